@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/config"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/migrate"
+)
+
+// Subcommands, so operators can manage an instance from a shell. They all
+// share the server's config and database.
+
+const commandUsage = `Usage: chirpy [--config FILE] [--print-config] [COMMAND]
+
+Commands:
+  serve                                  run the API server (the default)
+  migrate up|down|status                 manage the database schema
+  user create --email EMAIL [--password PASSWORD] [--red]
+  user list
+  user disable USER                      block logins and revoke the user's tokens
+  user promote USER                      upgrade to Chirpy Red
+  chirp delete CHIRP_ID
+  tokens prune [--older-than DURATION]   delete expired and revoked tokens
+  seed [--users N] [--chirps N]          fill a dev database with sample data
+
+USER is a user ID or email.
+`
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+}
+
+func runCommand(conf config.Config, db *sql.DB, args []string) error {
+	if len(args) == 0 || args[0] == "serve" {
+		return runServe(conf, db)
+	}
+
+	// Let Ctrl-C cancel whatever query is running
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	queries := database.New(db)
+	// Just enough of the server's config for commands that use withTx
+	cfg := &apiConfig{db: queries, sqlDB: db}
+
+	switch args[0] {
+	case "migrate":
+		migrator, err := migrate.New(db, slog.Default())
+		if err != nil {
+			return err
+		}
+		return runMigrateCommand(ctx, os.Stdout, migrator, args[1:])
+	case "user":
+		return runUserCommand(ctx, os.Stdout, cfg, args[1:])
+	case "chirp":
+		return runChirpCommand(ctx, os.Stdout, cfg, args[1:])
+	case "tokens":
+		return runTokensCommand(ctx, os.Stdout, queries, args[1:])
+	case "seed":
+		if conf.Platform != "dev" {
+			return errors.New("seed only runs with PLATFORM=dev, to keep sample data out of production")
+		}
+		return runSeedCommand(ctx, os.Stdout, queries, args[1:])
+	default:
+		return fmt.Errorf("unknown command '%s'\n\n%s", args[0], commandUsage)
+	}
+}
+
+// Finds a user by ID or email, whichever ref looks like
+func lookupUser(ctx context.Context, queries *database.Queries, ref string) (database.User, error) {
+	var user database.User
+	var err error
+	if id, parseErr := uuid.Parse(ref); parseErr == nil {
+		user, err = queries.GetUserByID(ctx, id)
+	} else {
+		user, err = queries.GetUserByEmail(ctx, ref)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, fmt.Errorf("no user '%s'", ref)
+	}
+	return user, err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/database"
+)
+
+// Runs 'chirpy chirp delete'
+func runChirpCommand(ctx context.Context, out io.Writer, cfg *apiConfig, args []string) error {
+	if len(args) != 2 || args[0] != "delete" {
+		return errors.New("usage: chirpy chirp delete CHIRP_ID")
+	}
+
+	chirpID, err := uuid.Parse(args[1])
+	if err != nil {
+		return fmt.Errorf("bad chirp ID: %w", err)
+	}
+	// Unlike the API, there's no author check - operators can delete anything
+	chirp, err := cfg.db.GetChirpByID(ctx, chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no chirp '%s'", chirpID)
+	} else if err != nil {
+		return fmt.Errorf("couldn't get chirp '%s': %w", chirpID, err)
+	}
+	// Recorded as the author's, as if they'd deleted it, so their webhooks
+	// hear about it
+	err = cfg.withTx(ctx, func(queries *database.Queries) error {
+		if err := queries.DeleteChirpByID(ctx, chirp.ID); err != nil {
+			return err
+		}
+		return recordEvent(ctx, queries, chirp.UserID, eventChirpDeleted, Chirp{
+			ID: chirp.ID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body: chirp.Body,
+			UserID: chirp.UserID,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't delete chirp '%s': %w", chirpID, err)
+	}
+
+	fmt.Fprintf(out, "Deleted chirp %s by user %s\n", chirp.ID, chirp.UserID)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/venzy/chirpy/internal/migrate"
+)
+
+// Runs 'chirpy migrate up|down|status'
+func runMigrateCommand(ctx context.Context, out io.Writer, migrator *migrate.Migrator, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpy migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		results, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		if len(results) == 0 {
+			fmt.Fprintln(out, "No pending migrations")
+		}
+		for _, result := range results {
+			fmt.Fprintf(out, "Applied %s (%s)\n", result.Source.Path, result.Duration.Round(time.Millisecond))
+		}
+	case "down":
+		result, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Rolled back %s (%s)\n", result.Source.Path, result.Duration.Round(time.Millisecond))
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "MIGRATION\tSTATE\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := ""
+			if !status.AppliedAt.IsZero() {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\n", status.Source.Path, status.State, appliedAt)
+		}
+		return table.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command '%s', must be up, down or status", args[0])
+	}
+	return nil
+}
+
+// Applies pending migrations if autoMigrate is set, then makes sure the schema
+// is at least as new as this build expects, since our queries depend on it.
+func ensureSchema(ctx context.Context, migrator *migrate.Migrator, autoMigrate bool) error {
+	if autoMigrate {
+		if _, err := migrator.Up(ctx); err != nil {
+			return fmt.Errorf("couldn't apply migrations: %w", err)
+		}
+	}
+
+	current, latest, err := migrator.Versions(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't get schema version: %w", err)
+	}
+	if current < latest {
+		return fmt.Errorf("schema is at version %d but this build needs %d - run 'chirpy migrate up' or set DB_AUTO_MIGRATE", current, latest)
+	}
+	if current > latest {
+		slog.Warn("Database schema is newer than this build expects", "version", current, "expected", latest)
+	}
+	return nil
+}
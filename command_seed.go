@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/database"
+)
+
+const seedPassword = "password"
+
+var seedChirpBodies = []string{
+	"Just setting up my chirpy",
+	"I had something interesting for breakfast",
+	"Gale! Gale! Gale!",
+	"What's everyone reading this week?",
+	"Chirping from the command line",
+}
+
+// Runs 'chirpy seed', creating sample users (seed-N@example.com, all with the
+// same password) with a few chirps each. Users that already exist are left
+// alone, so it's safe to run more than once.
+func runSeedCommand(ctx context.Context, out io.Writer, queries *database.Queries, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	userCount := flags.Int("users", 5, "number of users to create")
+	chirpCount := flags.Int("chirps", 3, "number of chirps per user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *userCount < 0 || *chirpCount < 0 {
+		return errors.New("--users and --chirps must not be negative")
+	}
+
+	hashedPassword, err := auth.HashPassword(seedPassword)
+	if err != nil {
+		return fmt.Errorf("couldn't hash password: %w", err)
+	}
+
+	created := 0
+	for i := 1; i <= *userCount; i++ {
+		email := fmt.Sprintf("seed-%d@example.com", i)
+		if _, err := queries.GetUserByEmail(ctx, email); err == nil {
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("couldn't check for user '%s': %w", email, err)
+		}
+
+		user, err := queries.CreateUser(ctx, database.CreateUserParams{
+			Email: email,
+			HashedPassword: hashedPassword,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't create user '%s': %w", email, err)
+		}
+		for j := range *chirpCount {
+			_, err := queries.CreateChirp(ctx, database.CreateChirpParams{
+				Body: seedChirpBodies[(i+j)%len(seedChirpBodies)],
+				UserID: user.ID,
+			})
+			if err != nil {
+				return fmt.Errorf("couldn't create chirp for '%s': %w", email, err)
+			}
+		}
+		created++
+	}
+
+	fmt.Fprintf(out, "Created %d users with %d chirps each, password '%s'\n", created, *chirpCount, seedPassword)
+	return nil
+}
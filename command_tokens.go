@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/venzy/chirpy/internal/database"
+)
+
+// Runs 'chirpy tokens prune'
+func runTokensCommand(ctx context.Context, out io.Writer, queries *database.Queries, args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return errors.New("usage: chirpy tokens prune [--older-than DURATION]")
+	}
+
+	flags := flag.NewFlagSet("tokens prune", flag.ContinueOnError)
+	// Recently revoked tokens are kept a while, since they still show up in
+	// users' token lists
+	olderThan := flags.Duration("older-than", 30*24*time.Hour, "only delete tokens that expired or were revoked at least this long ago")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *olderThan < 0 {
+		return errors.New("--older-than must not be negative")
+	}
+	cutoff := time.Now().Add(-*olderThan)
+
+	refreshTokens, err := queries.DeleteStaleRefreshTokens(ctx, cutoff)
+	if err != nil {
+		return fmt.Errorf("couldn't prune refresh tokens: %w", err)
+	}
+	apiTokens, err := queries.DeleteStaleAPITokens(ctx, cutoff)
+	if err != nil {
+		return fmt.Errorf("couldn't prune API tokens: %w", err)
+	}
+	if err := queries.DeleteExpiredOIDCAuthRequests(ctx); err != nil {
+		return fmt.Errorf("couldn't prune sign-in attempts: %w", err)
+	}
+
+	fmt.Fprintf(out, "Deleted %d refresh tokens and %d API tokens\n", refreshTokens, apiTokens)
+	return nil
+}
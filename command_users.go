@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/database"
+)
+
+// Runs 'chirpy user create|list|disable|promote'
+func runUserCommand(ctx context.Context, out io.Writer, cfg *apiConfig, args []string) error {
+	queries := cfg.db
+
+	if len(args) == 0 {
+		return errors.New("usage: chirpy user create|list|disable|promote")
+	}
+
+	switch args[0] {
+	case "create":
+		return runUserCreate(ctx, out, queries, args[1:])
+	case "list":
+		return runUserList(ctx, out, queries)
+	case "disable":
+		if len(args) != 2 {
+			return errors.New("usage: chirpy user disable USER")
+		}
+		return runUserDisable(ctx, out, cfg, args[1])
+	case "promote":
+		if len(args) != 2 {
+			return errors.New("usage: chirpy user promote USER")
+		}
+		user, err := lookupUser(ctx, queries, args[1])
+		if err != nil {
+			return err
+		}
+		if _, err := grantChirpyRed(ctx, queries, user.ID); err != nil {
+			return fmt.Errorf("couldn't promote user '%s': %w", user.Email, err)
+		}
+		fmt.Fprintf(out, "Upgraded %s (%s) to Chirpy Red\n", user.Email, user.ID)
+		return nil
+	default:
+		return fmt.Errorf("unknown user command '%s', must be create, list, disable or promote", args[0])
+	}
+}
+
+func runUserCreate(ctx context.Context, out io.Writer, queries *database.Queries, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	email := flags.String("email", "", "email address of the new user")
+	password := flags.String("password", "", "password for the new user, read from stdin if not given")
+	red := flags.Bool("red", false, "upgrade the new user to Chirpy Red")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Same rules as POST /api/users
+	if _, err := mail.ParseAddress(*email); err != nil {
+		return fmt.Errorf("bad email address: %w", err)
+	}
+	// Passing passwords as arguments leaves them in shell history
+	if *password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("couldn't read password: %w", err)
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	if len(*password) < 1 {
+		return errors.New("password is required")
+	}
+
+	hashedPassword, err := auth.HashPassword(*password)
+	if err != nil {
+		return fmt.Errorf("couldn't hash password: %w", err)
+	}
+	user, err := queries.CreateUser(ctx, database.CreateUserParams{
+		Email: *email,
+		HashedPassword: hashedPassword,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't create user: %w", err)
+	}
+	if *red {
+		if user, err = grantChirpyRed(ctx, queries, user.ID); err != nil {
+			return fmt.Errorf("created user %s but couldn't upgrade them: %w", user.ID, err)
+		}
+	}
+
+	fmt.Fprintf(out, "Created user %s (%s)\n", user.Email, user.ID)
+	return nil
+}
+
+func runUserList(ctx context.Context, out io.Writer, queries *database.Queries) error {
+	users, err := queries.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't list users: %w", err)
+	}
+
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tEMAIL\tCREATED\tRED\tDISABLED")
+	for _, user := range users {
+		disabled := ""
+		if user.DisabledAt.Valid {
+			disabled = user.DisabledAt.Time.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%t\t%s\n", user.ID, user.Email, user.CreatedAt.Format(time.RFC3339), user.IsChirpyRed, disabled)
+	}
+	return table.Flush()
+}
+
+// Disabled users can't log in, and all their refresh tokens and personal
+// access tokens are revoked. Access tokens already issued remain valid until
+// they expire.
+func runUserDisable(ctx context.Context, out io.Writer, cfg *apiConfig, ref string) error {
+	user, err := lookupUser(ctx, cfg.db, ref)
+	if err != nil {
+		return err
+	}
+
+	// All or nothing, so a user is never left disabled with working tokens
+	err = cfg.withTx(ctx, func(queries *database.Queries) error {
+		if _, err := queries.DisableUser(ctx, user.ID); err != nil {
+			return err
+		}
+		if err := queries.RevokeRefreshTokensByUserID(ctx, user.ID); err != nil {
+			return fmt.Errorf("couldn't revoke refresh tokens: %w", err)
+		}
+		if err := queries.RevokeAPITokensByUserID(ctx, user.ID); err != nil {
+			return fmt.Errorf("couldn't revoke API tokens: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't disable user '%s': %w", user.Email, err)
+	}
+
+	fmt.Fprintf(out, "Disabled %s (%s) and revoked their tokens\n", user.Email, user.ID)
+	return nil
+}
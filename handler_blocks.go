@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/database"
+)
+
+// Blocking and muting. A block hides two users from each other, whichever of
+// them made it: their chirps, notifications about each other, and messaging.
+// A mute only hides the muted user's chirps from the muter's own feed, i.e.
+// GET /api/chirps without an author_id.
+
+type Block struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Mute struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (cfg *apiConfig) handleBlockUser(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	blockedID, ok := cfg.otherUserFromBody(response, request, userID, "blocks")
+	if !ok {
+		return
+	}
+
+	// Along with the block, each disappears from the other's notifications
+	err := cfg.withTx(request.Context(), func(queries *database.Queries) error {
+		err := queries.BlockUser(request.Context(), database.BlockUserParams{
+			BlockerID: userID,
+			BlockedID: blockedID,
+		})
+		if err != nil {
+			return err
+		}
+		for _, pair := range [][2]uuid.UUID{{userID, blockedID}, {blockedID, userID}} {
+			err := queries.RemoveNotificationActor(request.Context(), database.RemoveNotificationActorParams{
+				ActorID: pair[1],
+				UserID: pair[0],
+			})
+			if err != nil {
+				return err
+			}
+			if err := queries.DeleteEmptyNotifications(request.Context(), pair[0]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		msg := fmt.Sprintf("blocks: Problem blocking user '%s': %s", blockedID, err)
+		loggerFrom(request.Context()).Error("blocks: Problem blocking user", "blocked_id", blockedID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// The users the user has blocked, most recent first. Doesn't include users
+// who've blocked them.
+func (cfg *apiConfig) handleGetBlocks(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	rows, err := cfg.db.GetBlocks(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("blocks: Problem retrieving blocks for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("blocks: Problem retrieving blocks", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	blocks := []Block{}
+	for _, row := range rows {
+		blocks = append(blocks, Block{UserID: row.BlockedID, CreatedAt: row.CreatedAt})
+	}
+	respondWithJSON(response, http.StatusOK, blocks)
+}
+
+func (cfg *apiConfig) handleUnblockUser(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	blockedID, err := uuid.Parse(request.PathValue("userID"))
+	if err != nil {
+		msg := fmt.Sprintf("blocks: Problem parsing userID from request: %s", err)
+		loggerFrom(request.Context()).Warn("blocks: Problem parsing userID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Notifications removed by the block stay removed
+	removed, err := cfg.db.UnblockUser(request.Context(), database.UnblockUserParams{
+		BlockerID: userID,
+		BlockedID: blockedID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("blocks: Problem unblocking user '%s': %s", blockedID, err)
+		loggerFrom(request.Context()).Error("blocks: Problem unblocking user", "blocked_id", blockedID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if removed == 0 {
+		msg := fmt.Sprintf("blocks: User '%s' hasn't blocked user '%s'", userID, blockedID)
+		loggerFrom(request.Context()).Warn("blocks: User hasn't blocked this user", "blocked_id", blockedID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handleMuteUser(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	mutedID, ok := cfg.otherUserFromBody(response, request, userID, "mutes")
+	if !ok {
+		return
+	}
+
+	err := cfg.db.MuteUser(request.Context(), database.MuteUserParams{
+		MuterID: userID,
+		MutedID: mutedID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("mutes: Problem muting user '%s': %s", mutedID, err)
+		loggerFrom(request.Context()).Error("mutes: Problem muting user", "muted_id", mutedID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// The users the user has muted, most recent first
+func (cfg *apiConfig) handleGetMutes(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	rows, err := cfg.db.GetMutes(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("mutes: Problem retrieving mutes for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("mutes: Problem retrieving mutes", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	mutes := []Mute{}
+	for _, row := range rows {
+		mutes = append(mutes, Mute{UserID: row.MutedID, CreatedAt: row.CreatedAt})
+	}
+	respondWithJSON(response, http.StatusOK, mutes)
+}
+
+func (cfg *apiConfig) handleUnmuteUser(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	mutedID, err := uuid.Parse(request.PathValue("userID"))
+	if err != nil {
+		msg := fmt.Sprintf("mutes: Problem parsing userID from request: %s", err)
+		loggerFrom(request.Context()).Warn("mutes: Problem parsing userID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	removed, err := cfg.db.UnmuteUser(request.Context(), database.UnmuteUserParams{
+		MuterID: userID,
+		MutedID: mutedID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("mutes: Problem unmuting user '%s': %s", mutedID, err)
+		loggerFrom(request.Context()).Error("mutes: Problem unmuting user", "muted_id", mutedID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if removed == 0 {
+		msg := fmt.Sprintf("mutes: User '%s' hasn't muted user '%s'", userID, mutedID)
+		loggerFrom(request.Context()).Warn("mutes: User hasn't muted this user", "muted_id", mutedID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// The existing user, other than userID, in a {"user_id": ...} request body.
+// Otherwise responds with an error, prefixed for the logs, and returns false.
+func (cfg *apiConfig) otherUserFromBody(response http.ResponseWriter, request *http.Request, userID uuid.UUID, prefix string) (uuid.UUID, bool) {
+	type requestParams struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("%s: Error decoding params: %s", prefix, err)
+		loggerFrom(request.Context()).Warn(prefix+": Error decoding params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return uuid.UUID{}, false
+	}
+	if params.UserID == userID {
+		msg := fmt.Sprintf("%s: user_id can't be yourself", prefix)
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return uuid.UUID{}, false
+	}
+
+	_, err = cfg.db.GetUserByID(request.Context(), params.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("%s: No user '%s'", prefix, params.UserID)
+		loggerFrom(request.Context()).Warn(prefix+": No such user", "target_user_id", params.UserID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return uuid.UUID{}, false
+	} else if err != nil {
+		msg := fmt.Sprintf("%s: Problem retrieving user '%s': %s", prefix, params.UserID, err)
+		loggerFrom(request.Context()).Error(prefix+": Problem retrieving user", "target_user_id", params.UserID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return uuid.UUID{}, false
+	}
+	return params.UserID, true
+}
+
+// Users whose chirps are hidden from viewerID: everyone blocked either way,
+// and if includeMuted, everyone they've muted
+func (cfg *apiConfig) hiddenUsers(ctx context.Context, viewerID uuid.UUID, includeMuted bool) (map[uuid.UUID]bool, error) {
+	hidden := map[uuid.UUID]bool{}
+	blocked, err := cfg.db.GetBlockedOrBlockingUserIDs(ctx, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range blocked {
+		hidden[id] = true
+	}
+	if !includeMuted {
+		return hidden, nil
+	}
+
+	muted, err := cfg.db.GetMutedUserIDs(ctx, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range muted {
+		hidden[id] = true
+	}
+	return hidden, nil
+}
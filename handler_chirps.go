@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"sort"
 	"strings"
@@ -30,24 +29,24 @@ func (cfg *apiConfig) handleCreateChirp(response http.ResponseWriter, request *h
 	params := requestParams{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		log.Printf("chirps: Error decoding createChirp params: %s\n", err)
+		loggerFrom(request.Context()).Error("chirps: Error decoding createChirp params", "error", err)
 		response.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Confirm user exists
-	_, err = cfg.db.GetUserByID(request.Context(), userID)
+	// Confirm user exists, and find what their plan allows
+	userEntitlements, err := cfg.entitlements.ForUser(request.Context(), userID)
 	if err != nil {
 		msg := fmt.Sprintf("chirps: Could not get user with ID '%s': %s", userID, err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("chirps: Could not get user", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
 
 	// Validate intended message
-	if len(params.Body) > cfg.maxChirpLength {
-		msg := fmt.Sprintf("chirps: chirp too long, must be less than or equal to %d chars", cfg.maxChirpLength)
-		log.Println(msg)
+	if len(params.Body) > userEntitlements.MaxChirpLength {
+		msg := fmt.Sprintf("chirps: chirp too long, must be less than or equal to %d chars", userEntitlements.MaxChirpLength)
+		loggerFrom(request.Context()).Warn(msg)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -55,10 +54,24 @@ func (cfg *apiConfig) handleCreateChirp(response http.ResponseWriter, request *h
 	// Clean up message
 	cleanedBody := cleanBody(params.Body)
 
-	// Create in DB
-	newChirpRow, err := cfg.db.CreateChirp(request.Context(), database.CreateChirpParams{
-		Body: cleanedBody,
-		UserID: userID,
+	// Create in DB, along with the event announcing it
+	var newChirp Chirp
+	err = cfg.withTx(request.Context(), func(queries *database.Queries) error {
+		newChirpRow, err := queries.CreateChirp(request.Context(), database.CreateChirpParams{
+			Body: cleanedBody,
+			UserID: userID,
+		})
+		if err != nil {
+			return err
+		}
+		newChirp = Chirp{
+			ID: newChirpRow.ID,
+			CreatedAt: newChirpRow.CreatedAt,
+			UpdatedAt: newChirpRow.UpdatedAt,
+			Body: newChirpRow.Body,
+			UserID: newChirpRow.UserID,
+		}
+		return recordEvent(request.Context(), queries, userID, eventChirpCreated, newChirp)
 	})
 	if err != nil {
 		msg := fmt.Sprintf("chirps: Problem creating chirp: %s", err)
@@ -66,14 +79,9 @@ func (cfg *apiConfig) handleCreateChirp(response http.ResponseWriter, request *h
 		return
 	}
 
+	cfg.metrics.chirpsCreated.With().Inc()
+
 	// Respond with success
-	newChirp := Chirp{
-		ID: newChirpRow.ID,
-		CreatedAt: newChirpRow.CreatedAt,
-		UpdatedAt: newChirpRow.UpdatedAt,
-		Body: newChirpRow.Body,
-		UserID: newChirpRow.UserID,
-	}
 	respondWithJSON(response, http.StatusCreated, newChirp)
 }
 
@@ -91,7 +99,9 @@ func cleanBody(body string) string {
 	return strings.Join(newSplitBody, " ")
 }
 
-func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *http.Request) {
+// Without chirps from anyone the viewer has blocked or been blocked by, or
+// muted unless asking for that author's chirps.
+func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *http.Request, viewer uuid.NullUUID) {
 	var chirpRows []database.Chirp
 
 	// Get optional query params
@@ -101,7 +111,7 @@ func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *htt
 	// Validate sort param
 	if sort_dir != "" && sort_dir != "asc" && sort_dir != "desc" {
 		msg := fmt.Sprintf("chirps: Invalid sort param '%s', must be 'asc' or 'desc'", sort_dir)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("chirps: Invalid sort param", "sort", sort_dir)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	} else if sort_dir == "" {
@@ -118,7 +128,7 @@ func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *htt
 		authorID, err := uuid.Parse(author_id)
 		if err != nil {
 			msg := fmt.Sprintf("chirps: Problem parsing author_id from request: %s", err)
-			log.Println(msg)
+			loggerFrom(request.Context()).Warn("chirps: Problem parsing author_id from request", "error", err)
 			respondWithError(response, http.StatusBadRequest, msg)
 			return
 		}
@@ -127,7 +137,7 @@ func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *htt
 		chirpRows, err = cfg.db.GetChirpsByAuthorID(request.Context(), authorID)
 		if err != nil {
 			msg := fmt.Sprintf("chirps: Problem retrieving chirps by author_id '%s': %s", authorID, err)
-			log.Println(msg)
+			loggerFrom(request.Context()).Error("chirps: Problem retrieving chirps by author", "author_id", authorID, "error", err)
 			respondWithError(response, http.StatusInternalServerError, msg)
 			return
 		}
@@ -137,7 +147,19 @@ func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *htt
 		chirpRows, err = cfg.db.GetChirps(request.Context())
 		if err != nil {
 			msg := fmt.Sprintf("chirps: Problem retrieving all chirps: %s", err)
-			log.Println(msg)
+			loggerFrom(request.Context()).Error("chirps: Problem retrieving all chirps", "error", err)
+			respondWithError(response, http.StatusInternalServerError, msg)
+			return
+		}
+	}
+
+	hidden := map[uuid.UUID]bool{}
+	if viewer.Valid {
+		var err error
+		hidden, err = cfg.hiddenUsers(request.Context(), viewer.UUID, author_id == "")
+		if err != nil {
+			msg := fmt.Sprintf("chirps: Problem retrieving users hidden from '%s': %s", viewer.UUID, err)
+			loggerFrom(request.Context()).Error("chirps: Problem retrieving hidden users", "error", err)
 			respondWithError(response, http.StatusInternalServerError, msg)
 			return
 		}
@@ -145,6 +167,9 @@ func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *htt
 
 	chirps := []Chirp{}
 	for _, chirp := range chirpRows {
+		if hidden[chirp.UserID] {
+			continue
+		}
 		chirps = append(chirps, Chirp{
 			ID: chirp.ID,
 			CreatedAt: chirp.CreatedAt,
@@ -165,12 +190,13 @@ func (cfg *apiConfig) handleGetChirps(response http.ResponseWriter, request *htt
 	respondWithJSON(response, http.StatusOK, chirps)
 }
 
-func (cfg *apiConfig) handleGetChirpByID(response http.ResponseWriter, request *http.Request) {
+// Chirps by anyone the viewer has blocked or been blocked by look missing
+func (cfg *apiConfig) handleGetChirpByID(response http.ResponseWriter, request *http.Request, viewer uuid.NullUUID) {
 	// Parse request params
 	chirpID, err := uuid.Parse(request.PathValue("chirpID"))
 	if err != nil {
 		msg := fmt.Sprintf("chirps: Problem parsing chirpID from request: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("chirps: Problem parsing chirpID from request", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -179,11 +205,30 @@ func (cfg *apiConfig) handleGetChirpByID(response http.ResponseWriter, request *
 	row, err := cfg.db.GetChirpByID(request.Context(), chirpID)
 	if err != nil {
 		msg := fmt.Sprintf("chirps: Problem retrieving chirp with id '%s': %s", chirpID, err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("chirps: Problem retrieving chirp", "chirp_id", chirpID, "error", err)
 		respondWithError(response, http.StatusNotFound, msg)
 		return
 	}
 
+	if viewer.Valid {
+		blocks, err := cfg.db.CountBlocksWith(request.Context(), database.CountBlocksWithParams{
+			UserID: viewer.UUID,
+			UserIds: []uuid.UUID{row.UserID},
+		})
+		if err != nil {
+			msg := fmt.Sprintf("chirps: Problem checking blocks for chirp with id '%s': %s", chirpID, err)
+			loggerFrom(request.Context()).Error("chirps: Problem checking blocks for chirp", "chirp_id", chirpID, "error", err)
+			respondWithError(response, http.StatusInternalServerError, msg)
+			return
+		}
+		if blocks > 0 {
+			msg := fmt.Sprintf("chirps: Chirp with id '%s' is hidden from user '%s'", chirpID, viewer.UUID)
+			loggerFrom(request.Context()).Warn("chirps: Chirp is hidden from user", "chirp_id", chirpID)
+			respondWithError(response, http.StatusNotFound, msg)
+			return
+		}
+	}
+
 	// Response
 	respondWithJSON(response, http.StatusOK, Chirp{
 		ID: row.ID,
@@ -199,7 +244,7 @@ func (cfg *apiConfig) handleDeleteChirpByID(response http.ResponseWriter, reques
 	chirpID, err := uuid.Parse(request.PathValue("chirpID"))
 	if err != nil {
 		msg := fmt.Sprintf("chirps: Problem parsing chirpID from request: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("chirps: Problem parsing chirpID from request", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -208,23 +253,34 @@ func (cfg *apiConfig) handleDeleteChirpByID(response http.ResponseWriter, reques
 	row, err := cfg.db.GetChirpByID(request.Context(), chirpID)
 	if err != nil {
 		msg := fmt.Sprintf("chirps: Problem retrieving chirp with id '%s': %s", chirpID, err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("chirps: Problem retrieving chirp", "chirp_id", chirpID, "error", err)
 		respondWithError(response, http.StatusNotFound, msg)
 		return
 	}
 
 	if row.UserID != userID {
 		msg := fmt.Sprintf("chirps: User '%s' does not own chirp '%s'", userID, chirpID)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("chirps: User does not own chirp", "chirp_id", chirpID)
 		respondWithError(response, http.StatusForbidden, msg)
 		return
 	}
 
-	// Delete chirp
-	err = cfg.db.DeleteChirpByID(request.Context(), chirpID)
-	if err != nil {	
+	// Delete chirp, along with the event announcing it
+	err = cfg.withTx(request.Context(), func(queries *database.Queries) error {
+		if err := queries.DeleteChirpByID(request.Context(), chirpID); err != nil {
+			return err
+		}
+		return recordEvent(request.Context(), queries, userID, eventChirpDeleted, Chirp{
+			ID: row.ID,
+			CreatedAt: row.CreatedAt,
+			UpdatedAt: row.UpdatedAt,
+			Body: row.Body,
+			UserID: row.UserID,
+		})
+	})
+	if err != nil {
 		msg := fmt.Sprintf("chirps: Problem deleting chirp with id '%s': %s", chirpID, err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Error("chirps: Problem deleting chirp", "chirp_id", chirpID, "error", err)
 		respondWithError(response, http.StatusInternalServerError, msg)
 		return
 	}
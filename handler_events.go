@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/events"
+)
+
+// Domain events are recorded in the outbox in the same transaction as the
+// change, then published to the subscribers registered in
+// subscribeToEvents by an events.Dispatcher in the background.
+
+// How often to look for events when not notified of new ones, e.g. to retry
+// failures or pick up events another replica committed
+const outboxPollInterval = 5 * time.Second
+
+// Registers everything that reacts to domain events
+func (cfg *apiConfig) subscribeToEvents(bus *events.Bus) {
+	bus.Subscribe("webhooks", cfg.queueWebhookDeliveries, eventChirpCreated, eventChirpDeleted)
+	bus.Subscribe("stream", cfg.notifyChirpCreated, eventChirpCreated)
+}
+
+// Runs fn in a transaction, committing if it returns nil and rolling back
+// otherwise. Queries run through the Queries it's given are observed like any
+// others.
+func (cfg *apiConfig) withTx(ctx context.Context, fn func(queries *database.Queries) error) error {
+	tx, err := cfg.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	if err := fn(cfg.db.WithHookedTx(tx)); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			loggerFrom(ctx).Error("Problem rolling back transaction", "error", rollbackErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	// Publish anything it recorded without waiting for the next poll
+	if cfg.eventDispatcher != nil {
+		cfg.eventDispatcher.Notify()
+	}
+	return nil
+}
+
+// Adds an event on the user's account to the outbox. Pass the Queries for the
+// transaction making the change, so it's only published if that's committed.
+func recordEvent(ctx context.Context, queries *database.Queries, userID uuid.UUID, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("couldn't encode %s event: %w", eventType, err)
+	}
+	err = queries.CreateOutboxEvent(ctx, database.CreateOutboxEventParams{
+		EventType: eventType,
+		UserID: userID,
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't record %s event: %w", eventType, err)
+	}
+	return nil
+}
+
+// The events.Store over the outbox table
+type outboxStore struct {
+	db *database.Queries
+}
+
+func (s outboxStore) Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]events.Event, error) {
+	rows, err := s.db.ClaimOutboxEvents(ctx, database.ClaimOutboxEventsParams{
+		MaxResults: int32(limit),
+		LeaseUntil: leaseUntil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := make([]events.Event, 0, len(rows))
+	for _, row := range rows {
+		claimed = append(claimed, events.Event{
+			ID: row.ID,
+			Type: row.EventType,
+			CreatedAt: row.CreatedAt,
+			UserID: row.UserID,
+			Payload: row.Payload,
+			Attempt: int(row.Attempts),
+		})
+	}
+	return claimed, nil
+}
+
+func (s outboxStore) Delete(ctx context.Context, event events.Event) error {
+	return s.db.DeleteOutboxEvent(ctx, event.ID)
+}
+
+func (s outboxStore) Retry(ctx context.Context, event events.Event, retryAt time.Time, reason string) error {
+	return s.db.RetryOutboxEvent(ctx, database.RetryOutboxEventParams{
+		ID: event.ID,
+		NextAttemptAt: retryAt,
+		LastError: sql.NullString{String: reason, Valid: true},
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/lockout"
+)
+
+// Brute-force protection for login. Failed attempts are counted both per
+// account and per client IP, and once either has failed too often further
+// attempts are refused with a 429 until the backoff has passed.
+//
+// Accounts are keyed by the email as supplied rather than by user ID, so an
+// unregistered email locks out exactly like a registered one and the responses
+// don't reveal which emails exist.
+
+const (
+	loginKeyEmail = "email"
+	loginKeyIP    = "ip"
+)
+
+type loginKey struct {
+	keyType string
+	key     string
+	policy  lockout.Policy
+}
+
+func normalizeLoginEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginKeys(request *http.Request, email string) []loginKey {
+	return []loginKey{
+		{keyType: loginKeyEmail, key: normalizeLoginEmail(email), policy: lockout.AccountPolicy},
+		{keyType: loginKeyIP, key: clientIP(request), policy: lockout.IPPolicy},
+	}
+}
+
+// Returns how long until another attempt is allowed, or zero if it is now.
+func (cfg *apiConfig) loginRetryAfter(ctx context.Context, keys []loginKey) (time.Duration, error) {
+	retryAfter := time.Duration(0)
+	for _, key := range keys {
+		failureDB, err := cfg.db.GetLoginFailure(ctx, database.GetLoginFailureParams{
+			KeyType: key.keyType,
+			Key: key.key,
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		if failureDB.LockedUntil.Valid {
+			if wait := time.Until(failureDB.LockedUntil.Time); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	return retryAfter, nil
+}
+
+// Best effort - a failure to record is logged rather than failing the request
+func (cfg *apiConfig) recordLoginFailure(ctx context.Context, keys []loginKey) {
+	for _, key := range keys {
+		failureDB, err := cfg.db.RecordLoginFailure(ctx, database.RecordLoginFailureParams{
+			KeyType: key.keyType,
+			Key: key.key,
+			WindowStart: time.Now().Add(-key.policy.Window),
+		})
+		if err != nil {
+			loggerFrom(ctx).Error("lockout: Couldn't record login failure", "key_type", key.keyType, "key", key.key, "error", err)
+			continue
+		}
+
+		lockedUntil := key.policy.LockedUntil(int(failureDB.Failures), failureDB.LastFailureAt)
+		if lockedUntil.IsZero() {
+			continue
+		}
+		if int(failureDB.Failures) >= key.policy.LockoutThreshold {
+			loggerFrom(ctx).Warn("lockout: Locking after repeated failures", "key_type", key.keyType, "key", key.key, "locked_until", lockedUntil, "failures", failureDB.Failures)
+		}
+		err = cfg.db.SetLoginLockedUntil(ctx, database.SetLoginLockedUntilParams{
+			KeyType: key.keyType,
+			Key: key.key,
+			LockedUntil: sql.NullTime{Time: lockedUntil, Valid: true},
+		})
+		if err != nil {
+			loggerFrom(ctx).Error("lockout: Couldn't lock", "key_type", key.keyType, "key", key.key, "error", err)
+		}
+	}
+}
+
+// Only the account is cleared on success - otherwise an attacker holding one
+// valid account could keep resetting their IP's count.
+func (cfg *apiConfig) clearLoginFailures(ctx context.Context, email string) {
+	_, err := cfg.db.ClearLoginFailures(ctx, database.ClearLoginFailuresParams{
+		KeyType: loginKeyEmail,
+		Key: normalizeLoginEmail(email),
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("lockout: Couldn't clear login failures", "email", email, "error", err)
+	}
+}
+
+func respondTooManyAttempts(response http.ResponseWriter, retryAfter time.Duration) {
+	response.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	respondWithError(response, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+}
+
+func (cfg *apiConfig) handleUnlockAccount(response http.ResponseWriter, request *http.Request) {
+	type requestParams struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("lockout: Error decoding unlockAccount params: %s", err)
+		loggerFrom(request.Context()).Warn("lockout: Error decoding unlockAccount params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	if params.Email == "" && params.IP == "" {
+		msg := "lockout: One of email or ip is required"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	cleared := int64(0)
+	for _, key := range []database.ClearLoginFailuresParams{
+		{KeyType: loginKeyEmail, Key: normalizeLoginEmail(params.Email)},
+		{KeyType: loginKeyIP, Key: params.IP},
+	} {
+		if key.Key == "" {
+			continue
+		}
+		count, err := cfg.db.ClearLoginFailures(request.Context(), key)
+		if err != nil {
+			msg := fmt.Sprintf("lockout: Problem unlocking %s '%s': %s", key.KeyType, key.Key, err)
+			loggerFrom(request.Context()).Error("lockout: Problem unlocking", "key_type", key.KeyType, "key", key.Key, "error", err)
+			respondWithError(response, http.StatusInternalServerError, msg)
+			return
+		}
+		cleared += count
+	}
+
+	loggerFrom(request.Context()).Info("lockout: Admin unlocked", "email", params.Email, "ip", params.IP)
+	respondWithJSON(response, http.StatusOK, map[string]int64{
+		"cleared": cleared,
+	})
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/notifications"
+	"github.com/venzy/chirpy/internal/pagination"
+)
+
+// Direct messages, in private conversations between two or a few users. A
+// conversation is only visible to its members; to anyone else it looks
+// missing. Users who've blocked each other, either way, can't start
+// conversations with each other, or send to ones they're both in. Members'
+// last_read_at are the read receipts: a message has been read by every member
+// whose last_read_at is at or after its created_at.
+
+const (
+	// Including whoever starts it
+	maxConversationMembers = 10
+	maxMessageLength       = 1000
+
+	defaultConversationListLimit = 20
+	maxConversationListLimit     = 100
+	defaultMessageListLimit      = 50
+	maxMessageListLimit          = 100
+)
+
+type Conversation struct {
+	ID          uuid.UUID            `json:"id"`
+	CreatedAt   time.Time            `json:"created_at"`
+	UpdatedAt   time.Time            `json:"updated_at"`
+	Members     []ConversationMember `json:"members"`
+	UnreadCount int64                `json:"unread_count"`
+}
+
+type ConversationMember struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	JoinedAt   time.Time  `json:"joined_at"`
+	LastReadAt *time.Time `json:"last_read_at"`
+}
+
+type Message struct {
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	ConversationID uuid.UUID `json:"conversation_id"`
+	SenderID       uuid.UUID `json:"sender_id"`
+	Body           string    `json:"body"`
+}
+
+func conversationMemberFromDB(row database.ConversationMember) ConversationMember {
+	return ConversationMember{
+		UserID: row.UserID,
+		JoinedAt: row.JoinedAt,
+		LastReadAt: nullTimePtr(row.LastReadAt),
+	}
+}
+
+func messageFromDB(row database.Message) Message {
+	return Message{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		ConversationID: row.ConversationID,
+		SenderID: row.SenderID,
+		Body: row.Body,
+	}
+}
+
+// Identifies the one-to-one conversation between two users, whichever of them
+// starts it
+func directKey(a, b uuid.UUID) string {
+	if b.String() < a.String() {
+		a, b = b, a
+	}
+	return a.String() + ":" + b.String()
+}
+
+// Starts a conversation with the other users in member_ids. Starting a
+// one-to-one conversation that already exists returns it, with 200 rather
+// than 201.
+func (cfg *apiConfig) handleCreateConversation(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type requestParams struct {
+		MemberIDs []uuid.UUID `json:"member_ids"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Error decoding createConversation params: %s", err)
+		loggerFrom(request.Context()).Warn("messages: Error decoding createConversation params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Everyone else, once each
+	others := []uuid.UUID{}
+	for _, memberID := range params.MemberIDs {
+		if memberID != userID && !slices.Contains(others, memberID) {
+			others = append(others, memberID)
+		}
+	}
+	if len(others) == 0 {
+		msg := "messages: member_ids must include someone other than you"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+	if len(others)+1 > maxConversationMembers {
+		msg := fmt.Sprintf("messages: Conversations can have at most %d members", maxConversationMembers)
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	active, err := cfg.db.CountActiveUsers(request.Context(), others)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem checking members: %s", err)
+		loggerFrom(request.Context()).Error("messages: Problem checking members", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if active != int64(len(others)) {
+		msg := "messages: Some member_ids aren't users"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	blocks, err := cfg.db.CountBlocksWith(request.Context(), database.CountBlocksWithParams{
+		UserID: userID,
+		UserIds: others,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem checking blocks: %s", err)
+		loggerFrom(request.Context()).Error("messages: Problem checking blocks", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if blocks > 0 {
+		msg := "messages: Can't start a conversation with users you've blocked, or who've blocked you"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusForbidden, msg)
+		return
+	}
+
+	// Only one-to-one conversations are unique; groups with the same members
+	// are separate conversations
+	var key sql.NullString
+	if len(others) == 1 {
+		key = sql.NullString{String: directKey(userID, others[0]), Valid: true}
+	}
+
+	var conversationRow database.Conversation
+	created := true
+	err = cfg.withTx(request.Context(), func(queries *database.Queries) error {
+		var err error
+		conversationRow, err = queries.CreateConversation(request.Context(), key)
+		if errors.Is(err, sql.ErrNoRows) && key.Valid {
+			created = false
+			conversationRow, err = queries.GetConversationByDirectKey(request.Context(), key)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		for _, memberID := range append([]uuid.UUID{userID}, others...) {
+			err := queries.AddConversationMember(request.Context(), database.AddConversationMemberParams{
+				ConversationID: conversationRow.ID,
+				UserID: memberID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem creating conversation: %s", err)
+		loggerFrom(request.Context()).Error("messages: Problem creating conversation", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	conversation, err := cfg.conversationFor(request.Context(), userID, conversationRow)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem retrieving conversation '%s': %s", conversationRow.ID, err)
+		loggerFrom(request.Context()).Error("messages: Problem retrieving conversation", "conversation_id", conversationRow.ID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	respondWithJSON(response, status, conversation)
+}
+
+// A page of the user's conversations, most recently active first. Pass the
+// next_cursor from one page as ?cursor= to get the next.
+func (cfg *apiConfig) handleGetConversations(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type responsePage struct {
+		Conversations []Conversation `json:"conversations"`
+		// Empty on the last page
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	limit, cursor, err := pageParams(request, defaultConversationListLimit, maxConversationListLimit)
+	if err != nil {
+		msg := fmt.Sprintf("messages: %s", err)
+		loggerFrom(request.Context()).Warn("messages: Invalid page params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	params := database.GetConversationsParams{
+		UserID: userID,
+		// One more than asked for, to tell whether there's another page
+		MaxResults: int32(limit + 1),
+	}
+	if cursor != nil {
+		params.BeforeUpdatedAt = sql.NullTime{Time: cursor.Time, Valid: true}
+		params.BeforeID = uuid.NullUUID{UUID: cursor.ID, Valid: true}
+	}
+
+	rows, err := cfg.db.GetConversations(request.Context(), params)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem retrieving conversations for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("messages: Problem retrieving conversations", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	page := responsePage{Conversations: []Conversation{}}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		page.NextCursor = pagination.Cursor{Time: last.UpdatedAt, ID: last.ID}.String()
+	}
+
+	conversationIDs := []uuid.UUID{}
+	for _, row := range rows {
+		conversationIDs = append(conversationIDs, row.ID)
+	}
+	memberRows, err := cfg.db.GetConversationMembers(request.Context(), conversationIDs)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem retrieving conversation members for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("messages: Problem retrieving conversation members", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	members := map[uuid.UUID][]ConversationMember{}
+	for _, memberRow := range memberRows {
+		members[memberRow.ConversationID] = append(members[memberRow.ConversationID], conversationMemberFromDB(memberRow))
+	}
+
+	for _, row := range rows {
+		page.Conversations = append(page.Conversations, Conversation{
+			ID: row.ID,
+			CreatedAt: row.CreatedAt,
+			UpdatedAt: row.UpdatedAt,
+			Members: members[row.ID],
+			UnreadCount: row.UnreadCount,
+		})
+	}
+	respondWithJSON(response, http.StatusOK, page)
+}
+
+func (cfg *apiConfig) handleGetConversation(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	conversationRow, ok := cfg.memberConversation(response, request, userID)
+	if !ok {
+		return
+	}
+
+	conversation, err := cfg.conversationFor(request.Context(), userID, conversationRow)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem retrieving conversation '%s': %s", conversationRow.ID, err)
+		loggerFrom(request.Context()).Error("messages: Problem retrieving conversation", "conversation_id", conversationRow.ID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	respondWithJSON(response, http.StatusOK, conversation)
+}
+
+// A page of the conversation's messages, newest first. Pass the next_cursor
+// from one page as ?cursor= to get the next. Doesn't mark anything read;
+// clients do that once the messages have been shown.
+func (cfg *apiConfig) handleGetMessages(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type responsePage struct {
+		Messages []Message `json:"messages"`
+		// Empty on the last page
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	conversationRow, ok := cfg.memberConversation(response, request, userID)
+	if !ok {
+		return
+	}
+
+	limit, cursor, err := pageParams(request, defaultMessageListLimit, maxMessageListLimit)
+	if err != nil {
+		msg := fmt.Sprintf("messages: %s", err)
+		loggerFrom(request.Context()).Warn("messages: Invalid page params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	params := database.GetMessagesParams{
+		ConversationID: conversationRow.ID,
+		// One more than asked for, to tell whether there's another page
+		MaxResults: int32(limit + 1),
+	}
+	if cursor != nil {
+		params.BeforeCreatedAt = sql.NullTime{Time: cursor.Time, Valid: true}
+		params.BeforeID = uuid.NullUUID{UUID: cursor.ID, Valid: true}
+	}
+
+	rows, err := cfg.db.GetMessages(request.Context(), params)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem retrieving messages for conversation '%s': %s", conversationRow.ID, err)
+		loggerFrom(request.Context()).Error("messages: Problem retrieving messages", "conversation_id", conversationRow.ID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	page := responsePage{Messages: []Message{}}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		page.NextCursor = pagination.Cursor{Time: last.CreatedAt, ID: last.ID}.String()
+	}
+	for _, row := range rows {
+		page.Messages = append(page.Messages, messageFromDB(row))
+	}
+	respondWithJSON(response, http.StatusOK, page)
+}
+
+func (cfg *apiConfig) handleSendMessage(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type requestParams struct {
+		Body string `json:"body"`
+	}
+
+	conversationRow, ok := cfg.memberConversation(response, request, userID)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("messages: Error decoding sendMessage params: %s", err)
+		loggerFrom(request.Context()).Warn("messages: Error decoding sendMessage params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+	if params.Body == "" || len(params.Body) > maxMessageLength {
+		msg := fmt.Sprintf("messages: body must be between 1 and %d chars", maxMessageLength)
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	memberRows, err := cfg.db.GetConversationMembers(request.Context(), []uuid.UUID{conversationRow.ID})
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem retrieving members of conversation '%s': %s", conversationRow.ID, err)
+		loggerFrom(request.Context()).Error("messages: Problem retrieving conversation members", "conversation_id", conversationRow.ID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	others := []uuid.UUID{}
+	for _, memberRow := range memberRows {
+		if memberRow.UserID != userID {
+			others = append(others, memberRow.UserID)
+		}
+	}
+	blocks, err := cfg.db.CountBlocksWith(request.Context(), database.CountBlocksWithParams{
+		UserID: userID,
+		UserIds: others,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem checking blocks in conversation '%s': %s", conversationRow.ID, err)
+		loggerFrom(request.Context()).Error("messages: Problem checking blocks", "conversation_id", conversationRow.ID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if blocks > 0 {
+		msg := fmt.Sprintf("messages: Can't send to conversation '%s', which has members you've blocked, or who've blocked you", conversationRow.ID)
+		loggerFrom(request.Context()).Warn("messages: Conversation has members blocked either way", "conversation_id", conversationRow.ID)
+		respondWithError(response, http.StatusForbidden, msg)
+		return
+	}
+
+	var message Message
+	err = cfg.withTx(request.Context(), func(queries *database.Queries) error {
+		messageRow, err := queries.CreateMessage(request.Context(), database.CreateMessageParams{
+			ConversationID: conversationRow.ID,
+			SenderID: userID,
+			Body: params.Body,
+		})
+		if err != nil {
+			return err
+		}
+		message = messageFromDB(messageRow)
+
+		// Moves it to the top of everyone's list
+		err = queries.TouchConversation(request.Context(), conversationRow.ID)
+		if err != nil {
+			return err
+		}
+		// Having written it, the sender has read everything up to it
+		_, err = queries.MarkConversationRead(request.Context(), database.MarkConversationReadParams{
+			ConversationID: conversationRow.ID,
+			UserID: userID,
+		})
+		if err != nil {
+			return err
+		}
+		for _, memberID := range others {
+			err = notifyUser(request.Context(), queries, memberID, userID, notifications.Message, uuid.NullUUID{}, conversationRow.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem sending message to conversation '%s': %s", conversationRow.ID, err)
+		loggerFrom(request.Context()).Error("messages: Problem sending message", "conversation_id", conversationRow.ID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	respondWithJSON(response, http.StatusCreated, message)
+}
+
+// Marks every message sent so far as read by the user, which the other
+// members see as their last_read_at
+func (cfg *apiConfig) handleMarkConversationRead(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	conversationID, err := uuid.Parse(request.PathValue("conversationID"))
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem parsing conversationID from request: %s", err)
+		loggerFrom(request.Context()).Warn("messages: Problem parsing conversationID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Only matches the user's own membership, so others' conversations look
+	// missing
+	marked, err := cfg.db.MarkConversationRead(request.Context(), database.MarkConversationReadParams{
+		ConversationID: conversationID,
+		UserID: userID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem marking conversation '%s' read: %s", conversationID, err)
+		loggerFrom(request.Context()).Error("messages: Problem marking conversation read", "conversation_id", conversationID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if marked == 0 {
+		msg := fmt.Sprintf("messages: No conversation '%s' for user '%s'", conversationID, userID)
+		loggerFrom(request.Context()).Warn("messages: No such conversation for user", "conversation_id", conversationID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Finds the conversation in the request path, if the user is a member.
+// Otherwise responds with an error, and returns false.
+func (cfg *apiConfig) memberConversation(response http.ResponseWriter, request *http.Request, userID uuid.UUID) (database.Conversation, bool) {
+	conversationID, err := uuid.Parse(request.PathValue("conversationID"))
+	if err != nil {
+		msg := fmt.Sprintf("messages: Problem parsing conversationID from request: %s", err)
+		loggerFrom(request.Context()).Warn("messages: Problem parsing conversationID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return database.Conversation{}, false
+	}
+
+	conversationRow, err := cfg.db.GetConversation(request.Context(), database.GetConversationParams{
+		ID: conversationID,
+		UserID: userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("messages: No conversation '%s' for user '%s'", conversationID, userID)
+		loggerFrom(request.Context()).Warn("messages: No such conversation for user", "conversation_id", conversationID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return database.Conversation{}, false
+	} else if err != nil {
+		msg := fmt.Sprintf("messages: Problem retrieving conversation '%s': %s", conversationID, err)
+		loggerFrom(request.Context()).Error("messages: Problem retrieving conversation", "conversation_id", conversationID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return database.Conversation{}, false
+	}
+	return conversationRow, true
+}
+
+// The conversation as the user sees it, with its members and their unread
+// count
+func (cfg *apiConfig) conversationFor(ctx context.Context, userID uuid.UUID, row database.Conversation) (Conversation, error) {
+	memberRows, err := cfg.db.GetConversationMembers(ctx, []uuid.UUID{row.ID})
+	if err != nil {
+		return Conversation{}, err
+	}
+	unread, err := cfg.db.CountUnreadMessages(ctx, database.CountUnreadMessagesParams{
+		ConversationID: row.ID,
+		UserID: userID,
+	})
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	conversation := Conversation{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+		Members: []ConversationMember{},
+		UnreadCount: unread,
+	}
+	for _, memberRow := range memberRows {
+		conversation.Members = append(conversation.Members, conversationMemberFromDB(memberRow))
+	}
+	return conversation, nil
+}
+
+// The ?limit= and ?cursor= of a request for a page of a list. cursor is nil
+// for the first page.
+func pageParams(request *http.Request, defaultLimit, maxLimit int) (int, *pagination.Cursor, error) {
+	limit := defaultLimit
+	if limitReq := request.URL.Query().Get("limit"); limitReq != "" {
+		var err error
+		limit, err = strconv.Atoi(limitReq)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return 0, nil, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+	}
+
+	cursorReq := request.URL.Query().Get("cursor")
+	if cursorReq == "" {
+		return limit, nil, nil
+	}
+	cursor, err := pagination.ParseCursor(cursorReq)
+	if err != nil {
+		return 0, nil, err
+	}
+	return limit, &cursor, nil
+}
@@ -1,21 +1,102 @@
 package main
 
 import (
-	"fmt"
-	"io"
+	"context"
+	"database/sql"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/venzy/chirpy/internal/metrics"
+	"github.com/venzy/chirpy/internal/server"
 )
 
-func (cfg *apiConfig) handleMetrics(response http.ResponseWriter, _ *http.Request) {
-	response.Header().Set("Content-Type", "text/html; charset=utf-8")
-	response.WriteHeader(http.StatusOK)
-	// Body
-	io.WriteString(response, fmt.Sprintf(`
-<html>
-  <body>
-    <h1>Welcome, Chirpy Admin</h1>
-    <p>Chirpy has been visited %d times!</p>
-  </body>
-</html>
-`, cfg.fileserverHits.Load()))
-}
\ No newline at end of file
+// Prometheus metrics, served at /metrics in the text exposition format.
+type appMetrics struct {
+	registry *metrics.Registry
+
+	fileserverHits  *metrics.CounterVec
+	httpRequests    *metrics.CounterVec
+	httpDuration    *metrics.HistogramVec
+	httpInFlight    *metrics.GaugeVec
+	dbQueries       *metrics.CounterVec
+	dbQueryDuration *metrics.HistogramVec
+	chirpsCreated   *metrics.CounterVec
+	logins          *metrics.CounterVec
+	loginFailures   *metrics.CounterVec
+	webhookEvents   *metrics.CounterVec
+}
+
+func newAppMetrics() *appMetrics {
+	registry := metrics.NewRegistry()
+	return &appMetrics{
+		registry: registry,
+		fileserverHits: registry.NewCounterVec("chirpy_fileserver_hits_total",
+			"Requests for static files under /app/."),
+		httpRequests: registry.NewCounterVec("chirpy_http_requests_total",
+			"HTTP requests served, by route pattern and status code.", "route", "code"),
+		httpDuration: registry.NewHistogramVec("chirpy_http_request_duration_seconds",
+			"HTTP request latency, by route pattern.", metrics.DefaultBuckets, "route"),
+		httpInFlight: registry.NewGaugeVec("chirpy_http_in_flight_requests",
+			"HTTP requests currently being served."),
+		dbQueries: registry.NewCounterVec("chirpy_db_queries_total",
+			"Database queries run, by sqlc query name and outcome.", "query", "result"),
+		dbQueryDuration: registry.NewHistogramVec("chirpy_db_query_duration_seconds",
+			"Database query latency, by sqlc query name.", metrics.DefaultBuckets, "query"),
+		chirpsCreated: registry.NewCounterVec("chirpy_chirps_created_total",
+			"Chirps created."),
+		logins: registry.NewCounterVec("chirpy_logins_total",
+			"Successful logins, by method.", "method"),
+		loginFailures: registry.NewCounterVec("chirpy_login_failures_total",
+			"Failed login attempts, by reason.", "reason"),
+		webhookEvents: registry.NewCounterVec("chirpy_webhook_events_total",
+			"Incoming webhook events, by provider and event type.", "provider", "event"),
+	}
+}
+
+func (cfg *apiConfig) handleMetrics(response http.ResponseWriter, request *http.Request) {
+	cfg.metrics.registry.Handler().ServeHTTP(response, request)
+}
+
+func (cfg *apiConfig) withMetricsInc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg.metrics.fileserverHits.With().Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Labels requests with the route pattern they matched (rather than the raw
+// path, which would explode the label space), so must go inside
+// withRequestLogging which resolves the route.
+func (cfg *apiConfig) withHTTPMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := requestRoute(r)
+
+		inFlight := cfg.metrics.httpInFlight.With()
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		recorder := server.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		cfg.metrics.httpRequests.With(route, strconv.Itoa(recorder.Status)).Inc()
+		cfg.metrics.httpDuration.With(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Records query counts and timings per sqlc query name
+func (m *appMetrics) queryHook(ctx context.Context, queryName string) (context.Context, func(err error)) {
+	start := time.Now()
+	return ctx, func(err error) {
+		result := "ok"
+		if errors.Is(err, sql.ErrNoRows) {
+			result = "no_rows"
+		} else if err != nil {
+			result = "error"
+		}
+		m.dbQueries.With(queryName, result).Inc()
+		m.dbQueryDuration.With(queryName).Observe(time.Since(start).Seconds())
+	}
+}
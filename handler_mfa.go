@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/database"
+)
+
+// Handlers for TOTP two-factor authentication.
+//
+// Enrollment is two steps: 'enroll' generates a secret for the user to add to
+// their authenticator app, then 'confirm' proves they did so by supplying a
+// code, at which point two-factor is switched on and recovery codes are issued.
+
+const totpIssuer = "Chirpy"
+const recoveryCodeCount = 10
+
+func (cfg *apiConfig) handleEnrollTOTP(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	user, err := cfg.db.GetUserByID(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Could not get user with ID '%s': %s", userID, err)
+		loggerFrom(request.Context()).Warn("mfa: Could not get user", "error", err)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	// Don't silently replace an active secret - the user must disable first
+	totpDB, err := cfg.db.GetTOTPCredentialByUserID(request.Context(), userID)
+	if err == nil && totpDB.ConfirmedAt.Valid {
+		msg := "mfa: Two-factor authentication is already enabled"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusConflict, msg)
+		return
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("mfa: Problem checking two-factor status: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Problem checking two-factor status", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	newSecret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Couldn't generate TOTP secret: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Couldn't generate TOTP secret", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	_, err = cfg.db.UpsertTOTPCredential(request.Context(), database.UpsertTOTPCredentialParams{
+		UserID: userID,
+		Secret: newSecret,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Problem storing TOTP secret: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Problem storing TOTP secret", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	respondWithJSON(response, http.StatusOK, map[string]string{
+		"secret": newSecret,
+		"otpauth_uri": auth.TOTPURI(totpIssuer, user.Email, newSecret),
+	})
+}
+
+func (cfg *apiConfig) handleConfirmTOTP(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type requestParams struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Error decoding confirmTOTP params: %s", err)
+		loggerFrom(request.Context()).Warn("mfa: Error decoding confirmTOTP params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	totpDB, err := cfg.db.GetTOTPCredentialByUserID(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: No two-factor enrollment in progress: %s", err)
+		loggerFrom(request.Context()).Warn("mfa: No two-factor enrollment in progress", "error", err)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+	if totpDB.ConfirmedAt.Valid {
+		msg := "mfa: Two-factor authentication is already enabled"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusConflict, msg)
+		return
+	}
+
+	step, err := auth.ValidateTOTP(totpDB.Secret, params.Code, time.Now())
+	if err != nil {
+		loggerFrom(request.Context()).Warn("mfa: Invalid code", "error", err)
+		respondWithError(response, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	// Replace any recovery codes left over from a previous enrollment
+	err = cfg.db.DeleteRecoveryCodesByUserID(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Problem clearing old recovery codes: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Problem clearing old recovery codes", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	newRecoveryCodes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Couldn't generate recovery codes: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Couldn't generate recovery codes", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	for _, code := range newRecoveryCodes {
+		codeHash, err := auth.HashPassword(code)
+		if err != nil {
+			msg := fmt.Sprintf("mfa: Problem hashing recovery code: %s", err)
+			loggerFrom(request.Context()).Error("mfa: Problem hashing recovery code", "error", err)
+			respondWithError(response, http.StatusInternalServerError, msg)
+			return
+		}
+		err = cfg.db.CreateRecoveryCode(request.Context(), database.CreateRecoveryCodeParams{
+			UserID: userID,
+			CodeHash: codeHash,
+		})
+		if err != nil {
+			msg := fmt.Sprintf("mfa: Problem storing recovery code: %s", err)
+			loggerFrom(request.Context()).Error("mfa: Problem storing recovery code", "error", err)
+			respondWithError(response, http.StatusInternalServerError, msg)
+			return
+		}
+	}
+
+	// Only switch two-factor on once the recovery codes are safely stored
+	err = cfg.db.ConfirmTOTPCredential(request.Context(), database.ConfirmTOTPCredentialParams{
+		UserID: userID,
+		LastUsedStep: step,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Problem enabling two-factor authentication: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Problem enabling two-factor authentication", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	respondWithJSON(response, http.StatusOK, map[string][]string{
+		"recovery_codes": newRecoveryCodes,
+	})
+}
+
+func (cfg *apiConfig) handleDisableTOTP(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type requestParams struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Error decoding disableTOTP params: %s", err)
+		loggerFrom(request.Context()).Warn("mfa: Error decoding disableTOTP params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Problem retrieving user: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Problem retrieving user", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	// As at login, guessing codes is subject to the same lockout as passwords
+	keys := loginKeys(request, user.Email)
+	retryAfter, err := cfg.loginRetryAfter(request.Context(), keys)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Couldn't check lockout status: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Couldn't check lockout status", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if retryAfter > 0 {
+		loggerFrom(request.Context()).Warn("mfa: disable refused while locked", "remote_ip", clientIP(request), "retry_after", retryAfter)
+		respondTooManyAttempts(response, retryAfter)
+		return
+	}
+
+	// A stolen access token alone shouldn't be enough to switch two-factor off
+	if err := cfg.verifySecondFactor(request, userID, params.Code, params.RecoveryCode); err != nil {
+		loggerFrom(request.Context()).Warn("mfa: Second factor rejected", "error", err)
+		cfg.recordLoginFailure(request.Context(), keys)
+		respondWithError(response, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	cfg.clearLoginFailures(request.Context(), user.Email)
+
+	err = cfg.db.DeleteTOTPCredential(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Problem disabling two-factor authentication: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Problem disabling two-factor authentication", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	err = cfg.db.DeleteRecoveryCodesByUserID(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Problem deleting recovery codes: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Problem deleting recovery codes", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Second step of login for users with two-factor enabled: exchanges the
+// challenge token from /api/login plus a TOTP or recovery code for access and
+// refresh tokens.
+func (cfg *apiConfig) handleLoginMFA(response http.ResponseWriter, request *http.Request) {
+	type requestParams struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Error decoding loginMFA params: %s", err)
+		loggerFrom(request.Context()).Warn("mfa: Error decoding loginMFA params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	userID, err := auth.ValidateMFAChallengeJWT(params.MFAToken, cfg.jwtSecret)
+	if err != nil {
+		loggerFrom(request.Context()).Warn("mfa: Invalid MFA challenge token", "error", err)
+		respondWithError(response, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(request.Context(), userID)
+	if err != nil {
+		loggerFrom(request.Context()).Warn("mfa: Could not get user", "user_id", userID, "error", err)
+		respondWithError(response, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	// Codes are only 6 digits, so guessing is subject to the same lockout as passwords
+	keys := loginKeys(request, user.Email)
+	retryAfter, err := cfg.loginRetryAfter(request.Context(), keys)
+	if err != nil {
+		msg := fmt.Sprintf("mfa: Couldn't check lockout status: %s", err)
+		loggerFrom(request.Context()).Error("mfa: Couldn't check lockout status", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if retryAfter > 0 {
+		cfg.metrics.loginFailures.With("locked").Inc()
+		loggerFrom(request.Context()).Warn("mfa: login refused while locked", "login_user_id", userID, "remote_ip", clientIP(request), "retry_after", retryAfter)
+		respondTooManyAttempts(response, retryAfter)
+		return
+	}
+
+	if err := cfg.verifySecondFactor(request, userID, params.Code, params.RecoveryCode); err != nil {
+		loggerFrom(request.Context()).Warn("mfa: Second factor rejected", "user_id", userID, "error", err)
+		cfg.metrics.loginFailures.With("bad_mfa_code").Inc()
+		cfg.recordLoginFailure(request.Context(), keys)
+		respondWithError(response, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	cfg.clearLoginFailures(request.Context(), user.Email)
+
+	cfg.respondWithLoginTokens(response, request, user, "mfa")
+}
+
+// Checks either a TOTP code or a recovery code (whichever was supplied),
+// consuming it so it can't be used again.
+func (cfg *apiConfig) verifySecondFactor(request *http.Request, userID uuid.UUID, code, recoveryCode string) error {
+	totpDB, err := cfg.db.GetTOTPCredentialByUserID(request.Context(), userID)
+	if err != nil {
+		return fmt.Errorf("couldn't get TOTP credential: %w", err)
+	}
+	if !totpDB.ConfirmedAt.Valid {
+		return errors.New("two-factor authentication is not enabled")
+	}
+
+	if code != "" {
+		step, err := auth.ValidateTOTP(totpDB.Secret, code, time.Now())
+		if err != nil {
+			return err
+		}
+		used, err := cfg.db.UseTOTPStep(request.Context(), database.UseTOTPStepParams{
+			UserID: userID,
+			LastUsedStep: step,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't record TOTP use: %w", err)
+		}
+		if used == 0 {
+			return errors.New("TOTP code was already used")
+		}
+		return nil
+	}
+
+	if recoveryCode != "" {
+		recoveryCodesDB, err := cfg.db.GetUnusedRecoveryCodesByUserID(request.Context(), userID)
+		if err != nil {
+			return fmt.Errorf("couldn't get recovery codes: %w", err)
+		}
+		normalized := auth.NormalizeRecoveryCode(recoveryCode)
+		for _, recoveryCodeDB := range recoveryCodesDB {
+			if auth.CheckPasswordHash(recoveryCodeDB.CodeHash, normalized) != nil {
+				continue
+			}
+			used, err := cfg.db.UseRecoveryCode(request.Context(), recoveryCodeDB.ID)
+			if err != nil {
+				return fmt.Errorf("couldn't record recovery code use: %w", err)
+			}
+			if used == 0 {
+				return errors.New("recovery code was already used")
+			}
+			return nil
+		}
+		return errors.New("recovery code does not match")
+	}
+
+	return errors.New("no code supplied")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/notifications"
+	"github.com/venzy/chirpy/internal/pagination"
+)
+
+// In-app notifications, created by notifyUser and read through the handlers
+// here. See the notifications package for how they're grouped.
+
+const (
+	defaultNotificationListLimit = 20
+	maxNotificationListLimit     = 100
+	// Actors listed in each notification, most recent first
+	notificationActorsShown = 3
+)
+
+type Notification struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Type      string     `json:"type"`
+	Summary   string     `json:"summary"`
+	ChirpID   *uuid.UUID `json:"chirp_id"`
+	// The most recent few, of ActorCount
+	ActorIDs   []uuid.UUID `json:"actor_ids"`
+	ActorCount int         `json:"actor_count"`
+	ReadAt     *time.Time  `json:"read_at"`
+}
+
+func notificationFromDB(row database.Notification) Notification {
+	notification := Notification{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+		Type: row.Type,
+		Summary: notifications.Summary(notifications.Type(row.Type), len(row.ActorIds)),
+		ActorIDs: row.ActorIds[:min(len(row.ActorIds), notificationActorsShown)],
+		ActorCount: len(row.ActorIds),
+		ReadAt: nullTimePtr(row.ReadAt),
+	}
+	if row.ChirpID.Valid {
+		notification.ChirpID = &row.ChirpID.UUID
+	}
+	return notification
+}
+
+// Notifies userID that actorID did something, e.g. liked their chirp. chirpID
+// is the user's chirp it's about, if any, and sourceID what caused it, e.g. the
+// reply or the conversation messaged in. Call it in the transaction making the
+// change, from whichever handler or event subscriber makes it. Repeats while
+// the notification is unread, notifying users of their own actions, and
+// notifications between users who've blocked each other do nothing.
+func notifyUser(ctx context.Context, queries *database.Queries, userID, actorID uuid.UUID, notificationType notifications.Type, chirpID uuid.NullUUID, sourceID uuid.UUID) error {
+	if userID == actorID {
+		return nil
+	}
+	_, err := queries.AddNotification(ctx, database.AddNotificationParams{
+		UserID: userID,
+		Type: string(notificationType),
+		GroupKey: notifications.GroupKey(notificationType, chirpID, sourceID),
+		ChirpID: chirpID,
+		ActorID: actorID,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't add %s notification: %w", notificationType, err)
+	}
+	return nil
+}
+
+// A page of notifications, newest first. Pass the next_cursor from one page
+// as ?cursor= to get the next.
+func (cfg *apiConfig) handleGetNotifications(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type responsePage struct {
+		Notifications []Notification `json:"notifications"`
+		UnreadCount   int64          `json:"unread_count"`
+		// Empty on the last page
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	limit, cursor, err := pageParams(request, defaultNotificationListLimit, maxNotificationListLimit)
+	if err != nil {
+		msg := fmt.Sprintf("notifications: %s", err)
+		loggerFrom(request.Context()).Warn("notifications: Invalid page params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	params := database.GetNotificationsParams{
+		UserID: userID,
+		// One more than asked for, to tell whether there's another page
+		MaxResults: int32(limit + 1),
+	}
+	if cursor != nil {
+		params.BeforeCreatedAt = sql.NullTime{Time: cursor.Time, Valid: true}
+		params.BeforeID = uuid.NullUUID{UUID: cursor.ID, Valid: true}
+	}
+
+	rows, err := cfg.db.GetNotifications(request.Context(), params)
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem retrieving notifications for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("notifications: Problem retrieving notifications", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	unread, err := cfg.db.CountUnreadNotifications(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem counting unread notifications for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("notifications: Problem counting unread notifications", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	page := responsePage{Notifications: []Notification{}, UnreadCount: unread}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		page.NextCursor = pagination.Cursor{Time: last.CreatedAt, ID: last.ID}.String()
+	}
+	for _, row := range rows {
+		page.Notifications = append(page.Notifications, notificationFromDB(row))
+	}
+	respondWithJSON(response, http.StatusOK, page)
+}
+
+func (cfg *apiConfig) handleMarkNotificationRead(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	notificationID, err := uuid.Parse(request.PathValue("notificationID"))
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem parsing notificationID from request: %s", err)
+		loggerFrom(request.Context()).Warn("notifications: Problem parsing notificationID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Only matches the user's own notifications, so other users' look missing
+	marked, err := cfg.db.MarkNotificationRead(request.Context(), database.MarkNotificationReadParams{
+		ID: notificationID,
+		UserID: userID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem marking notification '%s' read: %s", notificationID, err)
+		loggerFrom(request.Context()).Error("notifications: Problem marking notification read", "notification_id", notificationID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if marked == 0 {
+		msg := fmt.Sprintf("notifications: No notification '%s' for user '%s'", notificationID, userID)
+		loggerFrom(request.Context()).Warn("notifications: No such notification for user", "notification_id", notificationID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handleMarkAllNotificationsRead(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type responseBody struct {
+		Marked int64 `json:"marked"`
+	}
+
+	marked, err := cfg.db.MarkAllNotificationsRead(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem marking notifications read for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("notifications: Problem marking notifications read", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	respondWithJSON(response, http.StatusOK, responseBody{Marked: marked})
+}
+
+// Whether each type of notification is on, e.g. {"like": false, ...}
+func (cfg *apiConfig) handleGetNotificationPreferences(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	preferences, err := cfg.notificationPreferences(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem retrieving preferences for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("notifications: Problem retrieving preferences", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	respondWithJSON(response, http.StatusOK, preferences)
+}
+
+// Turns types on or off. Types left out of the request are unchanged.
+func (cfg *apiConfig) handleUpdateNotificationPreferences(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	decoder := json.NewDecoder(request.Body)
+	params := map[string]bool{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Error decoding preferences: %s", err)
+		loggerFrom(request.Context()).Warn("notifications: Error decoding preferences", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+	for notificationType := range params {
+		if !notifications.Type(notificationType).Valid() {
+			msg := fmt.Sprintf("notifications: Unknown notification type '%s'", notificationType)
+			loggerFrom(request.Context()).Warn("notifications: Unknown notification type", "type", notificationType)
+			respondWithError(response, http.StatusBadRequest, msg)
+			return
+		}
+	}
+
+	err = cfg.withTx(request.Context(), func(queries *database.Queries) error {
+		for notificationType, enabled := range params {
+			err := queries.SetNotificationPreference(request.Context(), database.SetNotificationPreferenceParams{
+				UserID: userID,
+				Type: notificationType,
+				Enabled: enabled,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem storing preferences for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("notifications: Problem storing preferences", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	preferences, err := cfg.notificationPreferences(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("notifications: Problem retrieving preferences for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("notifications: Problem retrieving preferences", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	respondWithJSON(response, http.StatusOK, preferences)
+}
+
+// Every type, on unless the user turned it off
+func (cfg *apiConfig) notificationPreferences(ctx context.Context, userID uuid.UUID) (map[string]bool, error) {
+	rows, err := cfg.db.GetNotificationPreferences(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	preferences := map[string]bool{}
+	for _, notificationType := range notifications.Types {
+		preferences[string(notificationType)] = true
+	}
+	for _, row := range rows {
+		preferences[row.Type] = row.Enabled
+	}
+	return preferences, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/oidc"
+)
+
+// Handlers for "sign in with X" via OpenID Connect providers.
+//
+// 'start' stores a state/nonce/PKCE verifier and redirects the browser to the
+// provider; the provider redirects back to 'callback' with a code, which is
+// exchanged for an ID token. The external identity is then matched to a chirpy
+// user (linking by verified email the first time) and chirpy's own tokens are
+// issued exactly as for a password login.
+//
+// 'start' also puts the state in a cookie, and 'callback' only accepts a state
+// that matches it. Otherwise anyone could start a sign-in themselves and send
+// someone else the callback link, signing them in to the attacker's account.
+
+const (
+	oidcAuthRequestExpiry = 10 * time.Minute
+	oidcStateCookie       = "chirpy_oidc_state"
+)
+
+func (cfg *apiConfig) handleOIDCStart(response http.ResponseWriter, request *http.Request) {
+	providerName := request.PathValue("provider")
+	provider, ok := cfg.oidcProviders[providerName]
+	if !ok {
+		msg := fmt.Sprintf("oidc: Unknown provider '%s'", providerName)
+		loggerFrom(request.Context()).Warn("oidc: Unknown provider", "provider", providerName)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	newState, err := oidc.GenerateState()
+	if err != nil {
+		msg := fmt.Sprintf("oidc: Couldn't generate state: %s", err)
+		loggerFrom(request.Context()).Error("oidc: Couldn't generate state", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	newNonce, err := oidc.GenerateState()
+	if err != nil {
+		msg := fmt.Sprintf("oidc: Couldn't generate nonce: %s", err)
+		loggerFrom(request.Context()).Error("oidc: Couldn't generate nonce", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	newVerifier, newChallenge, err := oidc.GeneratePKCE()
+	if err != nil {
+		msg := fmt.Sprintf("oidc: Couldn't generate PKCE verifier: %s", err)
+		loggerFrom(request.Context()).Error("oidc: Couldn't generate PKCE verifier", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(request.Context(), newState, newNonce, newChallenge)
+	if err != nil {
+		msg := fmt.Sprintf("oidc: Provider '%s' unavailable: %s", providerName, err)
+		loggerFrom(request.Context()).Error("oidc: Provider unavailable", "provider", providerName, "error", err)
+		respondWithError(response, http.StatusBadGateway, msg)
+		return
+	}
+
+	// Opportunistic cleanup of abandoned sign-in attempts
+	if err := cfg.db.DeleteExpiredOIDCAuthRequests(request.Context()); err != nil {
+		loggerFrom(request.Context()).Error("oidc: Couldn't delete expired auth requests", "error", err)
+	}
+
+	err = cfg.db.CreateOIDCAuthRequest(request.Context(), database.CreateOIDCAuthRequestParams{
+		State: newState,
+		Provider: providerName,
+		Nonce: newNonce,
+		CodeVerifier: newVerifier,
+		ExpiresAt: time.Now().Add(oidcAuthRequestExpiry),
+	})
+	if err != nil {
+		msg := fmt.Sprintf("oidc: Problem storing auth request: %s", err)
+		loggerFrom(request.Context()).Error("oidc: Problem storing auth request", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	http.SetCookie(response, cfg.oidcStateCookie(newState, int(oidcAuthRequestExpiry.Seconds())))
+	http.Redirect(response, request, authURL, http.StatusFound)
+}
+
+func (cfg *apiConfig) handleOIDCCallback(response http.ResponseWriter, request *http.Request) {
+	providerName := request.PathValue("provider")
+	provider, ok := cfg.oidcProviders[providerName]
+	if !ok {
+		msg := fmt.Sprintf("oidc: Unknown provider '%s'", providerName)
+		loggerFrom(request.Context()).Warn("oidc: Unknown provider", "provider", providerName)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	// Get query params
+	query := request.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		msg := fmt.Sprintf("oidc: Provider '%s' returned error '%s': %s", providerName, providerError, query.Get("error_description"))
+		loggerFrom(request.Context()).Warn("oidc: Provider returned an error", "provider", providerName, "provider_error", providerError, "error_description", query.Get("error_description"))
+		respondWithError(response, http.StatusUnauthorized, msg)
+		return
+	}
+	stateReq := query.Get("state")
+	codeReq := query.Get("code")
+	if stateReq == "" || codeReq == "" {
+		msg := "oidc: Callback is missing state or code"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// The state must be the one issued to this browser
+	stateCookie, err := request.Cookie(oidcStateCookie)
+	if err != nil || !auth.SecretsEqual(stateCookie.Value, stateReq) {
+		msg := "oidc: State doesn't match this browser's sign-in attempt"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusUnauthorized, "Invalid or expired sign-in attempt")
+		return
+	}
+	http.SetCookie(response, cfg.oidcStateCookie("", -1))
+
+	// Each state is single use, and must have been issued for this provider
+	authRequestDB, err := cfg.db.TakeOIDCAuthRequest(request.Context(), stateReq)
+	if err != nil {
+		loggerFrom(request.Context()).Warn("oidc: Unknown or already used state", "error", err)
+		respondWithError(response, http.StatusUnauthorized, "Invalid or expired sign-in attempt")
+		return
+	}
+	if authRequestDB.Provider != providerName || authRequestDB.ExpiresAt.Before(time.Now()) {
+		loggerFrom(request.Context()).Warn("oidc: State is expired or for another provider", "provider", authRequestDB.Provider)
+		respondWithError(response, http.StatusUnauthorized, "Invalid or expired sign-in attempt")
+		return
+	}
+
+	claims, err := provider.Exchange(request.Context(), codeReq, authRequestDB.CodeVerifier, authRequestDB.Nonce)
+	if err != nil {
+		loggerFrom(request.Context()).Warn("oidc: Couldn't exchange code with provider", "provider", providerName, "error", err)
+		respondWithError(response, http.StatusUnauthorized, "Sign-in with provider failed")
+		return
+	}
+
+	user, err := cfg.getOrLinkOIDCUser(request, providerName, claims)
+	if err != nil {
+		loggerFrom(request.Context()).Warn("oidc: Couldn't match identity to a user", "subject", claims.Subject, "provider", providerName, "error", err)
+		respondWithError(response, http.StatusForbidden, "Couldn't sign in with this identity")
+		return
+	}
+
+	cfg.completeLogin(response, request, user, "oidc")
+}
+
+// Sent only to the callback, and only over HTTPS outside dev. Lax, since the
+// provider redirecting back is a cross-site navigation. maxAge < 0 deletes it.
+func (cfg *apiConfig) oidcStateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name: oidcStateCookie,
+		Value: state,
+		Path: "/api/auth/",
+		MaxAge: maxAge,
+		HttpOnly: true,
+		Secure: cfg.platform != Dev,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Finds the user already linked to this external identity, or links it to the
+// user with the same (provider-verified) email, creating that user if needed.
+func (cfg *apiConfig) getOrLinkOIDCUser(request *http.Request, providerName string, claims *oidc.Claims) (database.User, error) {
+	identityDB, err := cfg.db.GetUserIdentity(request.Context(), database.GetUserIdentityParams{
+		Provider: providerName,
+		Subject: claims.Subject,
+	})
+	if err == nil {
+		return cfg.db.GetUserByID(request.Context(), identityDB.UserID)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, err
+	}
+
+	// Linking by an unverified email would let anyone claim any account
+	if claims.Email == "" || !claims.EmailVerified {
+		return database.User{}, errors.New("provider did not supply a verified email")
+	}
+
+	user, err := cfg.db.GetUserByEmail(request.Context(), claims.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Users created this way get a random password nobody knows, so they
+		// can only sign in via the provider (until they set one)
+		randomPassword, err := auth.MakeRefreshToken()
+		if err != nil {
+			return database.User{}, err
+		}
+		hashedPassword, err := auth.HashPassword(randomPassword)
+		if err != nil {
+			return database.User{}, err
+		}
+		user, err = cfg.db.CreateUser(request.Context(), database.CreateUserParams{
+			Email: claims.Email,
+			HashedPassword: hashedPassword,
+		})
+		if err != nil {
+			return database.User{}, err
+		}
+	} else if err != nil {
+		return database.User{}, err
+	}
+
+	_, err = cfg.db.CreateUserIdentity(request.Context(), database.CreateUserIdentityParams{
+		UserID: user.ID,
+		Provider: providerName,
+		Subject: claims.Subject,
+		Email: claims.Email,
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+
+	return user, nil
+}
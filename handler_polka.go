@@ -1,52 +1,255 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/subscriptions"
 )
 
 // Handlers for Polka payment processing webhooks
 
+const (
+	polkaProvider = "polka"
+	polkaSignatureHeader = "Polka-Signature"
+	// Polka's payloads are tiny, anything near this is not from them
+	maxWebhookBodyBytes = 1 << 20
+	// An event still processing after this long was abandoned, e.g. by a
+	// crash mid delivery, and may be claimed again
+	webhookProcessingLease = 5 * time.Minute
+)
+
+var (
+	errWebhookUnknownEvent = errors.New("unknown event type")
+	errWebhookUserNotFound = errors.New("user not found")
+)
+
+type polkaEvent struct {
+	// Optional - stays the same when Polka redelivers an event
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	// Optional - when the event happened, otherwise when we first received it
+	CreatedAt *time.Time `json:"created_at"`
+	Data      struct {
+		UserID uuid.UUID `json:"user_id"`
+		// Optional - the billing period paid for, on upgrades and renewals
+		PeriodStart *time.Time `json:"period_start"`
+		PeriodEnd   *time.Time `json:"period_end"`
+	} `json:"data"`
+}
+
+// Polka retries anything but a 2xx, so each delivery is recorded and repeats
+// of an event we've already handled are acknowledged without applying them
+// again. Failed or abandoned events are retried by the next delivery, or
+// replayed by an admin.
 // NOTE: Ideally negative responses should include a retry-after header. Not including for now.
 func (cfg *apiConfig) handlePolkaWebhook(response http.ResponseWriter, request *http.Request) {
-	// Check API key
-	apiKey, err := auth.GetAPIKey(request.Header)
-	if err != nil || apiKey != cfg.polkaKey {
-		msg := "polka: Invalid or missing API key"
-		log.Println(msg)
-		respondWithError(response, http.StatusUnauthorized, msg)
+	// Keep the raw body, it's what's signed, and what we store and replay
+	body, err := io.ReadAll(http.MaxBytesReader(response, request.Body, maxWebhookBodyBytes))
+	if err != nil {
+		msg := fmt.Sprintf("polka: Error reading webhook body: %s", err)
+		loggerFrom(request.Context()).Warn("polka: Error reading webhook body", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
 
-	// Parse request params
-	var params struct {
-		Event string `json:"event"`
-		Data struct {
-			UserID uuid.UUID `json:"user_id"`
-		}
+	if err := cfg.authenticatePolkaWebhook(request.Header, body); err != nil {
+		// Why is only logged, so senders can't probe which check failed
+		loggerFrom(request.Context()).Warn("polka: Rejected webhook", "remote_ip", clientIP(request), "error", err)
+		respondWithError(response, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
 
-	decoder := json.NewDecoder(request.Body)
-	err = decoder.Decode(&params)
+	var event polkaEvent
+	err = json.Unmarshal(body, &event)
 	if err != nil {
 		msg := fmt.Sprintf("polka: Error decoding webhook params: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("polka: Error decoding webhook params", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
 
-	switch params.Event {
-	case "user.upgraded":
-		cfg.handleUserUpgrade(response, request, params.Data.UserID)
-	default:
-		msg := fmt.Sprintf("polka: Unknown event type: %s", params.Event)
-		log.Println(msg)
-		respondWithError(response, http.StatusNoContent, msg)
+	cfg.metrics.webhookEvents.With(polkaProvider, event.Event).Inc()
+	eventID := polkaEventID(event)
+
+	eventDB, err := cfg.db.CreateWebhookEvent(request.Context(), database.CreateWebhookEventParams{
+		Provider: polkaProvider,
+		EventID: eventID,
+		EventType: event.Event,
+		Payload: body,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// Seen it before - only try again if it failed or was abandoned last
+		// time
+		eventDB, err = cfg.claimRedeliveredWebhookEvent(request.Context(), polkaProvider, eventID)
+		if errors.Is(err, sql.ErrNoRows) {
+			loggerFrom(request.Context()).Info("polka: Acknowledging duplicate delivery", "event_id", eventID)
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("polka: Problem recording webhook event: %s", err)
+		loggerFrom(request.Context()).Error("polka: Problem recording webhook event", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
 		return
 	}
-}
\ No newline at end of file
+
+	code, err := cfg.processWebhookEvent(request.Context(), eventDB)
+	if err != nil {
+		msg := fmt.Sprintf("polka: Problem processing event '%s': %s", eventDB.EventID, err)
+		loggerFrom(request.Context()).Warn("polka: Problem processing event", "event_id", eventDB.EventID, "error", err)
+		respondWithError(response, code, msg)
+		return
+	}
+	response.WriteHeader(code)
+}
+
+// Once signing secrets are configured the static API key is no longer
+// accepted, otherwise anyone holding it could skip the signature
+func (cfg *apiConfig) authenticatePolkaWebhook(headers http.Header, body []byte) error {
+	if len(cfg.polkaSigningSecrets) > 0 {
+		return auth.ValidateWebhookSignature(headers.Get(polkaSignatureHeader), body, cfg.polkaSigningSecrets, cfg.polkaSignatureTolerance, time.Now())
+	}
+
+	apiKey, err := auth.GetAPIKey(headers)
+	if err != nil {
+		return err
+	}
+	if !auth.SecretsEqual(apiKey, cfg.polkaKey) {
+		return errors.New("invalid API key")
+	}
+	return nil
+}
+
+// Without an ID from Polka, a redelivery can't be told apart from a new event
+// with the same body, e.g. an upgrade after a downgrade, so each delivery is
+// recorded as an event of its own and applied.
+func polkaEventID(event polkaEvent) string {
+	if event.ID != "" {
+		return event.ID
+	}
+	return "delivery:" + uuid.NewString()
+}
+
+// Claims a previously seen event for another attempt, if it failed or was
+// abandoned. Returns sql.ErrNoRows if it shouldn't be processed again.
+func (cfg *apiConfig) claimRedeliveredWebhookEvent(ctx context.Context, provider, eventID string) (database.WebhookEvent, error) {
+	existing, err := cfg.db.GetWebhookEvent(ctx, database.GetWebhookEventParams{
+		Provider: provider,
+		EventID: eventID,
+	})
+	if err != nil {
+		return database.WebhookEvent{}, err
+	}
+	return cfg.retryWebhookEvent(ctx, existing.ID)
+}
+
+// Claims an event for another attempt if it failed, or has been processing for
+// longer than webhookProcessingLease. Returns sql.ErrNoRows otherwise.
+func (cfg *apiConfig) retryWebhookEvent(ctx context.Context, id uuid.UUID) (database.WebhookEvent, error) {
+	return cfg.db.RetryWebhookEvent(ctx, database.RetryWebhookEventParams{
+		ID: id,
+		StaleBefore: time.Now().Add(-webhookProcessingLease),
+	})
+}
+
+// Applies a claimed event and records the outcome. Returns the status code to
+// report, and the error if it couldn't be applied.
+func (cfg *apiConfig) processWebhookEvent(ctx context.Context, eventDB database.WebhookEvent) (int, error) {
+	var err error
+	switch eventDB.Provider {
+	case polkaProvider:
+		err = cfg.applyPolkaEvent(ctx, eventDB.Payload, eventDB.CreatedAt)
+	default:
+		err = fmt.Errorf("%w from provider '%s'", errWebhookUnknownEvent, eventDB.Provider)
+	}
+
+	status, code := "processed", http.StatusNoContent
+	switch {
+	case err == nil:
+	case errors.Is(err, errWebhookUnknownEvent):
+		// Nothing to do, and no point in the sender retrying
+		status = "ignored"
+	case errors.Is(err, errWebhookUserNotFound):
+		status, code = "failed", http.StatusNotFound
+	default:
+		status, code = "failed", http.StatusInternalServerError
+	}
+
+	finishErr := cfg.db.FinishWebhookEvent(ctx, database.FinishWebhookEventParams{
+		ID: eventDB.ID,
+		Status: status,
+		Error: sql.NullString{String: errorString(err), Valid: err != nil},
+	})
+	if finishErr != nil {
+		// The event itself was handled, so just leave it showing as processing
+		loggerFrom(ctx).Error("webhooks: Problem recording event outcome", "id", eventDB.ID, "status", status, "error", finishErr)
+	}
+
+	if status == "ignored" {
+		return code, nil
+	}
+	return code, err
+}
+
+// Events can arrive late or out of order, so each is applied as of when it
+// happened, and ignored if the subscription has since moved on.
+func (cfg *apiConfig) applyPolkaEvent(ctx context.Context, payload json.RawMessage, receivedAt time.Time) error {
+	var event polkaEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	switch event.Event {
+	case "user.upgraded", "subscription.renewed", "payment.failed", "user.downgraded", "payment.refunded":
+	default:
+		return fmt.Errorf("%w: %s", errWebhookUnknownEvent, event.Event)
+	}
+
+	// Check user exists separately rather than trying to parse the error
+	userID := event.Data.UserID
+	if _, err := cfg.db.GetUserByID(ctx, userID); err != nil {
+		return fmt.Errorf("%w: '%s': %s", errWebhookUserNotFound, userID, err)
+	}
+
+	at := receivedAt
+	if event.CreatedAt != nil {
+		at = *event.CreatedAt
+	}
+
+	switch event.Event {
+	case "user.upgraded", "subscription.renewed":
+		periodStart := at
+		if event.Data.PeriodStart != nil {
+			periodStart = *event.Data.PeriodStart
+		}
+		periodEnd := periodStart.Add(defaultSubscriptionPeriod)
+		if event.Data.PeriodEnd != nil {
+			periodEnd = *event.Data.PeriodEnd
+		}
+		return cfg.renewSubscription(ctx, userID, at, periodStart, periodEnd)
+	case "payment.failed":
+		return cfg.markSubscriptionPastDue(ctx, userID, at)
+	case "user.downgraded":
+		return cfg.endSubscription(ctx, userID, subscriptions.Canceled, at)
+	default: // "payment.refunded"
+		return cfg.endSubscription(ctx, userID, subscriptions.Refunded, at)
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
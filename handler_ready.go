@@ -1,13 +1,77 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 )
 
-func handleReady(response http.ResponseWriter, request *http.Request) {
+// Health probes. Liveness only says the process is up and serving, so a
+// restart would help if it fails; readiness says whether we can usefully take
+// traffic right now, which depends on the database.
+
+const readinessCheckTimeout = 2 * time.Second
+
+func handleLivez(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	response.WriteHeader(http.StatusOK)
 	// Body
 	io.WriteString(response, "OK")
-}
\ No newline at end of file
+}
+
+type readinessCheck struct {
+	Status string `json:"status"`
+}
+
+type readinessResponse struct {
+	Status string                    `json:"status"`
+	Checks map[string]readinessCheck `json:"checks"`
+}
+
+// The probe is unauthenticated, so why a check failed is only logged
+func (cfg *apiConfig) handleReadyz(response http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	errs := map[string]error{
+		"shutdown": cfg.checkNotDraining(),
+		"database": cfg.sqlDB.PingContext(ctx),
+		"migrations": cfg.checkSchemaVersion(ctx),
+	}
+
+	ready := readinessResponse{Status: "ok", Checks: map[string]readinessCheck{}}
+	status := http.StatusOK
+	for name, err := range errs {
+		if err != nil {
+			loggerFrom(request.Context()).Warn("readyz: Check failed", "check", name, "error", err)
+			ready.Checks[name] = readinessCheck{Status: "failing"}
+			ready.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		ready.Checks[name] = readinessCheck{Status: "ok"}
+	}
+	respondWithJSON(response, status, ready)
+}
+
+func (cfg *apiConfig) checkNotDraining() error {
+	if cfg.draining.Load() {
+		return fmt.Errorf("shutting down")
+	}
+	return nil
+}
+
+// An older schema means our queries may fail. A newer one is expected while a
+// deploy rolls out, since migrations run before the old replicas are replaced.
+func (cfg *apiConfig) checkSchemaVersion(ctx context.Context) error {
+	version, err := cfg.db.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version < cfg.schemaVersion {
+		return fmt.Errorf("schema is at version %d, expected at least %d", version, cfg.schemaVersion)
+	}
+	return nil
+}
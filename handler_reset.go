@@ -11,9 +11,6 @@ func (cfg *apiConfig) handleReset(response http.ResponseWriter, _ *http.Request)
 		response.WriteHeader(http.StatusForbidden)
 	}
 
-	// Reset metrics
-	cfg.fileserverHits.Store(0)
-
 	// Reset database
 	err := cfg.db.DeleteUsers(context.Background())
 	if err != nil {
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/events"
+	"github.com/venzy/chirpy/internal/stream"
+)
+
+// New chirps streamed to clients as Server-Sent Events. Whichever server
+// publishes a chirp.created event sends a NOTIFY on chirp_created, and every
+// server LISTENs for it and fans the chirp out to its own streams, so clients
+// see every chirp whichever server they're connected to.
+
+const (
+	chirpCreatedChannel = "chirp_created"
+	// Sent when idle, so proxies don't close the connection
+	streamHeartbeatInterval = 15 * time.Second
+	// Chirps a client can fall behind by before it's disconnected, to
+	// reconnect and catch up with Last-Event-ID
+	streamClientBuffer = 64
+	// How long writing to a client may take before we give up on it
+	streamWriteTimeout = 10 * time.Second
+	// Per server, since each holds a connection open. WebSockets have their
+	// own limit.
+	maxStreams = 1000
+	// Chirps fetched per query when catching up a resumed stream
+	streamBacklogPage = 100
+	// How long clients should wait before reconnecting
+	streamRetry = 3 * time.Second
+)
+
+// Subscribed to chirp.created, to have every server stream the chirp
+func (cfg *apiConfig) notifyChirpCreated(ctx context.Context, event events.Event) error {
+	var chirp Chirp
+	if err := json.Unmarshal(event.Payload, &chirp); err != nil {
+		return fmt.Errorf("couldn't decode chirp: %w", err)
+	}
+	// Just the ID, since notifications are limited to 8000 bytes
+	return cfg.db.NotifyChirpCreated(ctx, chirp.ID.String())
+}
+
+// Streams new chirps, optionally only those by ?author_id=. A client that
+// reconnects with Last-Event-ID is first sent the chirps it missed.
+func (cfg *apiConfig) handleStreamChirps(response http.ResponseWriter, request *http.Request) {
+	authorID := uuid.NullUUID{}
+	if authorReq := request.URL.Query().Get("author_id"); authorReq != "" {
+		id, err := uuid.Parse(authorReq)
+		if err != nil {
+			msg := fmt.Sprintf("stream: Problem parsing author_id from request: %s", err)
+			loggerFrom(request.Context()).Warn("stream: Problem parsing author_id from request", "error", err)
+			respondWithError(response, http.StatusBadRequest, msg)
+			return
+		}
+		authorID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	if !reserveConnection(&cfg.openStreams, maxStreams) {
+		msg := "stream: Too many streams open, try again later"
+		loggerFrom(request.Context()).Warn(msg)
+		response.Header().Set("Retry-After", fmt.Sprintf("%d", int(streamRetry.Seconds())))
+		respondWithError(response, http.StatusServiceUnavailable, msg)
+		return
+	}
+	defer cfg.openStreams.Add(-1)
+
+	// Subscribe before catching up, so nothing published meanwhile is missed
+	topic := ""
+	if authorID.Valid {
+		topic = authorID.UUID.String()
+	}
+	sub := cfg.streamHub.Subscribe(topic, streamClientBuffer)
+	defer sub.Close()
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx and the like buffering the stream
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(response)
+	// The server's ReadTimeout and WriteTimeout would end every stream, so
+	// clear the first and give each write its own deadline instead
+	if err := controller.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		loggerFrom(request.Context()).Warn("stream: Couldn't clear read deadline", "error", err)
+	}
+	write := func(writeFn func() error) error {
+		err := controller.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		if err := writeFn(); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	logger := loggerFrom(request.Context())
+	if err := write(func() error { return stream.WriteRetry(response, int(streamRetry.Milliseconds())) }); err != nil {
+		logger.Warn("stream: Problem writing to client", "error", err)
+		return
+	}
+
+	// Chirps sent while catching up may also be buffered in sub
+	sent := map[string]bool{}
+	if lastEventID := request.Header.Get("Last-Event-ID"); lastEventID != "" {
+		err := cfg.streamBacklog(request.Context(), lastEventID, authorID, func(msg stream.Message) error {
+			sent[msg.ID] = true
+			return write(func() error { return stream.WriteMessage(response, msg) })
+		})
+		if err != nil {
+			logger.Warn("stream: Problem catching up client", "last_event_id", lastEventID, "error", err)
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-request.Context().Done():
+			return
+		case <-sub.Done():
+			// Sending what's buffered first means resuming picks up from there
+			for {
+				select {
+				case msg := <-sub.Messages():
+					if !sent[msg.ID] {
+						err = write(func() error { return stream.WriteMessage(response, msg) })
+					}
+				default:
+					if errors.Is(sub.Err(), stream.ErrSlowConsumer) {
+						logger.Info("stream: Disconnecting client that fell behind")
+					}
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		case msg := <-sub.Messages():
+			if sent[msg.ID] {
+				continue
+			}
+			err = write(func() error { return stream.WriteMessage(response, msg) })
+		case <-heartbeat.C:
+			err = write(func() error { return stream.WriteComment(response, "heartbeat") })
+		}
+		if err != nil {
+			logger.Info("stream: Client went away", "error", err)
+			return
+		}
+	}
+}
+
+// Counts another open connection in count, unless that would take it past
+// limit. Callers that get true must decrement count when they're done.
+func reserveConnection(count *atomic.Int64, limit int64) bool {
+	if count.Add(1) > limit {
+		count.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Sends the chirps created after lastEventID, oldest first. An ID we don't
+// know, e.g. because that chirp was deleted, sends nothing.
+func (cfg *apiConfig) streamBacklog(ctx context.Context, lastEventID string, authorID uuid.NullUUID, send func(stream.Message) error) error {
+	chirpID, err := uuid.Parse(lastEventID)
+	if err != nil {
+		return nil
+	}
+	last, err := cfg.db.GetChirpByID(ctx, chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		loggerFrom(ctx).Info("stream: Can't resume from unknown chirp", "chirp_id", chirpID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		rows, err := cfg.db.GetChirpsAfter(ctx, database.GetChirpsAfterParams{
+			CreatedAt: last.CreatedAt,
+			ID: last.ID,
+			AuthorID: authorID,
+			MaxResults: streamBacklogPage,
+		})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			msg, err := chirpMessage(row)
+			if err != nil {
+				return err
+			}
+			if err := send(msg); err != nil {
+				return err
+			}
+			last = row
+		}
+		if len(rows) < streamBacklogPage {
+			return nil
+		}
+	}
+}
+
+// The chirp as sent to streams, with its ID to resume from
+func chirpMessage(row database.Chirp) (stream.Message, error) {
+	data, err := json.Marshal(Chirp{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+		Body: row.Body,
+		UserID: row.UserID,
+	})
+	if err != nil {
+		return stream.Message{}, err
+	}
+	return stream.Message{
+		ID: row.ID.String(),
+		Event: "chirp",
+		Data: data,
+		Topic: row.UserID.String(),
+	}, nil
+}
+
+// Fans chirps announced on chirp_created out to this server's streams until
+// ctx is done
+func (cfg *apiConfig) runChirpListener(ctx context.Context, dbURL string) {
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			slog.Warn("stream: Lost connection for chirp notifications", "error", err)
+		case pq.ListenerEventReconnected:
+			slog.Info("stream: Reconnected for chirp notifications")
+		case pq.ListenerEventConnectionAttemptFailed:
+			slog.Warn("stream: Problem connecting for chirp notifications", "error", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(chirpCreatedChannel); err != nil {
+		slog.Error("stream: Problem listening for chirp notifications", "error", err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-listener.Notify:
+			if notification == nil {
+				// After reconnecting. Chirps announced meanwhile are lost, but
+				// clients that reconnect with Last-Event-ID will catch up.
+				continue
+			}
+			cfg.streamChirp(ctx, notification.Extra)
+		case <-time.After(90 * time.Second):
+			// Checks the connection is still alive when it's quiet
+			go listener.Ping()
+		}
+	}
+}
+
+func (cfg *apiConfig) streamChirp(ctx context.Context, chirpIDStr string) {
+	chirpID, err := uuid.Parse(chirpIDStr)
+	if err != nil {
+		slog.Warn("stream: Bad chirp ID in notification", "payload", chirpIDStr)
+		return
+	}
+	row, err := cfg.db.GetChirpByID(ctx, chirpID)
+	if err != nil {
+		// Most likely deleted already
+		slog.Info("stream: Couldn't get notified chirp", "chirp_id", chirpID, "error", err)
+		return
+	}
+	msg, err := chirpMessage(row)
+	if err != nil {
+		slog.Error("stream: Problem encoding chirp", "chirp_id", chirpID, "error", err)
+		return
+	}
+	cfg.streamHub.Publish(msg)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/config"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/entitlements"
+	"github.com/venzy/chirpy/internal/subscriptions"
+)
+
+// Chirpy Red subscriptions. Polka tells us about payments through webhooks,
+// and users.is_chirpy_red follows whether the user's subscription is in
+// effect - active, or past due but still within its grace period.
+
+// Chirpy Red users are on the Red plan, everyone else on Free
+func userPlanLookup(queries *database.Queries) entitlements.PlanLookup {
+	return func(ctx context.Context, userID uuid.UUID) (entitlements.Plan, error) {
+		user, err := queries.GetUserByID(ctx, userID)
+		if err != nil {
+			return "", err
+		}
+		if user.IsChirpyRed {
+			return entitlements.Red, nil
+		}
+		return entitlements.Free, nil
+	}
+}
+
+func entitlementsFromConfig(plan config.Plan, defaultMaxChirpLength int) entitlements.Entitlements {
+	maxChirpLength := plan.MaxChirpLength
+	if maxChirpLength == 0 {
+		maxChirpLength = defaultMaxChirpLength
+	}
+	return entitlements.Entitlements{
+		MaxChirpLength: maxChirpLength,
+		EditWindow: plan.EditWindow,
+		WritesPerMinute: plan.WritesPerMinute,
+		MediaUploads: plan.MediaUploads,
+		ScheduledChirps: plan.ScheduledChirps,
+	}
+}
+
+// Used when Polka doesn't say when a renewed period ends
+const defaultSubscriptionPeriod = 30 * 24 * time.Hour
+
+// Starts or renews a paid period, for a payment event that happened at
+func (cfg *apiConfig) renewSubscription(ctx context.Context, userID uuid.UUID, at, periodStart, periodEnd time.Time) error {
+	return cfg.updateSubscription(ctx, userID, func(current *subscriptions.State) (subscriptions.State, bool) {
+		return subscriptions.Renew(current, at, periodStart, periodEnd, cfg.subscriptionGracePeriod)
+	})
+}
+
+// A failed payment doesn't end Red straight away - it lasts through the grace
+// period
+func (cfg *apiConfig) markSubscriptionPastDue(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	return cfg.updateSubscription(ctx, userID, func(current *subscriptions.State) (subscriptions.State, bool) {
+		return subscriptions.MarkPastDue(current, at, time.Now(), cfg.subscriptionGracePeriod)
+	})
+}
+
+// Ends Red immediately, with status saying why
+func (cfg *apiConfig) endSubscription(ctx context.Context, userID uuid.UUID, status string, at time.Time) error {
+	return cfg.updateSubscription(ctx, userID, func(current *subscriptions.State) (subscriptions.State, bool) {
+		return subscriptions.End(current, status, at, time.Now())
+	})
+}
+
+// Applies change to the user's subscription, or to nil if they don't have
+// one, then brings is_chirpy_red into line, in one transaction. change returns
+// false to leave the subscription as it is, e.g. for an out of date event.
+func (cfg *apiConfig) updateSubscription(ctx context.Context, userID uuid.UUID, change func(current *subscriptions.State) (subscriptions.State, bool)) error {
+	return cfg.withTx(ctx, func(queries *database.Queries) error {
+		var current *subscriptions.State
+		subscriptionDB, err := queries.GetSubscriptionByUserIDForUpdate(ctx, userID)
+		if err == nil {
+			state := subscriptionStateFromDB(subscriptionDB)
+			current = &state
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("couldn't get subscription: %w", err)
+		}
+
+		next, ok := change(current)
+		if ok {
+			_, err = queries.UpsertSubscription(ctx, database.UpsertSubscriptionParams{
+				UserID: userID,
+				Status: next.Status,
+				CurrentPeriodStart: next.PeriodStart,
+				CurrentPeriodEnd: next.PeriodEnd,
+				ExpiresAt: next.ExpiresAt,
+				LastEventAt: next.LastEventAt,
+			})
+			if err != nil {
+				return fmt.Errorf("couldn't update subscription: %w", err)
+			}
+		} else {
+			loggerFrom(ctx).Info("subscriptions: Event doesn't apply to subscription", "user_id", userID)
+		}
+
+		// Even when unchanged, in case the flag was left set
+		return syncChirpyRed(ctx, queries, userID)
+	})
+}
+
+func subscriptionStateFromDB(row database.Subscription) subscriptions.State {
+	return subscriptions.State{
+		Status: row.Status,
+		PeriodStart: row.CurrentPeriodStart,
+		PeriodEnd: row.CurrentPeriodEnd,
+		ExpiresAt: row.ExpiresAt,
+		LastEventAt: row.LastEventAt,
+	}
+}
+
+// Gives a user Red with no end date, as admins do by hand
+func grantChirpyRed(ctx context.Context, queries *database.Queries, userID uuid.UUID) (database.User, error) {
+	// Counts as the latest event, so older payment events can't undo it
+	now := time.Now()
+	_, err := queries.UpsertSubscription(ctx, database.UpsertSubscriptionParams{
+		UserID: userID,
+		Status: subscriptions.Active,
+		CurrentPeriodStart: now,
+		LastEventAt: now,
+	})
+	if err != nil {
+		return database.User{}, fmt.Errorf("couldn't grant subscription: %w", err)
+	}
+	return queries.SyncUserChirpyRed(ctx, userID)
+}
+
+func syncChirpyRed(ctx context.Context, queries *database.Queries, userID uuid.UUID) error {
+	if _, err := queries.SyncUserChirpyRed(ctx, userID); err != nil {
+		return fmt.Errorf("couldn't update Chirpy Red status: %w", err)
+	}
+	return nil
+}
+
+// Expires lapsed subscriptions every interval until ctx is done. Safe to run
+// on every replica at once.
+func (cfg *apiConfig) runSubscriptionExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cfg.expireSubscriptions(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) expireSubscriptions(ctx context.Context) {
+	expired, err := cfg.db.ExpireSubscriptions(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("subscriptions: Problem expiring subscriptions", "error", err)
+		}
+		return
+	}
+
+	// Updates the users whose subscriptions just expired, and also any left
+	// out of step by a failure between updating a subscription and its user
+	updated, err := cfg.db.SyncAllUsersChirpyRed(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("subscriptions: Problem updating Chirpy Red status", "error", err)
+		}
+		return
+	}
+	if expired > 0 || updated > 0 {
+		slog.Info("subscriptions: Expired lapsed subscriptions", "expired", expired, "users_updated", updated)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/database"
+)
+
+// Handlers for personal access tokens, which let bots authenticate with an
+// 'Authorization: ApiKey <token>' header instead of logging in.
+
+// Scopes that can be granted to a personal access token. Requests made with a
+// JWT access token are not restricted by scope.
+const (
+	scopeChirpsWrite = "chirps:write"
+	scopeUsersWrite  = "users:write"
+)
+
+var validTokenScopes = map[string]bool{
+	scopeChirpsWrite: true,
+	scopeUsersWrite:  true,
+}
+
+type APIToken struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	// Only populated once, in the response to creation
+	Token      string     `json:"token,omitempty"`
+}
+
+func apiTokenFromDB(row database.ApiToken) APIToken {
+	scopes := row.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return APIToken{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		Name: row.Name,
+		Scopes: scopes,
+		ExpiresAt: nullTimePtr(row.ExpiresAt),
+		LastUsedAt: nullTimePtr(row.LastUsedAt),
+		RevokedAt: nullTimePtr(row.RevokedAt),
+	}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (cfg *apiConfig) handleCreateAPIToken(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type requestParams struct {
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("tokens: Error decoding createAPIToken params: %s", err)
+		loggerFrom(request.Context()).Warn("tokens: Error decoding createAPIToken params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Validate
+	if params.Name == "" {
+		msg := "tokens: Token name is required"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	for _, scope := range params.Scopes {
+		if !validTokenScopes[scope] {
+			msg := fmt.Sprintf("tokens: Unknown scope '%s'", scope)
+			loggerFrom(request.Context()).Warn("tokens: Unknown scope", "scope", scope)
+			respondWithError(response, http.StatusBadRequest, msg)
+			return
+		}
+	}
+
+	if params.ExpiresInSeconds < 0 {
+		msg := "tokens: expires_in_seconds must not be negative"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Zero means the token never expires
+	expiresAt := sql.NullTime{}
+	if params.ExpiresInSeconds > 0 {
+		expiresAt = sql.NullTime{
+			Time: time.Now().Add(time.Duration(params.ExpiresInSeconds) * time.Second),
+			Valid: true,
+		}
+	}
+
+	// Only the hash is stored, the token itself is returned to the user once
+	newToken, err := auth.MakeAPIToken()
+	if err != nil {
+		msg := fmt.Sprintf("tokens: Couldn't create token: %s", err)
+		loggerFrom(request.Context()).Error("tokens: Couldn't create token", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	newTokenRow, err := cfg.db.CreateAPIToken(request.Context(), database.CreateAPITokenParams{
+		UserID: userID,
+		Name: params.Name,
+		TokenHash: auth.HashAPIToken(newToken),
+		Scopes: params.Scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("tokens: Problem storing token: %s", err)
+		loggerFrom(request.Context()).Error("tokens: Problem storing token", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	apiToken := apiTokenFromDB(newTokenRow)
+	apiToken.Token = newToken
+	respondWithJSON(response, http.StatusCreated, apiToken)
+}
+
+func (cfg *apiConfig) handleGetAPITokens(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	rows, err := cfg.db.GetAPITokensByUserID(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("tokens: Problem retrieving tokens for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("tokens: Problem retrieving tokens", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	apiTokens := []APIToken{}
+	for _, row := range rows {
+		apiTokens = append(apiTokens, apiTokenFromDB(row))
+	}
+	respondWithJSON(response, http.StatusOK, apiTokens)
+}
+
+func (cfg *apiConfig) handleRevokeAPIToken(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	// Parse request params
+	tokenID, err := uuid.Parse(request.PathValue("tokenID"))
+	if err != nil {
+		msg := fmt.Sprintf("tokens: Problem parsing tokenID from request: %s", err)
+		loggerFrom(request.Context()).Warn("tokens: Problem parsing tokenID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Only matches tokens owned by this user, so other users' tokens look missing
+	revoked, err := cfg.db.RevokeAPIToken(request.Context(), database.RevokeAPITokenParams{
+		ID: tokenID,
+		UserID: userID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("tokens: Problem revoking token '%s': %s", tokenID, err)
+		loggerFrom(request.Context()).Error("tokens: Problem revoking token", "token_id", tokenID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if revoked == 0 {
+		msg := fmt.Sprintf("tokens: No active token '%s' for user '%s'", tokenID, userID)
+		loggerFrom(request.Context()).Warn("tokens: No such active token for user", "token_id", tokenID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/mail"
 	"time"
@@ -13,9 +14,6 @@ import (
 	"github.com/venzy/chirpy/internal/database"
 )
 
-const accessTokenExpiry = time.Hour
-const refreshTokenExpiry = 60 * 24 * time.Hour // 60 days
-
 type User struct {
 	ID           uuid.UUID `json:"id"`
 	CreatedAt    time.Time `json:"created_at"`
@@ -38,7 +36,7 @@ func (cfg *apiConfig) handleCreateUser(response http.ResponseWriter, request *ht
 	err := decoder.Decode(&params)
 	if err != nil {
 		msg := fmt.Sprintf("users: Error decoding createUser params: %s\n", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: Error decoding createUser params", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -46,14 +44,14 @@ func (cfg *apiConfig) handleCreateUser(response http.ResponseWriter, request *ht
 	// Basic validation
 	if _, err := mail.ParseAddress(params.Email); err != nil {
 		msg := fmt.Sprintf("users: Bad email address: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: Bad email address", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
 
 	if len(params.Password) < 1 {
 		msg := fmt.Sprintf("users: Password len > 1 required")
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn(msg)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -72,7 +70,7 @@ func (cfg *apiConfig) handleCreateUser(response http.ResponseWriter, request *ht
 	})
 	if err != nil {
 		msg := fmt.Sprintf("users: Problem creating user: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Error("users: Problem creating user", "error", err)
 		respondWithError(response, http.StatusInternalServerError, msg)
 		return
 	}
@@ -98,7 +96,7 @@ func (cfg *apiConfig) handleUpdateUser(response http.ResponseWriter, request *ht
 	err := decoder.Decode(&params)
 	if err != nil {
 		msg := fmt.Sprintf("users: Error decoding updateUser params: %s\n", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: Error decoding updateUser params", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -106,14 +104,14 @@ func (cfg *apiConfig) handleUpdateUser(response http.ResponseWriter, request *ht
 	// Basic validation
 	if _, err := mail.ParseAddress(params.Email); err != nil {
 		msg := fmt.Sprintf("users: Bad email address: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: Bad email address", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
 
 	if len(params.Password) < 1 {
 		msg := fmt.Sprintf("users: Password len > 1 required")
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn(msg)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -134,7 +132,7 @@ func (cfg *apiConfig) handleUpdateUser(response http.ResponseWriter, request *ht
 
 	if err != nil {	
 		msg := fmt.Sprintf("users: Problem updating user: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Error("users: Problem updating user", "error", err)
 		respondWithError(response, http.StatusInternalServerError, msg)
 		return
 	}
@@ -162,7 +160,7 @@ func (cfg *apiConfig) handleLogin(response http.ResponseWriter, request *http.Re
 	err := decoder.Decode(&params)
 	if err != nil {
 		msg := fmt.Sprintf("users: Error decoding login params: %s\n", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: Error decoding login params", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
@@ -170,16 +168,35 @@ func (cfg *apiConfig) handleLogin(response http.ResponseWriter, request *http.Re
 	// Validate email is well-formed
 	if _, err := mail.ParseAddress(params.Email); err != nil {
 		msg := fmt.Sprintf("users: Bad email address: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: Bad email address", "error", err)
 		respondWithError(response, http.StatusBadRequest, msg)
 		return
 	}
 
+	// Refuse outright while this account or IP is backing off
+	keys := loginKeys(request, params.Email)
+	retryAfter, err := cfg.loginRetryAfter(request.Context(), keys)
+	if err != nil {
+		msg := fmt.Sprintf("users: login couldn't check lockout status: %s", err)
+		loggerFrom(request.Context()).Error("users: login couldn't check lockout status", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if retryAfter > 0 {
+		cfg.metrics.loginFailures.With("locked").Inc()
+		loggerFrom(request.Context()).Warn("users: login refused while locked", "email", params.Email, "remote_ip", clientIP(request), "retry_after", retryAfter)
+		respondTooManyAttempts(response, retryAfter)
+		return
+	}
+
 	// Get user
 	user, err := cfg.db.GetUserByEmail(request.Context(), params.Email)
 	if err != nil {
-		msg := fmt.Sprintf("users: No such user '%s' or error: %s", params.Email, err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: No such user or error", "email", params.Email, "error", err)
+		// Take as long as a wrong password would, so timing doesn't leak whether the email exists
+		auth.CheckDummyPasswordHash(params.Password)
+		cfg.metrics.loginFailures.With("unknown_user").Inc()
+		cfg.recordLoginFailure(request.Context(), keys)
 		// Don't leak which was wrong (email or password)
 		respondWithError(response, http.StatusUnauthorized, "Incorrect email or password")
 		return
@@ -187,18 +204,76 @@ func (cfg *apiConfig) handleLogin(response http.ResponseWriter, request *http.Re
 
 	// Check password
 	if err = auth.CheckPasswordHash(user.HashedPassword, params.Password); err != nil {
-		msg := fmt.Sprintf("users: Password hash mismatch or error: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Warn("users: Password hash mismatch or error", "error", err)
+		cfg.metrics.loginFailures.With("bad_password").Inc()
+		cfg.recordLoginFailure(request.Context(), keys)
 		// Don't leak which was wrong (email or password)
 		respondWithError(response, http.StatusUnauthorized, "Incorrect email or password")
 		return
 	}
+	cfg.clearLoginFailures(request.Context(), params.Email)
+
+	cfg.completeLogin(response, request, user, "password")
+}
+
+// Called once a user has proven who they are (by password or an external
+// identity provider). With two-factor authentication enabled that only earns a
+// short-lived challenge token, to be exchanged at /api/login/mfa.
+func (cfg *apiConfig) completeLogin(response http.ResponseWriter, request *http.Request, user database.User, method string) {
+	if rejectDisabledUser(response, request, user) {
+		return
+	}
+
+	totpDB, err := cfg.db.GetTOTPCredentialByUserID(request.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("users: login couldn't check two-factor status: %s", err)
+		loggerFrom(request.Context()).Error("users: login couldn't check two-factor status", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if err == nil && totpDB.ConfirmedAt.Valid {
+		mfaToken, err := auth.MakeMFAChallengeJWT(user.ID, cfg.jwtSecret, cfg.mfaChallengeExpiry)
+		if err != nil {
+			msg := fmt.Sprintf("users: login couldn't create MFA challenge: %s", err)
+			loggerFrom(request.Context()).Error("users: login couldn't create MFA challenge", "error", err)
+			respondWithError(response, http.StatusInternalServerError, msg)
+			return
+		}
+		respondWithJSON(response, http.StatusOK, map[string]any{
+			"mfa_required": true,
+			"mfa_token": mfaToken,
+		})
+		return
+	}
+
+	cfg.respondWithLoginTokens(response, request, user, method)
+}
+
+// Disabled by an operator with 'chirpy user disable'. Returns whether the
+// login was rejected.
+func rejectDisabledUser(response http.ResponseWriter, request *http.Request, user database.User) bool {
+	if !user.DisabledAt.Valid {
+		return false
+	}
+	loggerFrom(request.Context()).Warn("users: Login for disabled user", "user_id", user.ID)
+	respondWithError(response, http.StatusForbidden, "Account disabled")
+	return true
+}
+
+// Issues a new access and refresh token pair for a user that has fully
+// authenticated, responding with the user and both tokens. The method (e.g.
+// "password") is only used for metrics.
+func (cfg *apiConfig) respondWithLoginTokens(response http.ResponseWriter, request *http.Request, user database.User, method string) {
+	// Checked again, in case the user was disabled mid MFA challenge
+	if rejectDisabledUser(response, request, user) {
+		return
+	}
 
 	// Create access token
-	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, accessTokenExpiry)
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, cfg.accessTokenExpiry)
 	if err != nil {
 		msg := fmt.Sprintf("users: login couldn't create JWT: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Error("users: login couldn't create JWT", "error", err)
 		respondWithError(response, http.StatusInternalServerError, msg)
 		return
 	}
@@ -207,7 +282,7 @@ func (cfg *apiConfig) handleLogin(response http.ResponseWriter, request *http.Re
 	refreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
 		msg := fmt.Sprintf("users: login couldn't create refresh token: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Error("users: login couldn't create refresh token", "error", err)
 		respondWithError(response, http.StatusInternalServerError, msg)
 		return
 	}
@@ -216,15 +291,17 @@ func (cfg *apiConfig) handleLogin(response http.ResponseWriter, request *http.Re
 	_, err = cfg.db.CreateRefreshToken(request.Context(), database.CreateRefreshTokenParams{
 		UserID: user.ID,
 		Token: refreshToken,
-		ExpiresAt: time.Now().Add(refreshTokenExpiry),
+		ExpiresAt: time.Now().Add(cfg.refreshTokenExpiry),
 	})
 	if err != nil {
 		msg := fmt.Sprintf("users: login couldn't store refresh token: %s", err)
-		log.Println(msg)
+		loggerFrom(request.Context()).Error("users: login couldn't store refresh token", "error", err)
 		respondWithError(response, http.StatusInternalServerError, msg)
 		return
 	}
 
+	cfg.metrics.logins.With(method).Inc()
+
 	loggedInUser := User{
 		ID: user.ID,
 		CreatedAt: user.CreatedAt,
@@ -280,7 +357,7 @@ func (cfg *apiConfig) handleRefresh(response http.ResponseWriter, request *http.
     }
 
     // Generate a new access token
-    newAccessJWT, err := auth.MakeJWT(refreshTokenDB.UserID, cfg.jwtSecret, accessTokenExpiry)
+    newAccessJWT, err := auth.MakeJWT(refreshTokenDB.UserID, cfg.jwtSecret, cfg.accessTokenExpiry)
     if err != nil {
         respondWithError(response, http.StatusInternalServerError, "Could not generate new access token")
         return
@@ -309,25 +386,3 @@ func (cfg *apiConfig) handleRevoke(response http.ResponseWriter, request *http.R
 	// Respond with No Content
 	response.WriteHeader(http.StatusNoContent)
 }
-
-func (cfg *apiConfig) handleUserUpgrade(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
-	// Check user exists separately rather than trying to parse the error
-	_, err := cfg.db.GetUserByID(request.Context(), userID)
-	if err != nil {
-		msg := fmt.Sprintf("users: Could not find user with ID '%s': %s", userID, err)
-		log.Println(msg)
-		respondWithError(response, http.StatusNotFound, msg)
-		return
-	}
-
-	// Perform the upgrade
-	_, err = cfg.db.UpgradeUser(request.Context(), userID)
-	if err != nil {
-		msg := fmt.Sprintf("users: Error upgrading user: %s\n", err)
-		log.Println(msg)
-		respondWithError(response, http.StatusInternalServerError, msg)
-		return
-	}
-
-	response.WriteHeader(http.StatusNoContent)
-}
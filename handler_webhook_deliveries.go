@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/events"
+	"github.com/venzy/chirpy/internal/outbound"
+)
+
+// Domain events are queued in webhook_deliveries, one row for each endpoint
+// subscribed to them, and sent by an outbound.Dispatcher in the background.
+
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+	// How often to look for deliveries that are due
+	webhookDeliveryInterval = 5 * time.Second
+)
+
+// What endpoints are sent. The ID is the domain event's, so it's the same for
+// every endpoint and every retry, and receivers can ignore repeats.
+type webhookEventPayload struct {
+	ID        uuid.UUID       `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Subscribed to the events endpoints can choose, queueing a delivery to each
+// of the user's endpoints that wants it. If this runs again for an event,
+// endpoints it was already queued for are skipped.
+func (cfg *apiConfig) queueWebhookDeliveries(ctx context.Context, event events.Event) error {
+	payload, err := json.Marshal(webhookEventPayload{
+		ID: event.ID,
+		Type: event.Type,
+		CreatedAt: event.CreatedAt.UTC(),
+		Data: event.Payload,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't encode payload: %w", err)
+	}
+
+	_, err = cfg.db.EnqueueWebhookDeliveries(ctx, database.EnqueueWebhookDeliveriesParams{
+		EventID: event.ID,
+		EventType: event.Type,
+		Payload: payload,
+		UserID: event.UserID,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't queue deliveries: %w", err)
+	}
+	return nil
+}
+
+// The outbound.Store over our tables
+type webhookDeliveryStore struct {
+	db *database.Queries
+}
+
+func (s webhookDeliveryStore) Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]outbound.Delivery, error) {
+	rows, err := s.db.ClaimWebhookDeliveries(ctx, database.ClaimWebhookDeliveriesParams{
+		MaxResults: int32(limit),
+		LeaseUntil: leaseUntil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]outbound.Delivery, 0, len(rows))
+	for _, row := range rows {
+		deliveries = append(deliveries, outbound.Delivery{
+			ID: row.ID,
+			EndpointID: row.EndpointID,
+			URL: row.Url,
+			Secret: row.Secret,
+			EventType: row.EventType,
+			Payload: row.Payload,
+			Attempt: int(row.Attempts),
+		})
+	}
+	return deliveries, nil
+}
+
+func (s webhookDeliveryStore) Finish(ctx context.Context, delivery outbound.Delivery, outcome outbound.Outcome, disableAfter int) (bool, error) {
+	status, nextAttemptAt := deliverySucceeded, time.Now()
+	switch {
+	case outcome.Succeeded:
+	case outcome.RetryAt.IsZero():
+		status = deliveryFailed
+	default:
+		status, nextAttemptAt = deliveryPending, outcome.RetryAt
+	}
+
+	err := s.db.FinishWebhookDelivery(ctx, database.FinishWebhookDeliveryParams{
+		ID: delivery.ID,
+		Status: status,
+		NextAttemptAt: nextAttemptAt,
+		ResponseStatus: sql.NullInt32{Int32: int32(outcome.StatusCode), Valid: outcome.StatusCode != 0},
+		LastError: sql.NullString{String: outcome.Error, Valid: outcome.Error != ""},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if outcome.Succeeded {
+		return false, s.db.RecordWebhookEndpointSuccess(ctx, delivery.EndpointID)
+	}
+	endpoint, err := s.db.RecordWebhookEndpointFailure(ctx, database.RecordWebhookEndpointFailureParams{
+		DisableAfter: int32(disableAfter),
+		ID: delivery.EndpointID,
+	})
+	if err != nil {
+		return false, err
+	}
+	// Only the failure that reached the limit reports it
+	return endpoint.DisabledAt.Valid && endpoint.ConsecutiveFailures == int32(disableAfter), nil
+}
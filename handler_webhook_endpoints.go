@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/outbound"
+)
+
+// Handlers for users' outbound webhook endpoints, which are sent events on
+// their account. Delivery itself is in handler_webhook_deliveries.go.
+
+const (
+	eventChirpCreated = "chirp.created"
+	eventChirpDeleted = "chirp.deleted"
+)
+
+var validWebhookEventTypes = map[string]bool{
+	eventChirpCreated: true,
+	eventChirpDeleted: true,
+}
+
+const (
+	defaultDeliveryListLimit = 50
+	maxDeliveryListLimit     = 500
+)
+
+type WebhookEndpoint struct {
+	ID                  uuid.UUID  `json:"id"`
+	CreatedAt           time.Time  `json:"created_at"`
+	URL                 string     `json:"url"`
+	EventTypes          []string   `json:"event_types"`
+	ConsecutiveFailures int32      `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at"`
+	// Only populated once, in the response to creation
+	Secret              string     `json:"secret,omitempty"`
+}
+
+func webhookEndpointFromDB(row database.WebhookEndpoint) WebhookEndpoint {
+	return WebhookEndpoint{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		URL: row.Url,
+		EventTypes: row.EventTypes,
+		ConsecutiveFailures: row.ConsecutiveFailures,
+		DisabledAt: nullTimePtr(row.DisabledAt),
+	}
+}
+
+type WebhookDelivery struct {
+	ID             uuid.UUID       `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int32           `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	ResponseStatus *int32          `json:"response_status"`
+	LastError      string          `json:"last_error,omitempty"`
+}
+
+func webhookDeliveryFromDB(row database.WebhookDelivery) WebhookDelivery {
+	delivery := WebhookDelivery{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		EventType: row.EventType,
+		Payload: row.Payload,
+		Status: row.Status,
+		Attempts: row.Attempts,
+		LastAttemptAt: nullTimePtr(row.LastAttemptAt),
+		LastError: row.LastError.String,
+	}
+	if row.Status == deliveryPending {
+		delivery.NextAttemptAt = &row.NextAttemptAt
+	}
+	if row.ResponseStatus.Valid {
+		delivery.ResponseStatus = &row.ResponseStatus.Int32
+	}
+	return delivery
+}
+
+func (cfg *apiConfig) handleCreateWebhookEndpoint(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	type requestParams struct {
+		URL        string   `json:"url"`
+		EventTypes []string `json:"event_types"`
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Error decoding createWebhookEndpoint params: %s", err)
+		loggerFrom(request.Context()).Warn("webhooks: Error decoding createWebhookEndpoint params", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Validate
+	if err := cfg.validateWebhookURL(request.Context(), params.URL); err != nil {
+		msg := fmt.Sprintf("webhooks: Invalid url: %s", err)
+		loggerFrom(request.Context()).Warn("webhooks: Invalid url", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	if len(params.EventTypes) == 0 {
+		msg := "webhooks: At least one event type is required"
+		loggerFrom(request.Context()).Warn(msg)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+	for _, eventType := range params.EventTypes {
+		if !validWebhookEventTypes[eventType] {
+			msg := fmt.Sprintf("webhooks: Unknown event type '%s'", eventType)
+			loggerFrom(request.Context()).Warn("webhooks: Unknown event type", "event_type", eventType)
+			respondWithError(response, http.StatusBadRequest, msg)
+			return
+		}
+	}
+
+	// Returned to the user once, for checking our signatures
+	secret, err := auth.MakeWebhookSecret()
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Couldn't create secret: %s", err)
+		loggerFrom(request.Context()).Error("webhooks: Couldn't create secret", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	endpointDB, err := cfg.db.CreateWebhookEndpoint(request.Context(), database.CreateWebhookEndpointParams{
+		UserID: userID,
+		Url: params.URL,
+		Secret: secret,
+		EventTypes: params.EventTypes,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem storing endpoint: %s", err)
+		loggerFrom(request.Context()).Error("webhooks: Problem storing endpoint", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	endpoint := webhookEndpointFromDB(endpointDB)
+	endpoint.Secret = secret
+	respondWithJSON(response, http.StatusCreated, endpoint)
+}
+
+// Plain HTTP is only allowed in dev, so payloads and signatures aren't sent in
+// the clear. Outside dev the host must also resolve to public addresses, so
+// endpoints can't be used to reach our own network. Deliveries check again
+// when they connect.
+func (cfg *apiConfig) validateWebhookURL(ctx context.Context, rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Host == "" {
+		return errors.New("must be an absolute URL")
+	}
+	if parsed.Scheme != "https" && !(parsed.Scheme == "http" && cfg.platform == Dev) {
+		return errors.New("must use https")
+	}
+	if cfg.platform != Dev {
+		return outbound.CheckHost(ctx, parsed.Hostname())
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handleGetWebhookEndpoints(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	rows, err := cfg.db.GetWebhookEndpointsByUserID(request.Context(), userID)
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem retrieving endpoints for user '%s': %s", userID, err)
+		loggerFrom(request.Context()).Error("webhooks: Problem retrieving endpoints", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	endpoints := []WebhookEndpoint{}
+	for _, row := range rows {
+		endpoints = append(endpoints, webhookEndpointFromDB(row))
+	}
+	respondWithJSON(response, http.StatusOK, endpoints)
+}
+
+func (cfg *apiConfig) handleDeleteWebhookEndpoint(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	endpointID, err := uuid.Parse(request.PathValue("endpointID"))
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem parsing endpointID from request: %s", err)
+		loggerFrom(request.Context()).Warn("webhooks: Problem parsing endpointID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Only matches endpoints owned by this user, so other users' look missing
+	deleted, err := cfg.db.DeleteWebhookEndpoint(request.Context(), database.DeleteWebhookEndpointParams{
+		ID: endpointID,
+		UserID: userID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem deleting endpoint '%s': %s", endpointID, err)
+		loggerFrom(request.Context()).Error("webhooks: Problem deleting endpoint", "endpoint_id", endpointID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	if deleted == 0 {
+		msg := fmt.Sprintf("webhooks: No endpoint '%s' for user '%s'", endpointID, userID)
+		loggerFrom(request.Context()).Warn("webhooks: No such endpoint for user", "endpoint_id", endpointID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Turns an endpoint back on after it was disabled for failing. Deliveries
+// queued meanwhile are sent once it's enabled.
+func (cfg *apiConfig) handleEnableWebhookEndpoint(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	endpointID, err := uuid.Parse(request.PathValue("endpointID"))
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem parsing endpointID from request: %s", err)
+		loggerFrom(request.Context()).Warn("webhooks: Problem parsing endpointID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	endpointDB, err := cfg.db.EnableWebhookEndpoint(request.Context(), database.EnableWebhookEndpointParams{
+		ID: endpointID,
+		UserID: userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("webhooks: No endpoint '%s' for user '%s'", endpointID, userID)
+		loggerFrom(request.Context()).Warn("webhooks: No such endpoint for user", "endpoint_id", endpointID)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem enabling endpoint '%s': %s", endpointID, err)
+		loggerFrom(request.Context()).Error("webhooks: Problem enabling endpoint", "endpoint_id", endpointID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	respondWithJSON(response, http.StatusOK, webhookEndpointFromDB(endpointDB))
+}
+
+// The delivery log for one endpoint, newest first
+func (cfg *apiConfig) handleGetWebhookDeliveries(response http.ResponseWriter, request *http.Request, userID uuid.UUID) {
+	endpointID, err := uuid.Parse(request.PathValue("endpointID"))
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem parsing endpointID from request: %s", err)
+		loggerFrom(request.Context()).Warn("webhooks: Problem parsing endpointID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	limit := defaultDeliveryListLimit
+	if limitReq := request.URL.Query().Get("limit"); limitReq != "" {
+		limit, err = strconv.Atoi(limitReq)
+		if err != nil || limit < 1 || limit > maxDeliveryListLimit {
+			msg := fmt.Sprintf("webhooks: limit must be between 1 and %d", maxDeliveryListLimit)
+			loggerFrom(request.Context()).Warn(msg)
+			respondWithError(response, http.StatusBadRequest, msg)
+			return
+		}
+	}
+
+	// Check ownership first, since deliveries don't record the user
+	_, err = cfg.db.GetWebhookEndpoint(request.Context(), database.GetWebhookEndpointParams{
+		ID: endpointID,
+		UserID: userID,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: No endpoint '%s' for user '%s': %s", endpointID, userID, err)
+		loggerFrom(request.Context()).Warn("webhooks: No such endpoint for user", "endpoint_id", endpointID, "error", err)
+		respondWithError(response, http.StatusNotFound, msg)
+		return
+	}
+
+	rows, err := cfg.db.GetWebhookDeliveriesByEndpointID(request.Context(), database.GetWebhookDeliveriesByEndpointIDParams{
+		EndpointID: endpointID,
+		Limit: int32(limit),
+	})
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem retrieving deliveries for endpoint '%s': %s", endpointID, err)
+		loggerFrom(request.Context()).Error("webhooks: Problem retrieving deliveries for endpoint", "endpoint_id", endpointID, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, row := range rows {
+		deliveries = append(deliveries, webhookDeliveryFromDB(row))
+	}
+	respondWithJSON(response, http.StatusOK, deliveries)
+}
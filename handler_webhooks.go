@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/database"
+)
+
+// Admin handlers for inspecting and replaying received webhooks
+
+const (
+	defaultWebhookListLimit = 50
+	maxWebhookListLimit     = 500
+)
+
+var validWebhookStatuses = map[string]bool{
+	"processing": true,
+	"processed":  true,
+	"ignored":    true,
+	"failed":     true,
+}
+
+type WebhookEvent struct {
+	ID          uuid.UUID       `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	Provider    string          `json:"provider"`
+	EventID     string          `json:"event_id"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int32           `json:"attempts"`
+	ProcessedAt *time.Time      `json:"processed_at"`
+}
+
+func webhookEventFromDB(row database.WebhookEvent) WebhookEvent {
+	return WebhookEvent{
+		ID: row.ID,
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
+		Provider: row.Provider,
+		EventID: row.EventID,
+		EventType: row.EventType,
+		Payload: row.Payload,
+		Status: row.Status,
+		Error: row.Error.String,
+		Attempts: row.Attempts,
+		ProcessedAt: nullTimePtr(row.ProcessedAt),
+	}
+}
+
+func (cfg *apiConfig) handleListWebhookEvents(response http.ResponseWriter, request *http.Request) {
+	statusReq := request.URL.Query().Get("status")
+	if statusReq != "" && !validWebhookStatuses[statusReq] {
+		msg := fmt.Sprintf("webhooks: Invalid status '%s'", statusReq)
+		loggerFrom(request.Context()).Warn("webhooks: Invalid status", "status", statusReq)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	limit := defaultWebhookListLimit
+	if limitReq := request.URL.Query().Get("limit"); limitReq != "" {
+		var err error
+		limit, err = strconv.Atoi(limitReq)
+		if err != nil || limit < 1 || limit > maxWebhookListLimit {
+			msg := fmt.Sprintf("webhooks: limit must be between 1 and %d", maxWebhookListLimit)
+			loggerFrom(request.Context()).Warn(msg)
+			respondWithError(response, http.StatusBadRequest, msg)
+			return
+		}
+	}
+
+	rows, err := cfg.db.ListWebhookEvents(request.Context(), database.ListWebhookEventsParams{
+		Status: sql.NullString{String: statusReq, Valid: statusReq != ""},
+		MaxResults: int32(limit),
+	})
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem listing events: %s", err)
+		loggerFrom(request.Context()).Error("webhooks: Problem listing events", "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	events := []WebhookEvent{}
+	for _, row := range rows {
+		events = append(events, webhookEventFromDB(row))
+	}
+	respondWithJSON(response, http.StatusOK, events)
+}
+
+// Processes a failed or abandoned event again from its stored payload, as if
+// it had been redelivered
+func (cfg *apiConfig) handleReplayWebhookEvent(response http.ResponseWriter, request *http.Request) {
+	id, err := uuid.Parse(request.PathValue("eventID"))
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem parsing eventID from request: %s", err)
+		loggerFrom(request.Context()).Warn("webhooks: Problem parsing eventID from request", "error", err)
+		respondWithError(response, http.StatusBadRequest, msg)
+		return
+	}
+
+	eventDB, err := cfg.retryWebhookEvent(request.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Either it doesn't exist, or it isn't in a state to be replayed
+		existing, getErr := cfg.db.GetWebhookEventByID(request.Context(), id)
+		if getErr != nil {
+			msg := fmt.Sprintf("webhooks: Could not find event '%s': %s", id, getErr)
+			loggerFrom(request.Context()).Warn("webhooks: Could not find event", "event_id", id, "error", getErr)
+			respondWithError(response, http.StatusNotFound, msg)
+			return
+		}
+		msg := fmt.Sprintf("webhooks: Only failed or abandoned events can be replayed, event '%s' is %s", id, existing.Status)
+		loggerFrom(request.Context()).Warn("webhooks: Only failed or abandoned events can be replayed", "event_id", id, "status", existing.Status)
+		respondWithError(response, http.StatusConflict, msg)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem claiming event '%s': %s", id, err)
+		loggerFrom(request.Context()).Error("webhooks: Problem claiming event", "event_id", id, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+
+	// A failure here is recorded on the event, which we return either way
+	if _, err := cfg.processWebhookEvent(request.Context(), eventDB); err != nil {
+		loggerFrom(request.Context()).Warn("webhooks: Replay failed", "id", id, "error", err)
+	} else {
+		loggerFrom(request.Context()).Info("webhooks: Admin replayed event", "id", id)
+	}
+
+	eventDB, err = cfg.db.GetWebhookEventByID(request.Context(), id)
+	if err != nil {
+		msg := fmt.Sprintf("webhooks: Problem retrieving event '%s': %s", id, err)
+		loggerFrom(request.Context()).Error("webhooks: Problem retrieving event", "event_id", id, "error", err)
+		respondWithError(response, http.StatusInternalServerError, msg)
+		return
+	}
+	respondWithJSON(response, http.StatusOK, webhookEventFromDB(eventDB))
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/stream"
+)
+
+// A WebSocket API for live updates, fed by the same stream.Hub as
+// GET /api/stream. Every message is a JSON object with a "type". Clients send
+//
+//	{"type": "subscribe", "id": "1", "topic": "chirps"}
+//	{"type": "unsubscribe", "id": "2", "topic": "chirps"}
+//	{"type": "ping", "id": "3"}
+//
+// and we reply with "subscribed", "unsubscribed", "pong" or "error", echoing
+// the id so the client can match them up. Events on subscribed topics arrive
+// as
+//
+//	{"type": "event", "topic": "chirps", "event": "chirp", "data": {...}}
+//
+// Topics are "chirps" for every new chirp, and "chirps:<author_id>" for one
+// author's. As with GET /api/chirps, chirps by users blocked either way are
+// left out, and on "chirps" so are those by muted users. Who's hidden is
+// looked up on subscribing, so changes apply to later subscriptions.
+
+const (
+	wsPingInterval = 30 * time.Second
+	// How long a ping or a write may take before we give up on the client
+	wsTimeout = 10 * time.Second
+	// Client messages are small, this stops anyone sending us big ones
+	wsReadLimit        = 4096
+	wsMaxSubscriptions = 20
+	// Per server, counted apart from SSE streams so neither can crowd out
+	// the other
+	maxWebSockets = 1000
+)
+
+type wsClientMessage struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Topic string `json:"topic,omitempty"`
+}
+
+type wsServerMessage struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id,omitempty"`
+	Topic string          `json:"topic,omitempty"`
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// Why a connection is being closed, for the close frame
+type wsCloseReason struct {
+	code   websocket.StatusCode
+	reason string
+}
+
+// Authenticates with the same access tokens as withAuthenticatedUser, but not
+// API tokens. The connection is closed when the token expires, and the client
+// should reconnect with a fresh one.
+func (cfg *apiConfig) handleWebSocket(response http.ResponseWriter, request *http.Request) {
+	token, err := auth.GetBearerToken(request.Header)
+	if err != nil {
+		respondWithError(response, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userID, expiresAt, err := auth.ValidateJWTExpiry(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(response, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	setRequestUserID(request.Context(), userID)
+
+	if !reserveConnection(&cfg.openWebSockets, maxWebSockets) {
+		msg := "websocket: Too many connections open, try again later"
+		loggerFrom(request.Context()).Warn(msg)
+		response.Header().Set("Retry-After", fmt.Sprintf("%d", int(streamRetry.Seconds())))
+		respondWithError(response, http.StatusServiceUnavailable, msg)
+		return
+	}
+	defer cfg.openWebSockets.Add(-1)
+
+	// The connection outlives the server's read and write timeouts, which
+	// stay set on it after it's hijacked. Each operation has its own instead.
+	controller := http.NewResponseController(response)
+	if err := controller.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		loggerFrom(request.Context()).Warn("websocket: Couldn't clear read deadline", "error", err)
+	}
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		loggerFrom(request.Context()).Warn("websocket: Couldn't clear write deadline", "error", err)
+	}
+
+	// Accept responds with an error itself if this isn't a valid upgrade
+	conn, err := websocket.Accept(response, request, nil)
+	if err != nil {
+		loggerFrom(request.Context()).Warn("websocket: Problem accepting connection", "error", err)
+		return
+	}
+	conn.SetReadLimit(wsReadLimit)
+
+	session := &wsSession{
+		cfg: cfg,
+		conn: conn,
+		userID: userID,
+		subscriptions: map[string]*stream.Subscription{},
+		events: make(chan wsServerMessage),
+		closing: make(chan wsCloseReason, 1),
+	}
+	closeReason := session.run(request.Context(), expiresAt)
+	loggerFrom(request.Context()).Info("websocket: Closing connection", "code", closeReason.code, "reason", closeReason.reason)
+	conn.Close(closeReason.code, closeReason.reason)
+}
+
+type wsSession struct {
+	cfg    *apiConfig
+	conn   *websocket.Conn
+	userID uuid.UUID
+	// By topic
+	subscriptions map[string]*stream.Subscription
+	// Events from all subscriptions, for writing
+	events chan wsServerMessage
+	// Set when something other than run decides the connection should end
+	closing chan wsCloseReason
+}
+
+// Serves the client until the connection should close, returning why
+func (s *wsSession) run(ctx context.Context, expiresAt time.Time) wsCloseReason {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer func() {
+		for _, sub := range s.subscriptions {
+			sub.Close()
+		}
+	}()
+
+	incoming := make(chan wsClientMessage)
+	go s.read(ctx, incoming)
+	go s.keepAlive(ctx)
+
+	expiry := time.NewTimer(time.Until(expiresAt))
+	defer expiry.Stop()
+	for {
+		var err error
+		select {
+		case reason := <-s.closing:
+			return reason
+		case <-ctx.Done():
+			return wsCloseReason{websocket.StatusGoingAway, "request ended"}
+		case <-s.cfg.streamHub.Closed():
+			return wsCloseReason{websocket.StatusGoingAway, "server shutting down"}
+		case <-expiry.C:
+			return wsCloseReason{websocket.StatusPolicyViolation, "token expired"}
+		case msg := <-incoming:
+			err = s.write(ctx, s.handle(ctx, msg))
+		case event := <-s.events:
+			err = s.write(ctx, event)
+		}
+		if err != nil {
+			return wsCloseReason{websocket.StatusInternalError, "couldn't write"}
+		}
+	}
+}
+
+// Passes the client's messages to incoming until the connection or ctx ends
+func (s *wsSession) read(ctx context.Context, incoming chan<- wsClientMessage) {
+	for {
+		msgType, data, err := s.conn.Read(ctx)
+		if err != nil {
+			status := websocket.CloseStatus(err)
+			if status == -1 {
+				// Not a close frame, e.g. the message was too big
+				status = websocket.StatusPolicyViolation
+			}
+			s.close(status, "read ended")
+			return
+		}
+
+		msg := wsClientMessage{}
+		if msgType != websocket.MessageText || json.Unmarshal(data, &msg) != nil {
+			// Answered with an error by handle
+			msg = wsClientMessage{Type: "invalid"}
+		}
+		select {
+		case incoming <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Pings the client so dead connections are noticed, and proxies don't close
+// idle ones
+func (s *wsSession) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, wsTimeout)
+			err := s.conn.Ping(pingCtx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				s.close(websocket.StatusPolicyViolation, "no pong")
+				return
+			}
+		}
+	}
+}
+
+// Asks run to end the connection, unless it's already ending
+func (s *wsSession) close(code websocket.StatusCode, reason string) {
+	select {
+	case s.closing <- wsCloseReason{code, reason}:
+	default:
+	}
+}
+
+func (s *wsSession) write(ctx context.Context, msg wsServerMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, wsTimeout)
+	defer cancel()
+	return s.conn.Write(ctx, websocket.MessageText, data)
+}
+
+// Handles a client message, returning the reply
+func (s *wsSession) handle(ctx context.Context, msg wsClientMessage) wsServerMessage {
+	switch msg.Type {
+	case "ping":
+		return wsServerMessage{Type: "pong", ID: msg.ID}
+	case "subscribe":
+		if err := s.subscribe(ctx, msg.Topic); err != nil {
+			return wsServerMessage{Type: "error", ID: msg.ID, Topic: msg.Topic, Error: err.Error()}
+		}
+		return wsServerMessage{Type: "subscribed", ID: msg.ID, Topic: msg.Topic}
+	case "unsubscribe":
+		if sub, ok := s.subscriptions[msg.Topic]; ok {
+			sub.Close()
+			delete(s.subscriptions, msg.Topic)
+		}
+		return wsServerMessage{Type: "unsubscribed", ID: msg.ID, Topic: msg.Topic}
+	case "invalid":
+		return wsServerMessage{Type: "error", Error: "messages must be JSON text"}
+	default:
+		return wsServerMessage{Type: "error", ID: msg.ID, Error: fmt.Sprintf("unknown message type '%s'", msg.Type)}
+	}
+}
+
+func (s *wsSession) subscribe(ctx context.Context, topic string) error {
+	if _, ok := s.subscriptions[topic]; ok {
+		// Already subscribed, which is fine
+		return nil
+	}
+	if len(s.subscriptions) >= wsMaxSubscriptions {
+		return fmt.Errorf("at most %d subscriptions per connection", wsMaxSubscriptions)
+	}
+	hubTopic, err := wsHubTopic(topic)
+	if err != nil {
+		return err
+	}
+	// Muted users are only hidden from the firehose, not from a chosen author
+	hidden, err := s.cfg.hiddenUsers(ctx, s.userID, hubTopic == "")
+	if err != nil {
+		loggerFrom(ctx).Error("websocket: Problem retrieving hidden users", "topic", topic, "error", err)
+		return fmt.Errorf("couldn't subscribe to '%s', try again later", topic)
+	}
+
+	sub := s.cfg.streamHub.Subscribe(hubTopic, streamClientBuffer)
+	s.subscriptions[topic] = sub
+	go s.forward(topic, sub, hidden)
+	return nil
+}
+
+// Passes a subscription's messages to run for writing until it ends, leaving
+// out those by hidden authors
+func (s *wsSession) forward(topic string, sub *stream.Subscription, hidden map[uuid.UUID]bool) {
+	for {
+		select {
+		case msg := <-sub.Messages():
+			// The hub topic is the author
+			if authorID, err := uuid.Parse(msg.Topic); err == nil && hidden[authorID] {
+				continue
+			}
+			select {
+			case s.events <- wsServerMessage{Type: "event", Topic: topic, Event: msg.Event, Data: msg.Data}:
+			case <-sub.Done():
+				// Unsubscribed, or the connection is closing
+				return
+			}
+		case <-sub.Done():
+			if errors.Is(sub.Err(), stream.ErrSlowConsumer) {
+				s.close(websocket.StatusTryAgainLater, "fell behind")
+			}
+			return
+		}
+	}
+}
+
+// The stream.Hub topic for a client's topic
+func wsHubTopic(topic string) (string, error) {
+	switch {
+	case topic == "chirps":
+		return "", nil
+	case strings.HasPrefix(topic, "chirps:"):
+		authorID, err := uuid.Parse(strings.TrimPrefix(topic, "chirps:"))
+		if err != nil {
+			return "", fmt.Errorf("invalid author ID in topic '%s'", topic)
+		}
+		return authorID.String(), nil
+	case topic == "timeline", topic == "mentions", strings.HasPrefix(topic, "thread:"):
+		// Need follows, mentions and replies, which chirps don't have yet
+		return "", fmt.Errorf("topic '%s' isn't available yet", topic)
+	default:
+		return "", fmt.Errorf("unknown topic '%s'", topic)
+	}
+}
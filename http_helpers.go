@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/venzy/chirpy/internal/auth"
@@ -18,7 +24,7 @@ func respondWithError(response http.ResponseWriter, code int, msg string) {
 		Error: msg,
 	})
 	if err != nil {
-		log.Printf("Error encoding error response: %s\n", err)
+		slog.Error("Error encoding error response", "error", err)
 		response.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -30,7 +36,7 @@ func respondWithError(response http.ResponseWriter, code int, msg string) {
 func respondWithJSON(response http.ResponseWriter, code int, payload interface{}) {
 	responseBody, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error encoding success response: %s\n", err)
+		slog.Error("Error encoding success response", "error", err)
 		response.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -39,8 +45,24 @@ func respondWithJSON(response http.ResponseWriter, code int, payload interface{}
 	response.Write(responseBody)
 }
 
-func (cfg *apiConfig) withAuthenticatedUser(handlerWithUser func(http.ResponseWriter, *http.Request, uuid.UUID)) http.Handler {
+// Accepts either a JWT access token ('Authorization: Bearer <jwt>') or a
+// personal access token ('Authorization: ApiKey <token>'). Personal access
+// tokens must have been granted the given scope; pass an empty scope for
+// endpoints that only a logged-in user may call (e.g. managing tokens).
+func (cfg *apiConfig) withAuthenticatedUser(scope string, handlerWithUser func(http.ResponseWriter, *http.Request, uuid.UUID)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKeyHeader, err := auth.GetAPIKey(r.Header); err == nil {
+			userID, err := cfg.validateAPIToken(r.Context(), apiKeyHeader, scope)
+			if err != nil {
+				loggerFrom(r.Context()).Warn("auth: Rejected API token", "error", err)
+				respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			setRequestUserID(r.Context(), userID)
+			handlerWithUser(w, r, userID)
+			return
+		}
+
 		token, err := auth.GetBearerToken(r.Header)
 		if err != nil {
 			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
@@ -53,6 +75,82 @@ func (cfg *apiConfig) withAuthenticatedUser(handlerWithUser func(http.ResponseWr
 			return
 		}
 
+		setRequestUserID(r.Context(), userID)
 		handlerWithUser(w, r, userID)
 	})
-}
\ No newline at end of file
+}
+
+// For public endpoints that show a logged-in user something different, e.g.
+// without users they've blocked. Only access tokens identify the user; other
+// requests, including ones with a bad or expired token, are served
+// anonymously, as they were before the endpoint knew about users.
+func (cfg *apiConfig) withOptionalUser(handlerWithViewer func(http.ResponseWriter, *http.Request, uuid.NullUUID)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		viewer := uuid.NullUUID{}
+		if token, err := auth.GetBearerToken(r.Header); err == nil {
+			if userID, err := auth.ValidateJWT(token, cfg.jwtSecret); err == nil {
+				setRequestUserID(r.Context(), userID)
+				viewer = uuid.NullUUID{UUID: userID, Valid: true}
+			}
+		}
+		handlerWithViewer(w, r, viewer)
+	})
+}
+
+func (cfg *apiConfig) validateAPIToken(ctx context.Context, apiKeyHeader, scope string) (uuid.UUID, error) {
+	if scope == "" {
+		return uuid.UUID{}, errors.New("endpoint does not accept API tokens")
+	}
+
+	apiTokenDB, err := cfg.db.GetAPITokenByHash(ctx, auth.HashAPIToken(apiKeyHeader))
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("unknown token: %w", err)
+	}
+
+	if apiTokenDB.RevokedAt.Valid {
+		return uuid.UUID{}, fmt.Errorf("token '%s' is revoked", apiTokenDB.ID)
+	}
+	if apiTokenDB.ExpiresAt.Valid && apiTokenDB.ExpiresAt.Time.Before(time.Now()) {
+		return uuid.UUID{}, fmt.Errorf("token '%s' is expired", apiTokenDB.ID)
+	}
+	if !slices.Contains(apiTokenDB.Scopes, scope) {
+		return uuid.UUID{}, fmt.Errorf("token '%s' lacks scope '%s'", apiTokenDB.ID, scope)
+	}
+
+	// Best effort - failing to record usage shouldn't fail the request
+	if err := cfg.db.TouchAPIToken(ctx, apiTokenDB.ID); err != nil {
+		loggerFrom(ctx).Error("auth: Couldn't update last_used_at", "token_id", apiTokenDB.ID, "error", err)
+	}
+
+	return apiTokenDB.UserID, nil
+}
+
+// Admin endpoints require 'Authorization: ApiKey <ADMIN_API_KEY>', and are
+// disabled entirely if no admin key is configured.
+func (cfg *apiConfig) withAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.adminKey == "" {
+			respondWithError(w, http.StatusForbidden, "Admin API is disabled")
+			return
+		}
+
+		apiKey, err := auth.GetAPIKey(r.Header)
+		if err != nil || !auth.SecretsEqual(apiKey, cfg.adminKey) {
+			loggerFrom(r.Context()).Warn("admin: Rejected request", "path", r.URL.Path, "remote_ip", clientIP(r))
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// The address of the client making the request. We don't trust
+// X-Forwarded-For since we don't know whether there's a proxy in front of us.
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
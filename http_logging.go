@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/server"
+)
+
+// Structured logging. Each request gets a requestInfo in its context, which
+// loggerFrom uses to tag every log line with the request ID, route and (once
+// authenticated) user ID, plus the trace ID when tracing is on.
+// withRequestLogging writes one access log line per request, including
+// latency.
+
+type requestInfo struct {
+	requestID string
+	route     string
+
+	// Guards the fields below, which are set part way through the request
+	// while handlers may already be logging from other goroutines
+	mu sync.Mutex
+	// Set by withAuthenticatedUser once it knows who the user is
+	userID uuid.UUID
+	// Set by withTracing
+	traceID string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+func loggerFrom(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	info := requestInfoFrom(ctx)
+	if info == nil {
+		return logger
+	}
+
+	info.mu.Lock()
+	userID, traceID := info.userID, info.traceID
+	info.mu.Unlock()
+
+	logger = logger.With("request_id", info.requestID, "route", info.route)
+	if userID != uuid.Nil {
+		logger = logger.With("user_id", userID)
+	}
+	if traceID != "" {
+		logger = logger.With("trace_id", traceID)
+	}
+	return logger
+}
+
+func setRequestUserID(ctx context.Context, userID uuid.UUID) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.mu.Lock()
+		info.userID = userID
+		info.mu.Unlock()
+	}
+}
+
+func setRequestTraceID(ctx context.Context, traceID string) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.mu.Lock()
+		info.traceID = traceID
+		info.mu.Unlock()
+	}
+}
+
+// The ServeMux pattern the request matched, e.g. "GET /api/chirps/{chirpID}"
+func requestRoute(r *http.Request) string {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return info.route
+	}
+	return "unknown"
+}
+
+// Accept a client or proxy supplied request ID only if it looks sane, since it
+// ends up in our logs
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._~+/=-]{1,128}$`)
+
+// Outermost middleware - wraps the whole mux so it can resolve the route.
+func withRequestLogging(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !requestIDRegex.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		info := &requestInfo{requestID: requestID, route: route}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		start := time.Now()
+		recorder := server.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelInfo
+		if recorder.Status >= 500 {
+			level = slog.LevelError
+		}
+		loggerFrom(r.Context()).Log(r.Context(), level, "http: request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.Status,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_ip", clientIP(r),
+		)
+	})
+}
+
+// Builds the default logger from LOG_FORMAT ("text" or "json") and LOG_LEVEL
+// ("debug", "info", "warn" or "error").
+func newLogger(out io.Writer, format, level string) (*slog.Logger, error) {
+	var slogLevel slog.Level
+	if level == "" {
+		level = "info"
+	}
+	if err := slogLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level '%s'", level)
+	}
+
+	options := &slog.HandlerOptions{Level: slogLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(out, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format '%s', must be 'text' or 'json'", format)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/entitlements"
+	"github.com/venzy/chirpy/internal/ratelimit"
+)
+
+// Rate limiting budgets. Anonymous requests are limited per client IP, and
+// authenticated writes per user, with the limit depending on their plan.
+type rateLimitBudget struct {
+	name  string
+	limit ratelimit.Limit
+	// Used instead of limit where the budget is per user, if set
+	planLimit func(entitlements.Entitlements) ratelimit.Limit
+}
+
+var (
+	anonymousReadBudget = rateLimitBudget{
+		name: "read",
+		limit: ratelimit.Limit{Burst: 60, Period: time.Minute},
+	}
+	authBudget = rateLimitBudget{
+		name: "auth",
+		limit: ratelimit.Limit{Burst: 10, Period: time.Minute},
+	}
+	writeBudget = rateLimitBudget{
+		name: "write",
+		limit: ratelimit.Limit{Burst: 20, Period: time.Minute},
+		planLimit: func(e entitlements.Entitlements) ratelimit.Limit {
+			return ratelimit.Limit{Burst: e.WritesPerMinute, Period: time.Minute}
+		},
+	}
+)
+
+// Limits by client IP. Composes like withMetricsInc.
+func (cfg *apiConfig) withRateLimit(budget rateLimitBudget, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := budget.name + ":ip:" + clientIP(r)
+		if !cfg.takeRateLimit(w, r, key, budget.limit) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limits by authenticated user, so goes inside withAuthenticatedUser.
+func (cfg *apiConfig) withUserRateLimit(budget rateLimitBudget, handlerWithUser func(http.ResponseWriter, *http.Request, uuid.UUID)) func(http.ResponseWriter, *http.Request, uuid.UUID) {
+	return func(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+		limit := budget.limit
+		if budget.planLimit != nil {
+			userEntitlements, err := cfg.entitlements.ForUser(r.Context(), userID)
+			if err == nil {
+				limit = budget.planLimit(userEntitlements)
+			}
+		}
+
+		key := budget.name + ":user:" + userID.String()
+		if !cfg.takeRateLimit(w, r, key, limit) {
+			return
+		}
+		handlerWithUser(w, r, userID)
+	}
+}
+
+// Sets the X-RateLimit-* headers, and responds with a 429 if the request isn't
+// allowed. Returns whether the request should proceed.
+func (cfg *apiConfig) takeRateLimit(w http.ResponseWriter, r *http.Request, key string, limit ratelimit.Limit) bool {
+	result, err := cfg.rateLimiter.Take(r.Context(), key, limit, time.Now())
+	if err != nil {
+		// Fail open - an unavailable store shouldn't take the whole API down
+		loggerFrom(r.Context()).Error("ratelimit: Couldn't check limit", "key", key, "error", err)
+		return true
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+
+	if !result.Allowed {
+		loggerFrom(r.Context()).Warn("ratelimit: Limit exceeded", "key", key)
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		respondWithError(w, http.StatusTooManyRequests, "Rate limit exceeded, try again later")
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
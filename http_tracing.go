@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/venzy/chirpy/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Runs each request in a span named after its route, so goes inside
+// withRequestLogging.
+func withTracing(next http.Handler) http.Handler {
+	return tracing.Handler(tracing.Tracer(), otel.GetTextMapPropagator(), requestRoute,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Lets loggerFrom tag log lines with the trace, including the access
+			// log line written after the span has ended
+			if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+				setRequestTraceID(r.Context(), spanContext.TraceID().String())
+			}
+			next.ServeHTTP(w, r)
+		}))
+}
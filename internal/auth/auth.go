@@ -2,6 +2,8 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"net/http"
@@ -30,11 +32,62 @@ func CheckPasswordHash(hash, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
+// A bcrypt hash of a random password nobody knows, at the same cost as
+// HashPassword uses. Comparing against it when there is no real hash to check
+// (e.g. login for an unknown email) makes that path take as long as a wrong
+// password, so response times don't reveal which emails are registered.
+const dummyPasswordHash = "$2a$10$0H.iokJelD8vKiPrWmKwdeyTjWcKjBDrGLWX7ExBLOwPYuodXrR2K"
+
+func CheckDummyPasswordHash(password string) {
+	// Always fails, the point is only to spend the time
+	_ = CheckPasswordHash(dummyPasswordHash, password)
+}
+
+// For comparing secrets such as API keys without the time taken revealing how
+// many leading characters matched.
+func SecretsEqual(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// Access tokens and MFA challenge tokens are both JWTs signed with the same
+// secret, so they are told apart by issuer - otherwise a challenge token
+// handed out after just a password check could be used as an access token.
+const (
+	accessTokenIssuer       = "chirpy"
+	mfaChallengeTokenIssuer = "chirpy-mfa"
+)
+
 func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return makeJWT(userID, tokenSecret, expiresIn, accessTokenIssuer)
+}
+
+func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	userID, _, err := validateJWT(tokenString, tokenSecret, accessTokenIssuer)
+	return userID, err
+}
+
+// Like ValidateJWT, but also returns when the token expires, for connections
+// that outlive the request that opened them.
+func ValidateJWTExpiry(tokenString, tokenSecret string) (uuid.UUID, time.Time, error) {
+	return validateJWT(tokenString, tokenSecret, accessTokenIssuer)
+}
+
+// Issued by login when the user has two-factor authentication enabled, and
+// exchanged along with a valid code for real access and refresh tokens.
+func MakeMFAChallengeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return makeJWT(userID, tokenSecret, expiresIn, mfaChallengeTokenIssuer)
+}
+
+func ValidateMFAChallengeJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	userID, _, err := validateJWT(tokenString, tokenSecret, mfaChallengeTokenIssuer)
+	return userID, err
+}
+
+func makeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration, issuer string) (string, error) {
 	now := time.Now().UTC()
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer: "chirpy",
+		Issuer: issuer,
 		IssuedAt: jwt.NewNumericDate(now),
 		ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
 		Subject: userID.String(),
@@ -43,28 +96,32 @@ func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (str
 	return token.SignedString([]byte(tokenSecret))
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+func validateJWT(tokenString, tokenSecret, issuer string) (uuid.UUID, time.Time, error) {
 	// This API is a little weird, and the documentation is pretty awful.
 	// It looks like you have to pass in a stack-local 'claims' to parse into ...
 	claims := &jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
 		return []byte(tokenSecret), nil
-	})
+	}, jwt.WithIssuer(issuer), jwt.WithExpirationRequired())
 
 	if err != nil {
-		return uuid.UUID{}, err
+		return uuid.UUID{}, time.Time{}, err
 	}
 
 	// ... but then you can still access it via the returned token
 	id, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.UUID{}, err
+		return uuid.UUID{}, time.Time{}, err
 	}
 	if id == "" {
-		return uuid.UUID{}, errors.New("subject claim is missing")
+		return uuid.UUID{}, time.Time{}, errors.New("subject claim is missing")
 	}
 
-	return uuid.Parse(id)
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.UUID{}, time.Time{}, err
+	}
+	return userID, claims.ExpiresAt.Time, nil
 }
 
 var bearerRegex = regexp.MustCompile(`^Bearer\s+([A-Za-z0-9-._~+/]+=*)$`)
@@ -106,4 +163,23 @@ func GetAPIKey(headers http.Header) (string, error) {
 		return "", errors.New("API key is empty")
 	}
 	return apiKey, nil
-}
\ No newline at end of file
+}
+
+// Personal access tokens are long random strings, so unlike passwords they
+// don't need a slow hash - a SHA-256 digest is enough to avoid storing them in
+// the clear, and lets us look tokens up by hash directly.
+const apiTokenPrefix = "chirpy_"
+
+func MakeAPIToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + hex.EncodeToString(tokenBytes), nil
+}
+
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -92,6 +92,37 @@ func TestExpiredJWT(t * testing.T) {
 	}
 }
 
+func TestValidateJWTExpiry(t *testing.T) {
+	userID := uuid.New()
+	secret := "eNc0d4_1f3"
+	before := time.Now().Add(time.Hour).Truncate(time.Second)
+	jwt, err := MakeJWT(userID, secret, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT() should have succeeded, err was: %s", err)
+	}
+
+	validatedUserID, expiresAt, err := ValidateJWTExpiry(jwt, secret)
+	if err != nil {
+		t.Fatalf("ValidateJWTExpiry() should have succeeded, err was: %s", err)
+	}
+	if validatedUserID != userID {
+		t.Errorf("ValidateJWTExpiry() user = %s, want %s", validatedUserID, userID)
+	}
+	// Expiry is only stored to the second
+	if expiresAt.Before(before) || expiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("ValidateJWTExpiry() expiry = %s, want about an hour from now", expiresAt)
+	}
+
+	// Challenge tokens aren't access tokens
+	challenge, err := MakeMFAChallengeJWT(userID, secret, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeMFAChallengeJWT() should have succeeded, err was: %s", err)
+	}
+	if _, _, err := ValidateJWTExpiry(challenge, secret); err == nil {
+		t.Errorf("ValidateJWTExpiry() should have rejected an MFA challenge token")
+	}
+}
+
 func TestGetBearerToken(t * testing.T) {
 	// This way of doing data-driven sub-tests was cribbed from Ch6 L6 solution files. Trying it out.
 
@@ -185,4 +216,33 @@ func TestMakeRefreshToken(t *testing.T) {
         }
         tokens[refreshToken] = struct{}{}
     }
-}
\ No newline at end of file
+}
+
+func TestMakeAPIToken(t *testing.T) {
+	token, err := MakeAPIToken()
+	if err != nil {
+		t.Errorf("MakeAPIToken() should have succeeded, err was: %s", err)
+		return
+	}
+	if !strings.HasPrefix(token, "chirpy_") {
+		t.Errorf("MakeAPIToken() token should start with 'chirpy_', was: %s", token)
+		return
+	}
+
+	// Must round-trip through the ApiKey Authorization scheme
+	headers := http.Header{}
+	headers.Add("Authorization", "ApiKey "+token)
+	apiKey, err := GetAPIKey(headers)
+	if err != nil || apiKey != token {
+		t.Errorf("GetAPIKey() = %v, %v, want %v", apiKey, err, token)
+		return
+	}
+
+	// Hashing must be deterministic so tokens can be looked up by hash
+	if HashAPIToken(token) != HashAPIToken(apiKey) {
+		t.Errorf("HashAPIToken() should be deterministic")
+	}
+	if HashAPIToken(token) == token {
+		t.Errorf("HashAPIToken() should not return the token itself")
+	}
+}
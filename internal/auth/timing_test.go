@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Harness for checking that code paths which must not be distinguishable by
+// timing (e.g. login with an unknown email vs. a wrong password) actually take
+// similar time. Timing is noisy, so these compare medians with a generous
+// tolerance, and are skipped with -short.
+
+type timingDistribution struct {
+	samples []time.Duration
+}
+
+func measureTiming(samples int, fn func()) timingDistribution {
+	dist := timingDistribution{samples: make([]time.Duration, 0, samples)}
+	for i := 0; i < samples; i++ {
+		start := time.Now()
+		fn()
+		dist.samples = append(dist.samples, time.Since(start))
+	}
+	slices.Sort(dist.samples)
+	return dist
+}
+
+func (dist timingDistribution) percentile(p int) time.Duration {
+	return dist.samples[(len(dist.samples)-1)*p/100]
+}
+
+func (dist timingDistribution) median() time.Duration {
+	return dist.percentile(50)
+}
+
+// Fails if the medians differ by more than the given ratio
+func compareTimings(t *testing.T, nameA string, a timingDistribution, nameB string, b timingDistribution, maxRatio float64) {
+	t.Helper()
+	for _, p := range []int{10, 50, 90} {
+		t.Logf("p%d: %s = %s, %s = %s", p, nameA, a.percentile(p), nameB, b.percentile(p))
+	}
+
+	slower, faster := a.median(), b.median()
+	if faster > slower {
+		slower, faster = faster, slower
+	}
+	if ratio := float64(slower) / float64(faster); ratio > maxRatio {
+		t.Errorf("median timings of %s and %s differ by %.2fx, want at most %.2fx", nameA, nameB, ratio, maxRatio)
+	}
+}
+
+func TestDummyPasswordHashCost(t *testing.T) {
+	cost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	if err != nil {
+		t.Fatalf("dummyPasswordHash should be a valid bcrypt hash, err was: %s", err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("dummyPasswordHash cost = %d, want %d to match HashPassword", cost, bcrypt.DefaultCost)
+	}
+}
+
+func TestLoginTimingUnknownUserVsWrongPassword(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test skipped in short mode")
+	}
+
+	realHash, err := HashPassword("Gladys#!456")
+	if err != nil {
+		t.Fatalf("Couldn't hash password: %s", err)
+	}
+
+	const samples = 15
+	wrongPassword := measureTiming(samples, func() {
+		_ = CheckPasswordHash(realHash, "not-the-password")
+	})
+	unknownUser := measureTiming(samples, func() {
+		CheckDummyPasswordHash("not-the-password")
+	})
+
+	compareTimings(t, "wrong password", wrongPassword, "unknown user", unknownUser, 1.5)
+}
+
+func TestSecretsEqualTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test skipped in short mode")
+	}
+
+	expected := "f271c81ff7084ee5b99a5091b42d486e"
+	// Differs in the first character vs. only in the last
+	earlyMismatch := "0271c81ff7084ee5b99a5091b42d486e"
+	lateMismatch := "f271c81ff7084ee5b99a5091b42d4860"
+
+	// Individual comparisons are far too quick to time, so time batches
+	const batch = 10000
+	const samples = 50
+	early := measureTiming(samples, func() {
+		for i := 0; i < batch; i++ {
+			SecretsEqual(earlyMismatch, expected)
+		}
+	})
+	late := measureTiming(samples, func() {
+		for i := 0; i < batch; i++ {
+			SecretsEqual(lateMismatch, expected)
+		}
+	})
+
+	compareTimings(t, "early mismatch", early, "late mismatch", late, 1.5)
+
+	if !SecretsEqual(expected, expected) || SecretsEqual(earlyMismatch, expected) {
+		t.Errorf("SecretsEqual() gave the wrong answer")
+	}
+}
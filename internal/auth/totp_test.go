@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// Test vectors from RFC 6238 Appendix B (SHA1), truncated to 6 digits.
+	// The secret is the ASCII string "12345678901234567890" in base32.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	tests := []struct {
+		unixTime int64
+		wantCode string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(tt.unixTime, 0)))
+		if err != nil {
+			t.Errorf("TOTPCode() should have succeeded, err was: %s", err)
+			continue
+		}
+		if code != tt.wantCode {
+			t.Errorf("TOTPCode() at %d = %s, want %s", tt.unixTime, code, tt.wantCode)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret() should have succeeded, err was: %s", err)
+	}
+
+	now := time.Unix(1744723537, 0)
+	code, err := TOTPCode(secret, TOTPStep(now))
+	if err != nil {
+		t.Fatalf("TOTPCode() should have succeeded, err was: %s", err)
+	}
+
+	step, err := ValidateTOTP(secret, code, now)
+	if err != nil || step != TOTPStep(now) {
+		t.Errorf("ValidateTOTP() = %d, %v, want %d", step, err, TOTPStep(now))
+	}
+
+	// One step of clock drift either way is tolerated
+	if _, err := ValidateTOTP(secret, code, now.Add(totpPeriod)); err != nil {
+		t.Errorf("ValidateTOTP() should tolerate one step of drift, err was: %s", err)
+	}
+
+	// But not more
+	if _, err := ValidateTOTP(secret, code, now.Add(3*totpPeriod)); err == nil {
+		t.Errorf("ValidateTOTP() should have failed for a stale code")
+	}
+
+	if _, err := ValidateTOTP(secret, "12345", now); err == nil {
+		t.Errorf("ValidateTOTP() should have failed for a short code")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("Chirpy", "walt@breakingbad.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:walt@breakingbad.com?") {
+		t.Errorf("TOTPURI() has unexpected label: %s", uri)
+	}
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=Chirpy") {
+		t.Errorf("TOTPURI() is missing secret or issuer: %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := MakeRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("MakeRecoveryCodes() should have succeeded, err was: %s", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("MakeRecoveryCodes() returned %d codes, want 10", len(codes))
+	}
+	for _, code := range codes {
+		if NormalizeRecoveryCode(code) != code {
+			t.Errorf("NormalizeRecoveryCode(%s) should be a no-op", code)
+		}
+		sloppy := strings.ToUpper(strings.ReplaceAll(code, "-", ""))
+		if NormalizeRecoveryCode(sloppy) != code {
+			t.Errorf("NormalizeRecoveryCode(%s) = %s, want %s", sloppy, NormalizeRecoveryCode(sloppy), code)
+		}
+	}
+}
+
+func TestMFAChallengeJWTIsNotAnAccessToken(t *testing.T) {
+	userID := uuid.New()
+	secret := "eNc0d4_1f3"
+
+	challenge, err := MakeMFAChallengeJWT(userID, secret, 5*time.Second)
+	if err != nil {
+		t.Fatalf("MakeMFAChallengeJWT() should have succeeded, err was: %s", err)
+	}
+
+	if _, err := ValidateJWT(challenge, secret); err == nil {
+		t.Errorf("ValidateJWT() should reject an MFA challenge token")
+	}
+
+	validatedUserID, err := ValidateMFAChallengeJWT(challenge, secret)
+	if err != nil || validatedUserID != userID {
+		t.Errorf("ValidateMFAChallengeJWT() = %s, %v, want %s", validatedUserID, err, userID)
+	}
+
+	// And the reverse
+	access, err := MakeJWT(userID, secret, 5*time.Second)
+	if err != nil {
+		t.Fatalf("MakeJWT() should have succeeded, err was: %s", err)
+	}
+	if _, err := ValidateMFAChallengeJWT(access, secret); err == nil {
+		t.Errorf("ValidateMFAChallengeJWT() should reject an access token")
+	}
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhookSignature(t *testing.T) {
+	body := []byte(`{"event":"user.upgraded","data":{"user_id":"3311741c-680c-4546-99f3-fc9efac2036c"}}`)
+	now := time.Unix(1744723537, 0)
+	tolerance := 5 * time.Minute
+
+	rotated := SignWebhook("new-secret", now, body)
+	// Sender signing with both secrets mid-rotation
+	both := rotated + ",v1=" + webhookSignature("old-secret", now.Unix(), body)
+
+	tests := []struct {
+		name    string
+		header  string
+		body    []byte
+		secrets []string
+		wantErr error
+	}{
+		{"valid", SignWebhook("secret", now, body), body, []string{"secret"}, nil},
+		{"second of our secrets", rotated, body, []string{"old-secret", "new-secret"}, nil},
+		{"second of their signatures", both, body, []string{"old-secret"}, nil},
+		{"within tolerance", SignWebhook("secret", now.Add(-4*time.Minute), body), body, []string{"secret"}, nil},
+		{"clock ahead", SignWebhook("secret", now.Add(4*time.Minute), body), body, []string{"secret"}, nil},
+		{"missing", "", body, []string{"secret"}, ErrWebhookSignatureMissing},
+		{"wrong secret", SignWebhook("other", now, body), body, []string{"secret"}, ErrWebhookSignatureInvalid},
+		{"tampered body", SignWebhook("secret", now, body), []byte(`{"event":"user.upgraded"}`), []string{"secret"}, ErrWebhookSignatureInvalid},
+		{"replayed", SignWebhook("secret", now.Add(-6*time.Minute), body), body, []string{"secret"}, ErrWebhookSignatureExpired},
+		{"no signature", "t=1744723537", body, []string{"secret"}, ErrWebhookSignatureInvalid},
+		{"no timestamp", "v1=" + webhookSignature("secret", now.Unix(), body), body, []string{"secret"}, ErrWebhookSignatureInvalid},
+		{"malformed", "garbage", body, []string{"secret"}, ErrWebhookSignatureInvalid},
+		{"no secrets", SignWebhook("secret", now, body), body, nil, ErrWebhookSignatureInvalid},
+	}
+
+	for _, tt := range tests {
+		err := ValidateWebhookSignature(tt.header, tt.body, tt.secrets, tolerance, now)
+		if tt.wantErr == nil && err != nil {
+			t.Errorf("%s: ValidateWebhookSignature() should have succeeded, err was: %s", tt.name, err)
+		}
+		if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: ValidateWebhookSignature() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
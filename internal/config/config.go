@@ -0,0 +1,400 @@
+// Package config loads chirpy's configuration. Values come from, in
+// increasing order of precedence: built-in defaults, an optional YAML or TOML
+// file, and environment variables (which a .env file can supply). Everything
+// is validated up front, so a misconfigured server fails at startup with every
+// problem listed, rather than at the first request that hits one.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Each field's env tag names the environment variable that sets it. Fields
+// tagged secret are redacted when printed.
+type Config struct {
+	// "dev" or "prod" - dev enables the reset endpoint
+	Platform string   `yaml:"platform" toml:"platform" env:"PLATFORM"`
+	Server   Server   `yaml:"server" toml:"server"`
+	Database Database `yaml:"database" toml:"database"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+	Chirps   Chirps   `yaml:"chirps" toml:"chirps"`
+	Polka    Polka    `yaml:"polka" toml:"polka"`
+	// Chirpy Red, paid for through Polka
+	Subscriptions Subscriptions `yaml:"subscriptions" toml:"subscriptions"`
+	Plans         Plans         `yaml:"plans" toml:"plans"`
+	OIDC          OIDC          `yaml:"oidc" toml:"oidc"`
+	Log           Log           `yaml:"log" toml:"log"`
+	Tracing       Tracing       `yaml:"tracing" toml:"tracing"`
+}
+
+type Server struct {
+	Addr              string        `yaml:"addr" toml:"addr" env:"LISTEN_ADDR"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	DrainDelay        time.Duration `yaml:"drain_delay" toml:"drain_delay" env:"SERVER_DRAIN_DELAY"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+}
+
+type Database struct {
+	URL             string        `yaml:"url" toml:"url" env:"DB_URL" secret:"true"`
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" toml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+	// Apply pending migrations at startup, rather than refusing to start
+	AutoMigrate bool `yaml:"auto_migrate" toml:"auto_migrate" env:"DB_AUTO_MIGRATE"`
+}
+
+type Auth struct {
+	JWTSecret          string        `yaml:"jwt_secret" toml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	AccessTokenExpiry  time.Duration `yaml:"access_token_expiry" toml:"access_token_expiry" env:"ACCESS_TOKEN_EXPIRY"`
+	RefreshTokenExpiry time.Duration `yaml:"refresh_token_expiry" toml:"refresh_token_expiry" env:"REFRESH_TOKEN_EXPIRY"`
+	MFAChallengeExpiry time.Duration `yaml:"mfa_challenge_expiry" toml:"mfa_challenge_expiry" env:"MFA_CHALLENGE_EXPIRY"`
+	// Optional - the admin API is disabled without it
+	AdminAPIKey string `yaml:"admin_api_key" toml:"admin_api_key" env:"ADMIN_API_KEY" secret:"true"`
+}
+
+type Chirps struct {
+	MaxLength int `yaml:"max_length" toml:"max_length" env:"CHIRP_MAX_LENGTH"`
+}
+
+// Webhooks are authenticated by signature if any signing secrets are set, and
+// by the older static API key otherwise
+type Polka struct {
+	Key string `yaml:"key" toml:"key" env:"POLKA_KEY" secret:"true"`
+	// Comma separated in the environment. More than one while rotating.
+	SigningSecrets     []string      `yaml:"signing_secrets" toml:"signing_secrets" env:"POLKA_SIGNING_SECRETS" secret:"true"`
+	SignatureTolerance time.Duration `yaml:"signature_tolerance" toml:"signature_tolerance" env:"POLKA_SIGNATURE_TOLERANCE"`
+}
+
+type Subscriptions struct {
+	// How long Red lasts past the end of a period that hasn't been paid for
+	GracePeriod time.Duration `yaml:"grace_period" toml:"grace_period" env:"SUBSCRIPTION_GRACE_PERIOD"`
+	// How often to look for subscriptions that have lapsed
+	ExpiryInterval time.Duration `yaml:"expiry_interval" toml:"expiry_interval" env:"SUBSCRIPTION_EXPIRY_INTERVAL"`
+}
+
+// What users on each plan may do. Only set in the config file. Editing,
+// media uploads and scheduling don't exist yet, but can be planned for.
+type Plans struct {
+	Free Plan `yaml:"free" toml:"free"`
+	Red  Plan `yaml:"red" toml:"red"`
+}
+
+type Plan struct {
+	// Zero for chirps.max_length
+	MaxChirpLength  int           `yaml:"max_chirp_length" toml:"max_chirp_length"`
+	EditWindow      time.Duration `yaml:"edit_window" toml:"edit_window"`
+	WritesPerMinute int           `yaml:"writes_per_minute" toml:"writes_per_minute"`
+	MediaUploads    bool          `yaml:"media_uploads" toml:"media_uploads"`
+	ScheduledChirps bool          `yaml:"scheduled_chirps" toml:"scheduled_chirps"`
+}
+
+// Optional "sign in with X" provider, enabled by setting Issuer
+type OIDC struct {
+	Issuer       string `yaml:"issuer" toml:"issuer" env:"OIDC_ISSUER"`
+	ProviderName string `yaml:"provider_name" toml:"provider_name" env:"OIDC_PROVIDER_NAME"`
+	ClientID     string `yaml:"client_id" toml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string `yaml:"redirect_url" toml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+}
+
+type Log struct {
+	// "text" or "json"
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT"`
+	// "debug", "info", "warn" or "error"
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+}
+
+type Tracing struct {
+	// "none", "stdout" or "otlp"
+	Exporter     string `yaml:"exporter" toml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	OTLPEndpoint string `yaml:"otlp_endpoint" toml:"otlp_endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName  string `yaml:"service_name" toml:"service_name" env:"OTEL_SERVICE_NAME"`
+}
+
+func Default() Config {
+	return Config{
+		Platform: "prod",
+		Server: Server{
+			Addr:              ":8080",
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			DrainDelay:        5 * time.Second,
+			ShutdownTimeout:   20 * time.Second,
+		},
+		Database: Database{
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		Auth: Auth{
+			AccessTokenExpiry:  time.Hour,
+			RefreshTokenExpiry: 60 * 24 * time.Hour, // 60 days
+			MFAChallengeExpiry: 5 * time.Minute,
+		},
+		Chirps: Chirps{MaxLength: 140},
+		Polka:  Polka{SignatureTolerance: 5 * time.Minute},
+		Subscriptions: Subscriptions{
+			GracePeriod:    3 * 24 * time.Hour,
+			ExpiryInterval: time.Hour,
+		},
+		Plans: Plans{
+			Free: Plan{WritesPerMinute: 20},
+			Red: Plan{
+				MaxChirpLength:  280,
+				EditWindow:      15 * time.Minute,
+				WritesPerMinute: 100,
+				MediaUploads:    true,
+				ScheduledChirps: true,
+			},
+		},
+		OIDC: OIDC{ProviderName: "oidc"},
+		Log:  Log{Format: "text", Level: "info"},
+		Tracing: Tracing{
+			Exporter:     "none",
+			OTLPEndpoint: "http://localhost:4318",
+			ServiceName:  "chirpy",
+		},
+	}
+}
+
+// Builds the config from the defaults, then the file at path (if not empty),
+// then the environment as returned by getenv, and validates the result.
+func Load(path string, getenv func(string) string) (Config, error) {
+	config := Default()
+	if path != "" {
+		if err := loadFile(path, &config); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Report bad values in the environment along with everything else wrong
+	problems := applyEnv(reflect.ValueOf(&config).Elem(), getenv)
+	problems = append(problems, config.problems()...)
+	if len(problems) > 0 {
+		return Config{}, &ValidationError{Problems: problems}
+	}
+	return config, nil
+}
+
+func loadFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: couldn't read file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if errors.Is(err, io.EOF) {
+			// Empty file
+			err = nil
+		}
+	case ".toml":
+		var metadata toml.MetaData
+		metadata, err = toml.Decode(string(data), config)
+		if err == nil {
+			if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+				err = fmt.Errorf("unknown keys %v", undecoded)
+			}
+		}
+	default:
+		return fmt.Errorf("config: file '%s' must end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config: couldn't parse '%s': %w", path, err)
+	}
+	return nil
+}
+
+// Sets each field with an env tag whose variable is non-empty, returning
+// every parse error rather than stopping at the first
+func applyEnv(v reflect.Value, getenv func(string) string) []error {
+	var errs []error
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		value := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(value, getenv)...)
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw := getenv(name)
+		if raw == "" {
+			continue
+		}
+		if err := setFromString(value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+func setFromString(value reflect.Value, raw string) error {
+	if value.Type() == reflect.TypeFor[time.Duration]() {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%s'", raw)
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer '%s'", raw)
+		}
+		value.SetInt(int64(n))
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", value.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean '%s'", raw)
+		}
+		value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// Checks every setting, returning a *ValidationError listing all the problems
+// found
+func (c Config) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (c Config) problems() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Platform == "dev" || c.Platform == "prod", "PLATFORM must be 'dev' or 'prod', got '%s'", c.Platform)
+
+	check(c.Server.Addr != "", "LISTEN_ADDR is required")
+	positiveDurations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"SERVER_READ_HEADER_TIMEOUT", c.Server.ReadHeaderTimeout},
+		{"SERVER_READ_TIMEOUT", c.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", c.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", c.Server.IdleTimeout},
+		{"SERVER_SHUTDOWN_TIMEOUT", c.Server.ShutdownTimeout},
+		{"ACCESS_TOKEN_EXPIRY", c.Auth.AccessTokenExpiry},
+		{"REFRESH_TOKEN_EXPIRY", c.Auth.RefreshTokenExpiry},
+		{"MFA_CHALLENGE_EXPIRY", c.Auth.MFAChallengeExpiry},
+		{"POLKA_SIGNATURE_TOLERANCE", c.Polka.SignatureTolerance},
+		{"SUBSCRIPTION_EXPIRY_INTERVAL", c.Subscriptions.ExpiryInterval},
+	}
+	for _, setting := range positiveDurations {
+		check(setting.d > 0, "%s must be positive, got %s", setting.name, setting.d)
+	}
+	check(c.Subscriptions.GracePeriod >= 0, "SUBSCRIPTION_GRACE_PERIOD must not be negative, got %s", c.Subscriptions.GracePeriod)
+	check(c.Server.DrainDelay >= 0, "SERVER_DRAIN_DELAY must not be negative, got %s", c.Server.DrainDelay)
+
+	check(c.Database.URL != "", "DB_URL is required")
+	check(c.Database.MaxOpenConns >= 0, "DB_MAX_OPEN_CONNS must not be negative, got %d", c.Database.MaxOpenConns)
+	check(c.Database.MaxIdleConns >= 0, "DB_MAX_IDLE_CONNS must not be negative, got %d", c.Database.MaxIdleConns)
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns,
+		"DB_MAX_IDLE_CONNS (%d) must not exceed DB_MAX_OPEN_CONNS (%d)", c.Database.MaxIdleConns, c.Database.MaxOpenConns)
+	check(c.Database.ConnMaxLifetime >= 0, "DB_CONN_MAX_LIFETIME must not be negative, got %s", c.Database.ConnMaxLifetime)
+	check(c.Database.ConnMaxIdleTime >= 0, "DB_CONN_MAX_IDLE_TIME must not be negative, got %s", c.Database.ConnMaxIdleTime)
+
+	check(c.Auth.JWTSecret != "", "JWT_SECRET is required")
+	check(c.Polka.Key != "" || len(c.Polka.SigningSecrets) > 0, "POLKA_KEY or POLKA_SIGNING_SECRETS is required")
+	check(c.Chirps.MaxLength > 0, "CHIRP_MAX_LENGTH must be positive, got %d", c.Chirps.MaxLength)
+
+	for _, plan := range []struct {
+		name string
+		plan Plan
+	}{
+		{"free", c.Plans.Free},
+		{"red", c.Plans.Red},
+	} {
+		check(plan.plan.MaxChirpLength >= 0, "plans.%s.max_chirp_length must not be negative, got %d", plan.name, plan.plan.MaxChirpLength)
+		check(plan.plan.EditWindow >= 0, "plans.%s.edit_window must not be negative, got %s", plan.name, plan.plan.EditWindow)
+		check(plan.plan.WritesPerMinute > 0, "plans.%s.writes_per_minute must be positive, got %d", plan.name, plan.plan.WritesPerMinute)
+	}
+
+	if c.OIDC.Issuer != "" {
+		check(c.OIDC.ProviderName != "", "OIDC_PROVIDER_NAME is required when OIDC_ISSUER is set")
+		check(c.OIDC.ClientID != "", "OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+		check(c.OIDC.RedirectURL != "", "OIDC_REDIRECT_URL is required when OIDC_ISSUER is set")
+	}
+
+	format := strings.ToLower(c.Log.Format)
+	check(format == "text" || format == "json", "LOG_FORMAT must be 'text' or 'json', got '%s'", c.Log.Format)
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "LOG_LEVEL must be 'debug', 'info', 'warn' or 'error', got '%s'", c.Log.Level)
+
+	switch strings.ToLower(c.Tracing.Exporter) {
+	case "none", "stdout", "console", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("OTEL_TRACES_EXPORTER must be 'none', 'stdout' or 'otlp', got '%s'", c.Tracing.Exporter))
+	}
+
+	return errs
+}
+
+type ValidationError struct {
+	Problems []error
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{fmt.Sprintf("config: %d problem(s) found:", len(e.Problems))}
+	for _, problem := range e.Problems {
+		lines = append(lines, "  - "+problem.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return e.Problems
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"io"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+// A copy of the config with every non-empty secret replaced, safe to log or
+// print
+func (c Config) Redacted() Config {
+	redactSecrets(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+func redactSecrets(v reflect.Value) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		value := v.Field(i)
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			redactSecrets(value)
+		case field.Tag.Get("secret") == "true" && value.Kind() == reflect.String && value.String() != "":
+			value.SetString(redacted)
+		case field.Tag.Get("secret") == "true" && value.Kind() == reflect.Slice && value.Len() > 0:
+			// A fresh slice, since the copy shares the original's
+			secrets := make([]string, value.Len())
+			for j := range secrets {
+				secrets[j] = redacted
+			}
+			value.Set(reflect.ValueOf(secrets))
+		}
+	}
+}
+
+// Writes the config as YAML, with secrets redacted. The output can be used as
+// a config file once the secrets are filled back in.
+func (c Config) WriteYAML(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -7,6 +7,7 @@ package database
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -100,6 +101,57 @@ func (q *Queries) GetChirps(ctx context.Context) ([]Chirp, error) {
 	return items, nil
 }
 
+const getChirpsAfter = `-- name: GetChirpsAfter :many
+SELECT id, created_at, updated_at, body, user_id FROM chirps
+WHERE (created_at, id) > ($1::timestamp, $2::uuid)
+    AND ($3::uuid IS NULL OR user_id = $3)
+ORDER BY created_at, id
+LIMIT $4
+`
+
+type GetChirpsAfterParams struct {
+	CreatedAt  time.Time
+	ID         uuid.UUID
+	AuthorID   uuid.NullUUID
+	MaxResults int32
+}
+
+// Chirps created after the given one, oldest first, optionally by one author.
+// For resuming a stream from the last chirp a client saw.
+func (q *Queries) GetChirpsAfter(ctx context.Context, arg GetChirpsAfterParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpsAfter,
+		arg.CreatedAt,
+		arg.ID,
+		arg.AuthorID,
+		arg.MaxResults,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getChirpsByAuthorID = `-- name: GetChirpsByAuthorID :many
 SELECT id, created_at, updated_at, body, user_id FROM chirps WHERE user_id = $1 ORDER BY created_at ASC
 `
@@ -132,3 +184,14 @@ func (q *Queries) GetChirpsByAuthorID(ctx context.Context, userID uuid.UUID) ([]
 	}
 	return items, nil
 }
+
+const notifyChirpCreated = `-- name: NotifyChirpCreated :exec
+SELECT pg_notify('chirp_created', $1::text)
+`
+
+// Tells every server listening on chirp_created about a new chirp. Run in a
+// transaction, it's sent when that commits.
+func (q *Queries) NotifyChirpCreated(ctx context.Context, chirpID string) error {
+	_, err := q.db.ExecContext(ctx, notifyChirpCreated, chirpID)
+	return err
+}
@@ -0,0 +1,80 @@
+package database
+
+// Not generated by sqlc - support for observing the queries it generates.
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Called before each query with the sqlc query name (e.g. "CreateChirp").
+// Returns the context to run the query with, and a function to call with the
+// query's outcome once it completes.
+type QueryHook func(ctx context.Context, queryName string) (context.Context, func(err error))
+
+type hookedDB struct {
+	db   DBTX
+	hook QueryHook
+}
+
+// Wraps db so that hook observes every query run through it. Pass the result
+// to New in place of db.
+func WithQueryHook(db DBTX, hook QueryHook) DBTX {
+	return &hookedDB{db: db, hook: hook}
+}
+
+// Like the generated WithTx, but queries in the transaction are observed by the
+// same hooks as q's, rather than run on tx directly.
+func (q *Queries) WithHookedTx(tx *sql.Tx) *Queries {
+	return &Queries{db: rehook(q.db, tx)}
+}
+
+// Rebuilds db's chain of hooks, in the same order, around inner instead
+func rehook(db DBTX, inner DBTX) DBTX {
+	if hooked, ok := db.(*hookedDB); ok {
+		return &hookedDB{db: rehook(hooked.db, inner), hook: hooked.hook}
+	}
+	return inner
+}
+
+func (h *hookedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, done := h.hook(ctx, QueryName(query))
+	result, err := h.db.ExecContext(ctx, query, args...)
+	done(err)
+	return result, err
+}
+
+func (h *hookedDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	ctx, done := h.hook(ctx, QueryName(query))
+	stmt, err := h.db.PrepareContext(ctx, query)
+	done(err)
+	return stmt, err
+}
+
+// Only covers running the query, not iterating the rows
+func (h *hookedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, done := h.hook(ctx, QueryName(query))
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (h *hookedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, done := h.hook(ctx, QueryName(query))
+	row := h.db.QueryRowContext(ctx, query, args...)
+	done(row.Err())
+	return row
+}
+
+// Extracts the name from the '-- name: CreateChirp :one' comment sqlc puts at
+// the start of each query.
+func QueryName(query string) string {
+	const prefix = "-- name: "
+	if !strings.HasPrefix(query, prefix) {
+		return "unknown"
+	}
+	firstLine, _, _ := strings.Cut(query[len(prefix):], "\n")
+	name, _, _ := strings.Cut(firstLine, " ")
+	return name
+}
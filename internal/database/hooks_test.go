@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestQueryName(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{createChirp, "CreateChirp"},
+		{getChirps, "GetChirps"},
+		{revokeAPIToken, "RevokeAPIToken"},
+		{"SELECT 1", "unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := QueryName(tt.query); got != tt.want {
+			t.Errorf("QueryName() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+// Records the queries it's asked to run, without running them
+type recordingDB struct {
+	DBTX
+	queries []string
+}
+
+func (r *recordingDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, QueryName(query))
+	return nil, nil
+}
+
+func TestRehook(t *testing.T) {
+	var calls []string
+	hook := func(name string) QueryHook {
+		return func(ctx context.Context, queryName string) (context.Context, func(err error)) {
+			calls = append(calls, name+":"+queryName)
+			return ctx, func(err error) {}
+		}
+	}
+
+	outer := &recordingDB{}
+	db := WithQueryHook(WithQueryHook(outer, hook("metrics")), hook("tracing"))
+	inner := &recordingDB{}
+	queries := &Queries{db: rehook(db, inner)}
+
+	if err := queries.DeleteChirpByID(context.Background(), uuid.Nil); err != nil {
+		t.Fatalf("DeleteChirpByID() error = %v", err)
+	}
+	if len(outer.queries) != 0 || len(inner.queries) != 1 {
+		t.Errorf("ran %v on the original and %v on the new db, want it only on the new one", outer.queries, inner.queries)
+	}
+	want := []string{"tracing:DeleteChirpByID", "metrics:DeleteChirpByID"}
+	if len(calls) != len(want) || calls[0] != want[0] || calls[1] != want[1] {
+		t.Errorf("hooks called %v, want %v", calls, want)
+	}
+
+	if got := rehook(outer, inner); got != inner {
+		t.Errorf("rehook() of an unhooked db = %v, want inner", got)
+	}
+}
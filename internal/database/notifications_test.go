@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/migrate"
+	"github.com/venzy/chirpy/internal/notifications"
+)
+
+// Queries against a migrated Postgres database at TEST_DB_URL, which should be
+// one for tests alone, e.g.
+// postgres://localhost:5432/chirpy_test?sslmode=disable. Skips the test if
+// it's not set.
+func testQueries(t *testing.T) (*Queries, *sql.DB) {
+	t.Helper()
+	url := os.Getenv("TEST_DB_URL")
+	if url == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrate.New(db, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("migrate.New() error = %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	return New(db), db
+}
+
+// Creates a user, deleted again with everything of theirs after the test
+func testUser(t *testing.T, queries *Queries, db *sql.DB) uuid.UUID {
+	t.Helper()
+	user, err := queries.CreateUser(context.Background(), CreateUserParams{
+		Email:          uuid.NewString() + "@example.com",
+		HashedPassword: "unused",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = $1", user.ID) })
+	return user.ID
+}
+
+// A second message in a conversation whose notification has been read starts
+// a new one, while repeats before then don't
+func TestAddNotificationAfterRead(t *testing.T) {
+	queries, db := testQueries(t)
+	ctx := context.Background()
+	recipient := testUser(t, queries, db)
+	sender := testUser(t, queries, db)
+	params := AddNotificationParams{
+		UserID:   recipient,
+		Type:     string(notifications.Message),
+		GroupKey: notifications.GroupKey(notifications.Message, uuid.NullUUID{}, uuid.New()),
+		ActorID:  sender,
+	}
+
+	if added, err := queries.AddNotification(ctx, params); err != nil || added != 1 {
+		t.Fatalf("AddNotification() for the first message = %d, %v, want 1", added, err)
+	}
+	if added, err := queries.AddNotification(ctx, params); err != nil || added != 0 {
+		t.Fatalf("AddNotification() while unread = %d, %v, want 0", added, err)
+	}
+	if _, err := queries.MarkAllNotificationsRead(ctx, recipient); err != nil {
+		t.Fatalf("MarkAllNotificationsRead() error = %v", err)
+	}
+	if added, err := queries.AddNotification(ctx, params); err != nil || added != 1 {
+		t.Fatalf("AddNotification() after reading = %d, %v, want 1", added, err)
+	}
+
+	rows, err := queries.GetNotifications(ctx, GetNotificationsParams{UserID: recipient, MaxResults: 10})
+	if err != nil {
+		t.Fatalf("GetNotifications() error = %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("GetNotifications() returned %d notifications, want 2", len(rows))
+	}
+	if rows[0].ReadAt.Valid || !rows[1].ReadAt.Valid {
+		t.Errorf("GetNotifications() = %+v, want the new unread one before the read one", rows)
+	}
+}
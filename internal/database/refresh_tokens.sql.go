@@ -54,6 +54,20 @@ func (q *Queries) DeleteRefreshTokenByToken(ctx context.Context, token string) e
 	return err
 }
 
+const deleteStaleRefreshTokens = `-- name: DeleteStaleRefreshTokens :execrows
+DELETE FROM refresh_tokens
+WHERE expires_at < $1::timestamp OR revoked_at < $1::timestamp
+`
+
+// Deletes tokens that expired or were revoked before the cutoff.
+func (q *Queries) DeleteStaleRefreshTokens(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteStaleRefreshTokens, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const getUserIDWithRefreshToken = `-- name: GetUserIDWithRefreshToken :one
 SELECT 
     users.id AS user_id,
@@ -87,3 +101,14 @@ func (q *Queries) RevokeRefreshToken(ctx context.Context, token string) error {
 	_, err := q.db.ExecContext(ctx, revokeRefreshToken, token)
 	return err
 }
+
+const revokeRefreshTokensByUserID = `-- name: RevokeRefreshTokensByUserID :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeRefreshTokensByUserID(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeRefreshTokensByUserID, userID)
+	return err
+}
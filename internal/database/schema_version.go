@@ -0,0 +1,18 @@
+package database
+
+// Not generated by sqlc - goose's version table isn't part of the schema sqlc
+// reads.
+
+import "context"
+
+const getSchemaVersion = `-- name: GetSchemaVersion :one
+SELECT COALESCE(MAX(version_id), 0)::bigint FROM goose_db_version WHERE is_applied
+`
+
+// The version of the newest migration goose has applied
+func (q *Queries) GetSchemaVersion(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getSchemaVersion)
+	var version int64
+	err := row.Scan(&version)
+	return version, err
+}
@@ -0,0 +1,71 @@
+// Package entitlements decides what a user may do based on their plan, so
+// handlers ask one place rather than each checking for Chirpy Red.
+package entitlements
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Plan string
+
+const (
+	Free Plan = "free"
+	Red  Plan = "red"
+)
+
+// What a plan allows. Zero values mean the feature isn't available.
+type Entitlements struct {
+	Plan           Plan
+	MaxChirpLength int
+	// How long after posting a chirp it can still be edited
+	EditWindow time.Duration
+	// Writes allowed in a burst, refilled over a minute
+	WritesPerMinute int
+	MediaUploads    bool
+	ScheduledChirps bool
+}
+
+// Finds which plan a user is on
+type PlanLookup func(ctx context.Context, userID uuid.UUID) (Plan, error)
+
+// What handlers use to find out what a user may do
+type Checker interface {
+	ForUser(ctx context.Context, userID uuid.UUID) (Entitlements, error)
+}
+
+type Service struct {
+	plans  map[Plan]Entitlements
+	lookup PlanLookup
+}
+
+// plans must include Free, which is used for any plan it doesn't include
+func New(plans map[Plan]Entitlements, lookup PlanLookup) (*Service, error) {
+	if _, ok := plans[Free]; !ok {
+		return nil, errors.New("entitlements: the free plan must be defined")
+	}
+	copied := make(map[Plan]Entitlements, len(plans))
+	for plan, entitlements := range plans {
+		entitlements.Plan = plan
+		copied[plan] = entitlements
+	}
+	return &Service{plans: copied, lookup: lookup}, nil
+}
+
+func (s *Service) ForPlan(plan Plan) Entitlements {
+	if entitlements, ok := s.plans[plan]; ok {
+		return entitlements
+	}
+	return s.plans[Free]
+}
+
+func (s *Service) ForUser(ctx context.Context, userID uuid.UUID) (Entitlements, error) {
+	plan, err := s.lookup(ctx, userID)
+	if err != nil {
+		return Entitlements{}, err
+	}
+	return s.ForPlan(plan), nil
+}
@@ -0,0 +1,69 @@
+package entitlements
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestForUser(t *testing.T) {
+	redUser := uuid.New()
+	goneUser := uuid.New()
+	oddUser := uuid.New()
+	lookup := func(ctx context.Context, userID uuid.UUID) (Plan, error) {
+		switch userID {
+		case redUser:
+			return Red, nil
+		case goneUser:
+			return "", errors.New("no such user")
+		case oddUser:
+			return "enterprise", nil
+		default:
+			return Free, nil
+		}
+	}
+
+	service, err := New(map[Plan]Entitlements{
+		Free: {MaxChirpLength: 140, WritesPerMinute: 20},
+		Red:  {MaxChirpLength: 280, WritesPerMinute: 100, MediaUploads: true},
+	}, lookup)
+	if err != nil {
+		t.Fatalf("New() should have succeeded, err was: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		userID     uuid.UUID
+		wantPlan   Plan
+		wantLength int
+		wantMedia  bool
+	}{
+		{"free", uuid.New(), Free, 140, false},
+		{"red", redUser, Red, 280, true},
+		{"unknown plan falls back to free", oddUser, Free, 140, false},
+	}
+
+	for _, tt := range tests {
+		got, err := service.ForUser(context.Background(), tt.userID)
+		if err != nil {
+			t.Errorf("%s: ForUser() should have succeeded, err was: %s", tt.name, err)
+			continue
+		}
+		if got.Plan != tt.wantPlan || got.MaxChirpLength != tt.wantLength || got.MediaUploads != tt.wantMedia {
+			t.Errorf("%s: ForUser() = %+v, want plan %s, length %d, media %t", tt.name, got, tt.wantPlan, tt.wantLength, tt.wantMedia)
+		}
+	}
+
+	if _, err := service.ForUser(context.Background(), goneUser); err == nil {
+		t.Errorf("ForUser() should have failed when the plan lookup does")
+	}
+}
+
+func TestNewRequiresFreePlan(t *testing.T) {
+	_, err := New(map[Plan]Entitlements{Red: {MaxChirpLength: 280}}, nil)
+	if err == nil {
+		t.Errorf("New() should have failed without a free plan")
+	}
+}
@@ -0,0 +1,187 @@
+// Package events publishes domain events to in-process subscribers. Events
+// are written to an outbox in the same transaction as the change they
+// describe, so they're neither lost if we stop before publishing them nor
+// published for changes that were rolled back. A Dispatcher then takes them
+// from the outbox and publishes them on a Bus.
+//
+// Delivery is at least once: an event stays in the outbox until every
+// subscriber has handled it, and is published again to all of them if any
+// failed. Subscribers must tolerate seeing an event more than once, e.g. by
+// keying what they do on its ID.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/queue"
+)
+
+// Defaults for a Dispatcher's settings
+const (
+	DefaultBatchSize = 100
+	// How long subscribers have to handle a batch before the events may be
+	// claimed again, by us or another replica
+	DefaultLease = time.Minute
+)
+
+// The wait before publishing again after an attempt failed: a second, then
+// doubling up to 5 minutes. Events are retried for as long as it takes.
+var Backoff = queue.Backoff{Base: time.Second, Max: 5 * time.Minute}
+
+type Event struct {
+	ID        uuid.UUID
+	Type      string
+	CreatedAt time.Time
+	// The user whose account it concerns
+	UserID  uuid.UUID
+	Payload json.RawMessage
+	// Including this one
+	Attempt int
+}
+
+// Handles an event, returning an error to have it published again later
+type Handler func(ctx context.Context, event Event) error
+
+type subscriber struct {
+	name string
+	// Empty for all of them
+	eventTypes map[string]bool
+	handler    Handler
+}
+
+// Publishes events to the subscribers interested in them
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []subscriber
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Has handler called with events of the given types, or every event if none
+// are given. The name identifies the subscriber in errors and logs.
+func (b *Bus) Subscribe(name string, handler Handler, eventTypes ...string) {
+	types := map[string]bool{}
+	for _, eventType := range eventTypes {
+		types[eventType] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, subscriber{name: name, eventTypes: types, handler: handler})
+}
+
+// Calls each interested subscriber in the order they subscribed, returning
+// their errors joined. A subscriber's failure doesn't stop the rest being
+// called.
+func (b *Bus) Publish(ctx context.Context, event Event) error {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, sub := range subscribers {
+		if len(sub.eventTypes) > 0 && !sub.eventTypes[event.Type] {
+			continue
+		}
+		if err := sub.handle(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// One subscriber panicking shouldn't take the others, or the server, down
+func (s subscriber) handle(ctx context.Context, event Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handler(ctx, event)
+}
+
+type Store interface {
+	// Claims up to limit due events, oldest first, counting an attempt on
+	// each. They mustn't be claimed again before leaseUntil, in case we're
+	// still publishing them.
+	Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]Event, error)
+	// Removes an event every subscriber has handled
+	Delete(ctx context.Context, event Event) error
+	// Has the event claimed again at retryAt, recording why it failed
+	Retry(ctx context.Context, event Event, retryAt time.Time, reason string) error
+}
+
+// Publishes events from a Store on a Bus in the background
+type Dispatcher struct {
+	store  Store
+	bus    *Bus
+	logger *slog.Logger
+	now    func() time.Time
+	wake   chan struct{}
+
+	BatchSize int
+	Lease     time.Duration
+}
+
+func NewDispatcher(store Store, bus *Bus, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{
+		store:     store,
+		bus:       bus,
+		logger:    logger,
+		now:       time.Now,
+		wake:      make(chan struct{}, 1),
+		BatchSize: DefaultBatchSize,
+		Lease:     DefaultLease,
+	}
+}
+
+// Has Run look for events now rather than at its next tick, e.g. after
+// committing one. Never blocks.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+		// Already due to look
+	}
+}
+
+// Publishes whatever is due every interval, or sooner when notified, until
+// ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	queue.Run(ctx, interval, d.BatchSize, d.wake, d.RunOnce, func(err error) {
+		d.logger.Error("events: Problem publishing events", "error", err)
+	})
+}
+
+// Claims and publishes one batch of due events, returning how many it claimed
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, error) {
+	batch, err := d.store.Claim(ctx, d.BatchSize, d.now().Add(d.Lease))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, event := range batch {
+		if err := d.bus.Publish(ctx, event); err != nil {
+			d.logger.Warn("events: Subscriber failed", "event_id", event.ID, "type", event.Type, "attempt", event.Attempt, "error", err)
+			if err := d.store.Retry(ctx, event, d.now().Add(Backoff.After(event.Attempt)), err.Error()); err != nil {
+				// It'll be retried once the lease runs out anyway
+				return len(batch), fmt.Errorf("couldn't record failure of event %s: %w", event.ID, err)
+			}
+			continue
+		}
+		if err := d.store.Delete(ctx, event); err != nil {
+			// It'll be published again once the lease runs out
+			return len(batch), fmt.Errorf("couldn't remove published event %s: %w", event.ID, err)
+		}
+	}
+	return len(batch), nil
+}
@@ -0,0 +1,192 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/queue/queuetest"
+)
+
+// An in-memory outbox with the same semantics as the database one
+type memStore struct {
+	now    func() time.Time
+	outbox *queuetest.Queue[Event]
+}
+
+func newMemStore(now func() time.Time) *memStore {
+	return &memStore{now: now, outbox: queuetest.NewQueue[Event](now)}
+}
+
+func (s *memStore) add(eventType string) uuid.UUID {
+	id := uuid.New()
+	s.outbox.Add(Event{ID: id, Type: eventType, CreatedAt: s.now(), UserID: uuid.New(), Payload: []byte(`{}`)})
+	return id
+}
+
+func (s *memStore) Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]Event, error) {
+	return s.outbox.Claim(limit, leaseUntil, nil, func(event *Event) { event.Attempt++ }), nil
+}
+
+func (s *memStore) Delete(ctx context.Context, event Event) error {
+	s.outbox.Remove(func(stored Event) bool { return stored.ID == event.ID })
+	return nil
+}
+
+func (s *memStore) Retry(ctx context.Context, event Event, retryAt time.Time, reason string) error {
+	s.outbox.Update(func(stored Event) bool { return stored.ID == event.ID }, func(entry *queuetest.Entry[Event]) {
+		entry.DueAt, entry.Reason = retryAt, reason
+	})
+	return nil
+}
+
+func newTestDispatcher(store Store, bus *Bus, clock *queuetest.Clock) *Dispatcher {
+	dispatcher := NewDispatcher(store, bus, queuetest.Logger())
+	dispatcher.now = clock.Now
+	return dispatcher
+}
+
+func TestBusPublish(t *testing.T) {
+	var got []string
+	record := func(name string) Handler {
+		return func(ctx context.Context, event Event) error {
+			got = append(got, name+":"+event.Type)
+			return nil
+		}
+	}
+
+	bus := NewBus()
+	bus.Subscribe("all", record("all"))
+	bus.Subscribe("created", record("created"), "chirp.created")
+	bus.Subscribe("failing", func(ctx context.Context, event Event) error {
+		return errors.New("index unavailable")
+	}, "chirp.deleted")
+	bus.Subscribe("panicking", func(ctx context.Context, event Event) error {
+		panic("oops")
+	}, "chirp.deleted")
+	bus.Subscribe("after", record("after"), "chirp.deleted")
+
+	if err := bus.Publish(context.Background(), Event{Type: "chirp.created"}); err != nil {
+		t.Errorf("Publish() error = %v", err)
+	}
+	err := bus.Publish(context.Background(), Event{Type: "chirp.deleted"})
+	if err == nil {
+		t.Errorf("Publish() should have reported the failing subscribers")
+	}
+
+	// Failures don't stop later subscribers
+	want := []string{"all:chirp.created", "created:chirp.created", "all:chirp.deleted", "after:chirp.deleted"}
+	if len(got) != len(want) {
+		t.Fatalf("handled %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("handled %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestDispatcherPublishesAndDeletes(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	store := newMemStore(clock.Now)
+	first := store.add("chirp.created")
+	second := store.add("chirp.deleted")
+
+	var published []uuid.UUID
+	bus := NewBus()
+	bus.Subscribe("test", func(ctx context.Context, event Event) error {
+		published = append(published, event.ID)
+		return nil
+	})
+
+	claimed, err := newTestDispatcher(store, bus, clock).RunOnce(context.Background())
+	if err != nil || claimed != 2 {
+		t.Fatalf("RunOnce() = %d, %v, want 2 events", claimed, err)
+	}
+	if len(published) != 2 || published[0] != first || published[1] != second {
+		t.Errorf("published %v, want %v in order", published, []uuid.UUID{first, second})
+	}
+	if store.outbox.Len() != 0 {
+		t.Errorf("%d events left in the outbox, want none", store.outbox.Len())
+	}
+}
+
+func TestDispatcherRetriesFailures(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	store := newMemStore(clock.Now)
+	store.add("chirp.created")
+
+	failuresLeft := 2
+	var attempts []int
+	bus := NewBus()
+	bus.Subscribe("flaky", func(ctx context.Context, event Event) error {
+		attempts = append(attempts, event.Attempt)
+		if failuresLeft > 0 {
+			failuresLeft--
+			return errors.New("try later")
+		}
+		return nil
+	})
+	dispatcher := newTestDispatcher(store, bus, clock)
+
+	steps := []struct {
+		advance     time.Duration
+		wantClaimed int
+	}{
+		{0, 1},                      // fails, retry in a second
+		{500 * time.Millisecond, 0}, // not due yet
+		{500 * time.Millisecond, 1}, // fails, retry in two seconds
+		{2 * time.Second, 1},        // succeeds
+		{time.Hour, 0},              // nothing left
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		claimed, err := dispatcher.RunOnce(context.Background())
+		if err != nil || claimed != step.wantClaimed {
+			t.Fatalf("step %d: RunOnce() = %d, %v, want %d", i, claimed, err, step.wantClaimed)
+		}
+		if i == 0 && store.outbox.Entry(0).Reason == "" {
+			t.Errorf("failure reason wasn't recorded")
+		}
+	}
+	if len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("attempts = %v, want 1, 2, 3", attempts)
+	}
+	if store.outbox.Len() != 0 {
+		t.Errorf("%d events left in the outbox, want none", store.outbox.Len())
+	}
+}
+
+func TestDispatcherNotify(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	store := newMemStore(clock.Now)
+	published := make(chan Event, 1)
+	bus := NewBus()
+	bus.Subscribe("test", func(ctx context.Context, event Event) error {
+		published <- event
+		return nil
+	})
+	dispatcher := newTestDispatcher(store, bus, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// Long enough that only a notification can explain publishing
+		dispatcher.Run(ctx, time.Hour)
+		close(done)
+	}()
+
+	store.add("chirp.created")
+	dispatcher.Notify()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Errorf("event wasn't published after Notify()")
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,69 @@
+// Package lockout decides how long to refuse login attempts after repeated
+// failures. It is pure policy - counting failures is up to the caller.
+package lockout
+
+import "time"
+
+type Policy struct {
+	// Failures allowed before any delay kicks in
+	FreeAttempts int
+	// Delay after the first failure beyond FreeAttempts, doubling each time
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// After this many failures the key is locked for LockoutDuration instead
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// Failures older than this are forgotten
+	Window time.Duration
+}
+
+// Per-account limits. Keyed by the email supplied, whether or not a user has
+// it, so that lockouts don't reveal which emails are registered.
+var AccountPolicy = Policy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	Window:           time.Hour,
+}
+
+// Per-IP limits are looser, since many users can share an address (NAT etc.)
+var IPPolicy = Policy{
+	FreeAttempts:     10,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 50,
+	LockoutDuration:  time.Hour,
+	Window:           time.Hour,
+}
+
+// How long to refuse further attempts after the given number of consecutive
+// failures.
+func (p Policy) Delay(failures int) time.Duration {
+	if failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Time until which attempts should be refused, or the zero time if they
+// needn't be.
+func (p Policy) LockedUntil(failures int, lastFailure time.Time) time.Time {
+	delay := p.Delay(failures)
+	if delay == 0 {
+		return time.Time{}
+	}
+	return lastFailure.Add(delay)
+}
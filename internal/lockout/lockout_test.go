@@ -0,0 +1,51 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	policy := Policy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         10 * time.Second,
+		LockoutThreshold: 10,
+		LockoutDuration:  time.Hour,
+	}
+
+	tests := []struct {
+		failures  int
+		wantDelay time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if delay := policy.Delay(tt.failures); delay != tt.wantDelay {
+			t.Errorf("Delay(%d) = %s, want %s", tt.failures, delay, tt.wantDelay)
+		}
+	}
+}
+
+func TestLockedUntil(t *testing.T) {
+	lastFailure := time.Date(2025, 4, 15, 12, 0, 0, 0, time.UTC)
+
+	if lockedUntil := AccountPolicy.LockedUntil(1, lastFailure); !lockedUntil.IsZero() {
+		t.Errorf("LockedUntil() should be zero within free attempts, was %s", lockedUntil)
+	}
+
+	lockedUntil := AccountPolicy.LockedUntil(AccountPolicy.LockoutThreshold, lastFailure)
+	if !lockedUntil.Equal(lastFailure.Add(AccountPolicy.LockoutDuration)) {
+		t.Errorf("LockedUntil() at threshold = %s, want %s", lockedUntil, lastFailure.Add(AccountPolicy.LockoutDuration))
+	}
+}
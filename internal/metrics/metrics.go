@@ -0,0 +1,353 @@
+// Package metrics is a small Prometheus-compatible metrics registry: labelled
+// counters, gauges and histograms, rendered in the text exposition format.
+// It covers what chirpy needs without pulling in the full client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default histogram buckets, in seconds - suitable for request and query latency
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	writeText(w io.Writer) error
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: '%s' registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Renders every registered metric in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.writeText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		r.WriteText(w)
+	})
+}
+
+// Shared bookkeeping for a metric with a fixed set of label names, holding one
+// series per distinct combination of label values.
+type vec[S any] struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	newSeries  func() *S
+
+	mu     sync.Mutex
+	series map[string]*labelledSeries[S]
+}
+
+type labelledSeries[S any] struct {
+	labelValues []string
+	series      *S
+}
+
+func newVec[S any](name, help, metricType string, labelNames []string, newSeries func() *S) *vec[S] {
+	return &vec[S]{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		newSeries:  newSeries,
+		series:     map[string]*labelledSeries[S]{},
+	}
+}
+
+func (v *vec[S]) with(labelValues []string) *S {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: '%s' wants %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ls, ok := v.series[key]
+	if !ok {
+		ls = &labelledSeries[S]{labelValues: slices.Clone(labelValues), series: v.newSeries()}
+		v.series[key] = ls
+	}
+	return ls.series
+}
+
+// Series sorted by label values, so output is stable
+func (v *vec[S]) sorted() []*labelledSeries[S] {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	sorted := make([]*labelledSeries[S], 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, v.series[key])
+	}
+	return sorted
+}
+
+func (v *vec[S]) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.metricType)
+	return err
+}
+
+// A float64 guarded by a mutex, the basis of counters and gauges
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (val *value) add(delta float64) {
+	val.mu.Lock()
+	val.v += delta
+	val.mu.Unlock()
+}
+
+func (val *value) set(v float64) {
+	val.mu.Lock()
+	val.v = v
+	val.mu.Unlock()
+}
+
+func (val *value) get() float64 {
+	val.mu.Lock()
+	defer val.mu.Unlock()
+	return val.v
+}
+
+type Counter struct {
+	value
+}
+
+func (c *Counter) Inc() {
+	c.add(1)
+}
+
+// Counters only go up - negative deltas are ignored
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.add(delta)
+	}
+}
+
+type CounterVec struct {
+	*vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labelNames, func() *Counter { return &Counter{} })}
+	r.register(name, c)
+	return c
+}
+
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.with(labelValues)
+}
+
+func (c *CounterVec) writeText(w io.Writer) error {
+	if err := c.writeHeader(w); err != nil {
+		return err
+	}
+	for _, ls := range c.sorted() {
+		if err := writeSample(w, c.name, c.labelNames, ls.labelValues, "", "", ls.series.get()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Inc() {
+	g.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.add(-1)
+}
+
+func (g *Gauge) Set(v float64) {
+	g.set(v)
+}
+
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labelNames, func() *Gauge { return &Gauge{} })}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.with(labelValues)
+}
+
+func (g *GaugeVec) writeText(w io.Writer) error {
+	if err := g.writeHeader(w); err != nil {
+		return err
+	}
+	for _, ls := range g.sorted() {
+		if err := writeSample(w, g.name, g.labelNames, ls.labelValues, "", "", ls.series.get()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	// Not cumulative - counts[i] is observations in (buckets[i-1], buckets[i]],
+	// with a final entry for those above the last bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+type HistogramVec struct {
+	*vec[Histogram]
+	buckets []float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	h := &HistogramVec{
+		vec: newVec(name, help, "histogram", labelNames, func() *Histogram {
+			return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+		}),
+		buckets: buckets,
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.with(labelValues)
+}
+
+func (h *HistogramVec) writeText(w io.Writer) error {
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	for _, ls := range h.sorted() {
+		hist := ls.series
+		hist.mu.Lock()
+		counts := slices.Clone(hist.counts)
+		sum, count := hist.sum, hist.count
+		hist.mu.Unlock()
+
+		cumulative := uint64(0)
+		for i, upperBound := range h.buckets {
+			cumulative += counts[i]
+			if err := writeSample(w, h.name+"_bucket", h.labelNames, ls.labelValues, "le", formatFloat(upperBound), float64(cumulative)); err != nil {
+				return err
+			}
+		}
+		if err := writeSample(w, h.name+"_bucket", h.labelNames, ls.labelValues, "le", "+Inf", float64(count)); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_sum", h.labelNames, ls.labelValues, "", "", sum); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_count", h.labelNames, ls.labelValues, "", "", float64(count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes one sample line, with an optional extra label (used for 'le')
+func writeSample(w io.Writer, name string, labelNames, labelValues []string, extraName, extraValue string, v float64) error {
+	var line strings.Builder
+	line.WriteString(name)
+
+	pairs := make([]string, 0, len(labelNames)+1)
+	for i, labelName := range labelNames {
+		pairs = append(pairs, labelName+`="`+escapeLabelValue(labelValues[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) > 0 {
+		line.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	line.WriteString(" " + formatFloat(v) + "\n")
+	_, err := io.WriteString(w, line.String())
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
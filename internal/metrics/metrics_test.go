@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("http_requests_total", "Requests served.", "route", "code")
+	inFlight := registry.NewGaugeVec("http_in_flight_requests", "Requests being served.")
+	latency := registry.NewHistogramVec("http_request_duration_seconds", "Request latency.", []float64{0.1, 1}, "route")
+
+	requests.With("GET /api/chirps", "200").Inc()
+	requests.With("GET /api/chirps", "200").Add(2)
+	requests.With(`weird "route"`, "500").Inc()
+	inFlight.With().Inc()
+	inFlight.With().Inc()
+	inFlight.With().Dec()
+	latency.With("GET /api/chirps").Observe(0.05)
+	latency.With("GET /api/chirps").Observe(0.1)
+	latency.With("GET /api/chirps").Observe(5)
+
+	var out strings.Builder
+	if err := registry.WriteText(&out); err != nil {
+		t.Fatalf("WriteText() should have succeeded, err was: %s", err)
+	}
+
+	want := `# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{route="GET /api/chirps",code="200"} 3
+http_requests_total{route="weird \"route\"",code="500"} 1
+# HELP http_in_flight_requests Requests being served.
+# TYPE http_in_flight_requests gauge
+http_in_flight_requests 1
+# HELP http_request_duration_seconds Request latency.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{route="GET /api/chirps",le="0.1"} 2
+http_request_duration_seconds_bucket{route="GET /api/chirps",le="1"} 2
+http_request_duration_seconds_bucket{route="GET /api/chirps",le="+Inf"} 3
+http_request_duration_seconds_sum{route="GET /api/chirps"} 5.15
+http_request_duration_seconds_count{route="GET /api/chirps"} 3
+`
+	if out.String() != want {
+		t.Errorf("WriteText() output mismatch\ngot:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestCounterIgnoresNegative(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounterVec("things_total", "Things.").With()
+	counter.Add(-5)
+	if counter.get() != 0 {
+		t.Errorf("Counter should ignore negative deltas, value is %v", counter.get())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("things_total", "Things.").With().Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Handler() Content-Type = %s", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "things_total 1\n") {
+		t.Errorf("Handler() body missing sample:\n%s", recorder.Body.String())
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("things_total", "Things.")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering the same name twice should panic")
+		}
+	}()
+	registry.NewGaugeVec("things_total", "Things.")
+}
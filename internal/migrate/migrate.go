@@ -0,0 +1,95 @@
+// Package migrate applies chirpy's embedded goose migrations. Migrating holds
+// a Postgres advisory lock, so replicas starting at the same time take turns
+// rather than racing to apply the same migration.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+	"github.com/venzy/chirpy/sql/schema"
+)
+
+type Migrator struct {
+	provider *goose.Provider
+}
+
+func New(db *sql.DB, logger *slog.Logger) (*Migrator, error) {
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, fmt.Errorf("migrate: couldn't create lock: %w", err)
+	}
+	provider, err := goose.NewProvider(goose.DialectPostgres, db, schema.FS,
+		goose.WithSessionLocker(locker),
+		goose.WithSlog(logger),
+		goose.WithVerbose(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: couldn't load migrations: %w", err)
+	}
+	return &Migrator{provider: provider}, nil
+}
+
+// Applies every pending migration
+func (m *Migrator) Up(ctx context.Context) ([]*goose.MigrationResult, error) {
+	return m.provider.Up(ctx)
+}
+
+// Rolls back the most recently applied migration
+func (m *Migrator) Down(ctx context.Context) (*goose.MigrationResult, error) {
+	return m.provider.Down(ctx)
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]*goose.MigrationStatus, error) {
+	return m.provider.Status(ctx)
+}
+
+// The version the database is at, and the newest embedded migration
+func (m *Migrator) Versions(ctx context.Context) (current, latest int64, err error) {
+	current, err = m.provider.GetDBVersion(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return current, LatestVersion(), nil
+}
+
+// The version of the newest embedded migration, which is the schema version
+// this build of chirpy expects
+func LatestVersion() int64 {
+	versions, err := embeddedVersions()
+	if err != nil || len(versions) == 0 {
+		// Can't happen - the files are embedded at build time, and checked by
+		// the tests
+		panic(fmt.Sprintf("migrate: bad embedded migrations: %v", err))
+	}
+	return versions[len(versions)-1]
+}
+
+// Versions of the embedded migrations, in the order the file names sort in
+func embeddedVersions() ([]int64, error) {
+	names, err := fs.Glob(schema.FS, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []int64{}
+	for _, name := range names {
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration '%s' has no version prefix", name)
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration '%s' has an invalid version: %w", name, err)
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
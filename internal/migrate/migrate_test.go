@@ -0,0 +1,47 @@
+package migrate
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/venzy/chirpy/sql/schema"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	versions, err := embeddedVersions()
+	if err != nil {
+		t.Fatalf("embeddedVersions() error = %v", err)
+	}
+	if len(versions) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	// Numbered from 1 with no gaps or duplicates, so the newest is the count
+	for i, version := range versions {
+		if version != int64(i+1) {
+			t.Errorf("migration %d has version %d, want %d", i, version, i+1)
+		}
+	}
+	if got := LatestVersion(); got != int64(len(versions)) {
+		t.Errorf("LatestVersion() = %d, want %d", got, len(versions))
+	}
+}
+
+func TestEmbeddedMigrationsHaveUpAndDown(t *testing.T) {
+	names, err := fs.Glob(schema.FS, "*.sql")
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+	for _, name := range names {
+		contents, err := fs.ReadFile(schema.FS, name)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+		for _, annotation := range []string{"-- +goose Up", "-- +goose Down"} {
+			if !strings.Contains(string(contents), annotation) {
+				t.Errorf("%s is missing '%s'", name, annotation)
+			}
+		}
+	}
+}
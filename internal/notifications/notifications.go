@@ -0,0 +1,79 @@
+// Package notifications holds the rules for in-app notifications: which types
+// there are, which are grouped together while unread ("5 people liked your
+// chirp"), and how they're described.
+package notifications
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+type Type string
+
+const (
+	Reply   Type = "reply"
+	Mention Type = "mention"
+	Like    Type = "like"
+	Follow  Type = "follow"
+	Rechirp Type = "rechirp"
+	// A direct message. The conversation is the source, so there's one unread
+	// notification per conversation, listing who's written since.
+	Message Type = "message"
+)
+
+// Every type, in the order preferences are listed
+var Types = []Type{Reply, Mention, Like, Follow, Rechirp, Message}
+
+func (t Type) Valid() bool {
+	switch t {
+	case Reply, Mention, Like, Follow, Rechirp, Message:
+		return true
+	}
+	return false
+}
+
+// Whether notifications of this type about the same thing are shown as one
+// while unread. Replies and mentions each have their own content, so aren't.
+func (t Type) Grouped() bool {
+	return t == Like || t == Follow || t == Rechirp
+}
+
+// Identifies the group a notification joins while it's unread. chirpID is
+// the recipient's chirp it's about, if any, and sourceID what caused it, e.g.
+// the reply. Notifications that aren't grouped get a key of their own, so a
+// repeat of the same one is still recognised.
+func GroupKey(t Type, chirpID uuid.NullUUID, sourceID uuid.UUID) string {
+	if !t.Grouped() {
+		return fmt.Sprintf("%s:%s", t, sourceID)
+	}
+	if chirpID.Valid {
+		return fmt.Sprintf("%s:%s", t, chirpID.UUID)
+	}
+	return string(t)
+}
+
+// Describes a notification with the given number of actors, e.g. "5 people
+// liked your chirp"
+func Summary(t Type, actors int) string {
+	who := "Someone"
+	if actors > 1 {
+		who = fmt.Sprintf("%d people", actors)
+	}
+	switch t {
+	case Reply:
+		return who + " replied to your chirp"
+	case Mention:
+		return who + " mentioned you"
+	case Like:
+		return who + " liked your chirp"
+	case Follow:
+		return who + " followed you"
+	case Rechirp:
+		return who + " rechirped your chirp"
+	case Message:
+		return who + " messaged you"
+	default:
+		return who + " did something"
+	}
+}
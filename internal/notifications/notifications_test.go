@@ -0,0 +1,63 @@
+package notifications
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestGroupKey(t *testing.T) {
+	chirpID := uuid.MustParse("3311741c-680c-4546-99f3-fc9efac2036c")
+	sourceID := uuid.MustParse("ada4cd66-b592-4a4b-b564-4e15f95f4d2c")
+	chirp := uuid.NullUUID{UUID: chirpID, Valid: true}
+
+	tests := []struct {
+		name    string
+		t       Type
+		chirpID uuid.NullUUID
+		want    string
+	}{
+		{"likes of a chirp", Like, chirp, "like:" + chirpID.String()},
+		{"rechirps of a chirp", Rechirp, chirp, "rechirp:" + chirpID.String()},
+		{"follows", Follow, uuid.NullUUID{}, "follow"},
+		{"each reply", Reply, chirp, "reply:" + sourceID.String()},
+		{"each mention", Mention, uuid.NullUUID{}, "mention:" + sourceID.String()},
+	}
+	for _, tt := range tests {
+		if got := GroupKey(tt.t, tt.chirpID, sourceID); got != tt.want {
+			t.Errorf("%s: GroupKey() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tests := []struct {
+		t      Type
+		actors int
+		want   string
+	}{
+		{Like, 1, "Someone liked your chirp"},
+		{Like, 5, "5 people liked your chirp"},
+		{Follow, 2, "2 people followed you"},
+		{Reply, 1, "Someone replied to your chirp"},
+		{Mention, 1, "Someone mentioned you"},
+		{Rechirp, 3, "3 people rechirped your chirp"},
+		{Message, 2, "2 people messaged you"},
+	}
+	for _, tt := range tests {
+		if got := Summary(tt.t, tt.actors); got != tt.want {
+			t.Errorf("Summary(%s, %d) = %s, want %s", tt.t, tt.actors, got, tt.want)
+		}
+	}
+}
+
+func TestTypeValid(t *testing.T) {
+	for _, typ := range Types {
+		if !typ.Valid() {
+			t.Errorf("%s should be valid", typ)
+		}
+	}
+	if Type("poke").Valid() {
+		t.Errorf("poke shouldn't be valid")
+	}
+}
@@ -0,0 +1,222 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A just-enough OpenID provider: discovery, JWKS, and a token endpoint that
+// checks PKCE and hands back an ID token with whatever claims the test set.
+type mockProvider struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	keyID         string
+	clientID      string
+	code          string
+	codeChallenge string
+	claims        jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Couldn't generate RSA key: %s", err)
+	}
+
+	mock := &mockProvider{key: key, keyID: "test-key", clientID: "chirpy-test", code: "the-code"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mock.server.URL,
+			"authorization_endpoint": mock.server.URL + "/authorize",
+			"token_endpoint":         mock.server.URL + "/token",
+			"jwks_uri":               mock.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": mock.keyID,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("code") != mock.code || PKCEChallenge(r.PostForm.Get("code_verifier")) != mock.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "opaque",
+			"id_token":     mock.sign(t, mock.claims),
+		})
+	})
+	mock.server = httptest.NewServer(mux)
+	t.Cleanup(mock.server.Close)
+	return mock
+}
+
+func (mock *mockProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = mock.keyID
+	signed, err := token.SignedString(mock.key)
+	if err != nil {
+		t.Fatalf("Couldn't sign ID token: %s", err)
+	}
+	return signed
+}
+
+func (mock *mockProvider) validClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            mock.server.URL,
+		"aud":            mock.clientID,
+		"sub":            "external-user-1",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"email":          "walt@breakingbad.com",
+		"email_verified": true,
+		"nonce":          nonce,
+	}
+}
+
+func (mock *mockProvider) provider() *Provider {
+	return NewProvider(Config{
+		Name:        "mock",
+		Issuer:      mock.server.URL,
+		ClientID:    mock.clientID,
+		RedirectURL: "http://localhost:8080/api/auth/mock/callback",
+	}, mock.server.Client())
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := mock.provider()
+	ctx := context.Background()
+
+	state, _ := GenerateState()
+	nonce, _ := GenerateState()
+	verifier, challenge, err := GeneratePKCE()
+	if err != nil {
+		t.Fatalf("GeneratePKCE() should have succeeded, err was: %s", err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, challenge)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() should have succeeded, err was: %s", err)
+	}
+	parsed, _ := url.Parse(authURL)
+	if !strings.HasSuffix(parsed.Path, "/authorize") ||
+		parsed.Query().Get("state") != state ||
+		parsed.Query().Get("code_challenge") != challenge ||
+		parsed.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("AuthCodeURL() returned unexpected URL: %s", authURL)
+	}
+
+	// Simulate the provider having seen the challenge on the authorize step
+	mock.codeChallenge = parsed.Query().Get("code_challenge")
+	mock.claims = mock.validClaims(nonce)
+
+	claims, err := provider.Exchange(ctx, mock.code, verifier, nonce)
+	if err != nil {
+		t.Fatalf("Exchange() should have succeeded, err was: %s", err)
+	}
+	if claims.Subject != "external-user-1" || claims.Email != "walt@breakingbad.com" || !claims.EmailVerified {
+		t.Errorf("Exchange() returned unexpected claims: %+v", claims)
+	}
+
+	// Wrong verifier means PKCE fails at the provider
+	if _, err := provider.Exchange(ctx, mock.code, "not-the-verifier", nonce); err == nil {
+		t.Errorf("Exchange() should have failed with the wrong code verifier")
+	}
+}
+
+func TestVerifyIDTokenRejections(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := mock.provider()
+	ctx := context.Background()
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name  string
+		token func() string
+	}{
+		{
+			name:  "Wrong nonce",
+			token: func() string { return mock.sign(t, mock.validClaims("other-nonce")) },
+		},
+		{
+			name: "Wrong audience",
+			token: func() string {
+				claims := mock.validClaims("nonce")
+				claims["aud"] = "someone-else"
+				return mock.sign(t, claims)
+			},
+		},
+		{
+			name: "Wrong issuer",
+			token: func() string {
+				claims := mock.validClaims("nonce")
+				claims["iss"] = "https://evil.example.com"
+				return mock.sign(t, claims)
+			},
+		},
+		{
+			name: "Expired",
+			token: func() string {
+				claims := mock.validClaims("nonce")
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return mock.sign(t, claims)
+			},
+		},
+		{
+			name: "Signed by unknown key",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, mock.validClaims("nonce"))
+				token.Header["kid"] = mock.keyID
+				signed, _ := token.SignedString(otherKey)
+				return signed
+			},
+		},
+		{
+			name: "HMAC algorithm",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, mock.validClaims("nonce"))
+				signed, _ := token.SignedString([]byte("secret"))
+				return signed
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := provider.VerifyIDToken(ctx, tt.token(), "nonce"); err == nil {
+				t.Errorf("VerifyIDToken() should have failed")
+			}
+		})
+	}
+
+	// Sanity check that the same setup accepts a good token
+	if _, err := provider.VerifyIDToken(ctx, mock.sign(t, mock.validClaims("nonce")), "nonce"); err != nil {
+		t.Errorf("VerifyIDToken() should have succeeded, err was: %s", err)
+	}
+}
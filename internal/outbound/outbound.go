@@ -0,0 +1,204 @@
+// Package outbound delivers webhooks to integrators' endpoints from a durable
+// queue, retrying failures with exponential backoff and disabling endpoints
+// that keep failing. The queue lives behind a Store, so this can be tested
+// without a database.
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/queue"
+)
+
+const (
+	SignatureHeader = "Chirpy-Signature"
+	EventHeader     = "Chirpy-Event"
+	DeliveryHeader  = "Chirpy-Delivery"
+)
+
+// Defaults for a Dispatcher's settings
+const (
+	DefaultMaxAttempts  = 10
+	DefaultDisableAfter = 25
+	DefaultBatchSize    = 50
+	DefaultConcurrency  = 10
+	DefaultTimeout      = 10 * time.Second
+)
+
+// The wait before retrying after an attempt failed: 30s, then doubling up to
+// 6 hours
+var Backoff = queue.Backoff{Base: 30 * time.Second, Max: 6 * time.Hour}
+
+// A claimed attempt at delivering one event to one endpoint
+type Delivery struct {
+	ID         uuid.UUID
+	EndpointID uuid.UUID
+	URL        string
+	Secret     string
+	EventType  string
+	Payload    []byte
+	// Including this one
+	Attempt int
+}
+
+// The outcome of an attempt, to be recorded by the Store
+type Outcome struct {
+	Succeeded bool
+	// Zero if no response was received
+	StatusCode int
+	Error      string
+	// When to try again, or zero to give up
+	RetryAt time.Time
+}
+
+type Store interface {
+	// Claims up to limit due deliveries, counting an attempt on each. They
+	// mustn't be claimed again before leaseUntil, in case we're still sending.
+	Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]Delivery, error)
+	// Records an attempt's outcome. Failures also count towards disabling the
+	// endpoint after disableAfter in a row, and successes reset that count.
+	// Returns whether the endpoint was disabled by this failure.
+	Finish(ctx context.Context, delivery Delivery, outcome Outcome, disableAfter int) (bool, error)
+}
+
+type Dispatcher struct {
+	store  Store
+	client *http.Client
+	logger *slog.Logger
+	now    func() time.Time
+
+	MaxAttempts  int
+	DisableAfter int
+	BatchSize    int
+	// How many of a batch are sent at once
+	Concurrency int
+}
+
+// client may be nil for NewClient with DefaultTimeout, sending only to public
+// addresses
+func NewDispatcher(store Store, client *http.Client, logger *slog.Logger) *Dispatcher {
+	if client == nil {
+		client = NewClient(DefaultTimeout, false)
+	}
+	return &Dispatcher{
+		store:        store,
+		client:       client,
+		logger:       logger,
+		now:          time.Now,
+		MaxAttempts:  DefaultMaxAttempts,
+		DisableAfter: DefaultDisableAfter,
+		BatchSize:    DefaultBatchSize,
+		Concurrency:  DefaultConcurrency,
+	}
+}
+
+// Sends whatever is due every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	queue.Run(ctx, interval, d.BatchSize, nil, d.RunOnce, func(err error) {
+		d.logger.Error("outbound: Problem delivering webhooks", "error", err)
+	})
+}
+
+// Claims and sends one batch of due deliveries, returning how many it claimed
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, error) {
+	timeout := d.client.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	concurrency := max(d.Concurrency, 1)
+	// Sends go out concurrency at a time, so the whole batch takes at most a
+	// timeout per round. The lease allows one more for recording outcomes, so
+	// nobody else picks any of them up while we're still going.
+	rounds := (d.BatchSize + concurrency - 1) / concurrency
+	deliveries, err := d.store.Claim(ctx, d.BatchSize, d.now().Add(time.Duration(rounds+1)*timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	slots := make(chan struct{}, concurrency)
+	for _, delivery := range deliveries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := d.deliver(ctx, delivery); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return len(deliveries), firstErr
+}
+
+// Attempts one delivery and records the outcome
+func (d *Dispatcher) deliver(ctx context.Context, delivery Delivery) error {
+	outcome := d.attempt(ctx, delivery)
+	disabled, err := d.store.Finish(ctx, delivery, outcome, d.DisableAfter)
+	if err != nil {
+		// It'll be retried once the lease runs out
+		return fmt.Errorf("couldn't record delivery %s: %w", delivery.ID, err)
+	}
+	if disabled {
+		d.logger.Warn("outbound: Disabled endpoint after repeated failures", "endpoint_id", delivery.EndpointID, "url", delivery.URL)
+	}
+	return nil
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, delivery Delivery) Outcome {
+	statusCode, err := d.send(ctx, delivery)
+	if err == nil {
+		return Outcome{Succeeded: true, StatusCode: statusCode}
+	}
+
+	d.logger.Warn("outbound: Delivery failed", "delivery_id", delivery.ID, "attempt", delivery.Attempt, "error", err)
+	outcome := Outcome{StatusCode: statusCode, Error: err.Error()}
+	if delivery.Attempt < d.MaxAttempts {
+		outcome.RetryAt = d.now().Add(Backoff.After(delivery.Attempt))
+	}
+	return outcome
+}
+
+// Posts the signed payload, failing on anything but a 2xx
+func (d *Dispatcher) send(ctx context.Context, delivery Delivery) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, auth.SignWebhook(delivery.Secret, d.now(), delivery.Payload))
+	request.Header.Set(EventHeader, delivery.EventType)
+	request.Header.Set(DeliveryHeader, delivery.ID.String())
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	// Drain a little so the connection can be reused, but don't wait on a
+	// receiver that sends us a lot
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint responded %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
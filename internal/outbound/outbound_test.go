@@ -0,0 +1,360 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/venzy/chirpy/internal/auth"
+	"github.com/venzy/chirpy/internal/queue/queuetest"
+)
+
+// An in-memory queue with the same semantics as the database one
+type memStore struct {
+	queue *queuetest.Queue[Delivery]
+
+	mu       sync.Mutex
+	failures map[uuid.UUID]int
+	disabled map[uuid.UUID]bool
+	finishes []Outcome
+}
+
+func newMemStore(now func() time.Time) *memStore {
+	return &memStore{queue: queuetest.NewQueue[Delivery](now), failures: map[uuid.UUID]int{}, disabled: map[uuid.UUID]bool{}}
+}
+
+func (s *memStore) enqueue(endpointID uuid.UUID, url string) {
+	s.queue.Add(Delivery{
+		ID:         uuid.New(),
+		EndpointID: endpointID,
+		URL:        url,
+		Secret:     "whsec_test",
+		EventType:  "chirp.created",
+		Payload:    []byte(`{"type":"chirp.created"}`),
+	})
+}
+
+func (s *memStore) Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enabled := func(delivery Delivery) bool { return !s.disabled[delivery.EndpointID] }
+	return s.queue.Claim(limit, leaseUntil, enabled, func(delivery *Delivery) { delivery.Attempt++ }), nil
+}
+
+func (s *memStore) Finish(ctx context.Context, delivery Delivery, outcome Outcome, disableAfter int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finishes = append(s.finishes, outcome)
+	s.queue.Update(func(queued Delivery) bool { return queued.ID == delivery.ID }, func(entry *queuetest.Entry[Delivery]) {
+		switch {
+		case outcome.Succeeded:
+			entry.Status = "succeeded"
+		case outcome.RetryAt.IsZero():
+			entry.Status = "failed"
+		default:
+			entry.DueAt = outcome.RetryAt
+		}
+	})
+
+	if outcome.Succeeded {
+		s.failures[delivery.EndpointID] = 0
+		return false, nil
+	}
+	s.failures[delivery.EndpointID]++
+	if !s.disabled[delivery.EndpointID] && s.failures[delivery.EndpointID] >= disableAfter {
+		s.disabled[delivery.EndpointID] = true
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *memStore) status(i int) string {
+	return s.queue.Entry(i).Status
+}
+
+func newTestDispatcher(store Store, clock *queuetest.Clock) *Dispatcher {
+	// Test receivers listen on loopback
+	dispatcher := NewDispatcher(store, NewClient(DefaultTimeout, true), queuetest.Logger())
+	dispatcher.now = clock.Now
+	return dispatcher
+}
+
+func TestDeliverySigned(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	var received http.Header
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	store := newMemStore(clock.Now)
+	store.enqueue(uuid.New(), receiver.URL)
+	dispatcher := newTestDispatcher(store, clock)
+
+	if sent, err := dispatcher.RunOnce(context.Background()); err != nil || sent != 1 {
+		t.Fatalf("RunOnce() = %d, %v, want 1 delivery", sent, err)
+	}
+	if store.status(0) != "succeeded" {
+		t.Errorf("status = %s, want succeeded", store.status(0))
+	}
+
+	// The receiver can check it came from us, using the helper Polka's
+	// webhooks are checked with
+	err := auth.ValidateWebhookSignature(received.Get(SignatureHeader), body, []string{"whsec_test"}, 5*time.Minute, clock.Now())
+	if err != nil {
+		t.Errorf("signature didn't validate: %s", err)
+	}
+	if received.Get(EventHeader) != "chirp.created" || received.Get(DeliveryHeader) == "" {
+		t.Errorf("missing event headers: %v", received)
+	}
+}
+
+func TestDeliveryRetriesWithBackoff(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	var mu sync.Mutex
+	failuresLeft := 2
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failuresLeft > 0 {
+			failuresLeft--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	store := newMemStore(clock.Now)
+	store.enqueue(uuid.New(), receiver.URL)
+	dispatcher := newTestDispatcher(store, clock)
+
+	steps := []struct {
+		advance  time.Duration
+		wantSent int
+	}{
+		{0, 1},                // fails, retry in 30s
+		{10 * time.Second, 0}, // not due yet
+		{20 * time.Second, 1}, // fails, retry in a minute
+		{59 * time.Second, 0}, // not due yet
+		{time.Second, 1},      // succeeds
+		{time.Hour, 0},        // nothing left
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		sent, err := dispatcher.RunOnce(context.Background())
+		if err != nil || sent != step.wantSent {
+			t.Fatalf("step %d: RunOnce() = %d, %v, want %d", i, sent, err, step.wantSent)
+		}
+	}
+	if store.status(0) != "succeeded" {
+		t.Errorf("status = %s, want succeeded", store.status(0))
+	}
+	if got := store.finishes[0].StatusCode; got != http.StatusServiceUnavailable {
+		t.Errorf("first attempt status = %d, want 503", got)
+	}
+}
+
+func TestDeliveryGivesUpAndDisables(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	endpointID := uuid.New()
+	store := newMemStore(clock.Now)
+	store.enqueue(endpointID, receiver.URL)
+	store.enqueue(endpointID, receiver.URL)
+	dispatcher := newTestDispatcher(store, clock)
+	dispatcher.MaxAttempts = 2
+	dispatcher.DisableAfter = 3
+	// One at a time, so the order is clear
+	dispatcher.BatchSize = 1
+
+	// Two failed attempts each would be four, but the third disables the
+	// endpoint, so the last is never made
+	for range 4 {
+		if _, err := dispatcher.RunOnce(context.Background()); err != nil {
+			t.Fatalf("RunOnce() error = %v", err)
+		}
+		clock.Advance(Backoff.Max)
+	}
+
+	if len(store.finishes) != 3 {
+		t.Errorf("made %d attempts, want 3", len(store.finishes))
+	}
+	if store.status(0) != "failed" {
+		t.Errorf("first delivery status = %s, want failed after max attempts", store.status(0))
+	}
+	if store.status(1) != "pending" {
+		t.Errorf("second delivery status = %s, want pending until the endpoint is enabled", store.status(1))
+	}
+	if !store.disabled[endpointID] {
+		t.Errorf("endpoint should have been disabled")
+	}
+}
+
+func TestDeliveryUnreachable(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	url := receiver.URL
+	receiver.Close()
+
+	store := newMemStore(clock.Now)
+	store.enqueue(uuid.New(), url)
+	if _, err := newTestDispatcher(store, clock).RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+	outcome := store.finishes[0]
+	if outcome.Succeeded || outcome.StatusCode != 0 || outcome.Error == "" || outcome.RetryAt.IsZero() {
+		t.Errorf("outcome = %+v, want a retry with no status code", outcome)
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := PublicAddress(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("PublicAddress(%s) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	if err := CheckHost(context.Background(), "127.0.0.1"); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("CheckHost(127.0.0.1) error = %v, want ErrPrivateAddress", err)
+	}
+	if err := CheckHost(context.Background(), "93.184.216.34"); err != nil {
+		t.Errorf("CheckHost(93.184.216.34) error = %v, want nil", err)
+	}
+}
+
+func TestDeliveryRefusesPrivateAddresses(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	store := newMemStore(clock.Now)
+	store.enqueue(uuid.New(), receiver.URL)
+	dispatcher := newTestDispatcher(store, clock)
+	dispatcher.client = NewClient(DefaultTimeout, false)
+
+	if sent, err := dispatcher.RunOnce(context.Background()); err != nil || sent != 1 {
+		t.Fatalf("RunOnce() = %d, %v, want 1 delivery", sent, err)
+	}
+	if called || store.status(0) != "pending" {
+		t.Errorf("delivery to loopback = %s (received %t), want refused and pending a retry", store.status(0), called)
+	}
+	if !strings.Contains(store.finishes[0].Error, ErrPrivateAddress.Error()) {
+		t.Errorf("outcome error = %q, want it to mention %q", store.finishes[0].Error, ErrPrivateAddress)
+	}
+}
+
+func TestDeliveryDoesntFollowRedirects(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	receiver := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer receiver.Close()
+
+	store := newMemStore(clock.Now)
+	store.enqueue(uuid.New(), receiver.URL)
+	dispatcher := newTestDispatcher(store, clock)
+
+	if sent, err := dispatcher.RunOnce(context.Background()); err != nil || sent != 1 {
+		t.Fatalf("RunOnce() = %d, %v, want 1 delivery", sent, err)
+	}
+	if redirected || store.status(0) != "pending" {
+		t.Errorf("redirected delivery = %s (followed %t), want failed and pending a retry", store.status(0), redirected)
+	}
+}
+
+// Records the lease each claim was given
+type leaseStore struct {
+	*memStore
+	leases []time.Time
+}
+
+func (s *leaseStore) Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]Delivery, error) {
+	s.leases = append(s.leases, leaseUntil)
+	return s.memStore.Claim(ctx, limit, leaseUntil)
+}
+
+func TestBatchSentConcurrentlyWithinLease(t *testing.T) {
+	clock := queuetest.NewClock(time.Now())
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	store := &leaseStore{memStore: newMemStore(clock.Now)}
+	for i := 0; i < 6; i++ {
+		store.enqueue(uuid.New(), receiver.URL)
+	}
+	dispatcher := newTestDispatcher(store, clock)
+	dispatcher.BatchSize = 6
+	dispatcher.Concurrency = 3
+
+	if sent, err := dispatcher.RunOnce(context.Background()); err != nil || sent != 6 {
+		t.Fatalf("RunOnce() = %d, %v, want 6 deliveries", sent, err)
+	}
+	for i := 0; i < 6; i++ {
+		if store.status(i) != "succeeded" {
+			t.Errorf("delivery %d status = %s, want succeeded", i, store.status(i))
+		}
+	}
+	if maxInFlight != 3 {
+		t.Errorf("max in flight = %d, want 3", maxInFlight)
+	}
+	// Two rounds of sends, plus time to record them
+	if want := clock.Now().Add(3 * DefaultTimeout); !store.leases[0].Equal(want) {
+		t.Errorf("lease = %s, want %s", store.leases[0], want)
+	}
+}
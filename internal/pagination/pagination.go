@@ -0,0 +1,47 @@
+// Package pagination holds the cursors used to page through lists ordered
+// newest first by a timestamp, with the ID breaking ties.
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Where a page ends: the timestamp and ID of its last item. Opaque to
+// clients.
+type Cursor struct {
+	Time time.Time
+	ID   uuid.UUID
+}
+
+func (c Cursor) String() string {
+	raw := fmt.Sprintf("%d_%s", c.Time.UnixMicro(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	micros, id, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+	var t int64
+	if _, err := fmt.Sscanf(micros, "%d", &t); err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	parsedID, err := uuid.Parse(id)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{Time: time.UnixMicro(t).UTC(), ID: parsedID}, nil
+}
@@ -0,0 +1,26 @@
+package pagination
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCursor(t *testing.T) {
+	cursor := Cursor{Time: time.Date(2025, 4, 15, 13, 25, 37, 123456000, time.UTC), ID: uuid.New()}
+	parsed, err := ParseCursor(cursor.String())
+	if err != nil {
+		t.Fatalf("ParseCursor() error = %v", err)
+	}
+	if !parsed.Time.Equal(cursor.Time) || parsed.ID != cursor.ID {
+		t.Errorf("ParseCursor() = %+v, want %+v", parsed, cursor)
+	}
+
+	for _, bad := range []string{"", "!!!", "bm9wZQ", "MTIzX25vdC1hLXV1aWQ"} {
+		if _, err := ParseCursor(bad); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ParseCursor(%q) error = %v, want %v", bad, err, ErrInvalidCursor)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Package queue holds what chirpy's durable background queues have in common:
+// a loop claiming leased batches from a store while there's a backlog, and
+// exponential backoff between retries.
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// Exponential backoff: Base after the first failed attempt, doubling with each
+// attempt after that, up to Max
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// The wait before retrying after the given attempt failed
+func (b Backoff) After(attempt int) time.Duration {
+	backoff := b.Base
+	for i := 1; i < attempt && backoff < b.Max; i++ {
+		backoff *= 2
+	}
+	return min(backoff, b.Max)
+}
+
+// Calls runOnce every interval, or sooner when wake receives, until ctx is
+// done. wake may be nil. runOnce claims and handles one batch, returning how
+// many it claimed, and is called again straight away while batches come back
+// full, to work through a backlog. Its errors go to onError unless ctx is done.
+func Run(ctx context.Context, interval time.Duration, batchSize int, wake <-chan struct{}, runOnce func(context.Context) (int, error), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Keep going while there's a backlog
+		for {
+			claimed, err := runOnce(ctx)
+			if err != nil && ctx.Err() == nil {
+				onError(err)
+			}
+			if err != nil || claimed < batchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		backoff Backoff
+		attempt int
+		want    time.Duration
+	}{
+		{Backoff{time.Second, 5 * time.Minute}, 1, time.Second},
+		{Backoff{time.Second, 5 * time.Minute}, 2, 2 * time.Second},
+		{Backoff{time.Second, 5 * time.Minute}, 9, 256 * time.Second},
+		{Backoff{time.Second, 5 * time.Minute}, 10, 5 * time.Minute},
+		{Backoff{30 * time.Second, 6 * time.Hour}, 5, 8 * time.Minute},
+		{Backoff{30 * time.Second, 6 * time.Hour}, 11, 6 * time.Hour},
+		{Backoff{30 * time.Second, 6 * time.Hour}, 100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := tt.backoff.After(tt.attempt); got != tt.want {
+			t.Errorf("%+v.After(%d) = %s, want %s", tt.backoff, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	steps := []struct {
+		claimed int
+		err     error
+	}{
+		// A backlog of two full batches and a short one
+		{10, nil}, {10, nil}, {3, nil},
+		// Then, when woken, a failure
+		{10, errors.New("boom")},
+		// Then, woken again, nothing left
+		{0, nil},
+	}
+	calls := 0
+	runOnce := func(ctx context.Context) (int, error) {
+		step := steps[calls]
+		calls++
+		if calls == len(steps) {
+			cancel()
+		}
+		return step.claimed, step.err
+	}
+	errs := make(chan error, len(steps))
+
+	// The interval is long enough that only wake explains further calls
+	wake := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		Run(ctx, time.Hour, 10, wake, runOnce, func(err error) { errs <- err })
+		close(done)
+	}()
+
+	wake <- struct{}{}
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("onError() wasn't called")
+	}
+	wake <- struct{}{}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run() didn't return after ctx was done")
+	}
+	if calls != len(steps) {
+		t.Errorf("runOnce() called %d times, want %d", calls, len(steps))
+	}
+}
@@ -0,0 +1,125 @@
+// Package queuetest provides fakes for testing code built on package queue:
+// a clock tests move by hand, and an in-memory queue with the same leasing
+// semantics as the database ones.
+package queuetest
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type Clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func NewClock(t time.Time) *Clock {
+	return &Clock{t: t}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// A logger that throws everything away
+func Logger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+const Pending = "pending"
+
+type Entry[T any] struct {
+	Value T
+	// Pending until a test's store says otherwise
+	Status string
+	// When it's next due to be claimed
+	DueAt time.Time
+	// Why the last attempt failed
+	Reason string
+}
+
+// Entries in the order they were added, each claimable once pending and due
+type Queue[T any] struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	entries []*Entry[T]
+}
+
+func NewQueue[T any](now func() time.Time) *Queue[T] {
+	return &Queue[T]{now: now}
+}
+
+// Adds value, due now
+func (q *Queue[T]) Add(value T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = append(q.entries, &Entry[T]{Value: value, Status: Pending, DueAt: q.now()})
+}
+
+// Claims up to limit pending, due entries that ready accepts (nil for all),
+// oldest first. Each is passed to claim, e.g. to count an attempt, then pushed
+// back to leaseUntil.
+func (q *Queue[T]) Claim(limit int, leaseUntil time.Time, ready func(T) bool, claim func(*T)) []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var claimed []T
+	for _, entry := range q.entries {
+		if len(claimed) == limit {
+			break
+		}
+		if entry.Status != Pending || entry.DueAt.After(q.now()) || (ready != nil && !ready(entry.Value)) {
+			continue
+		}
+		claim(&entry.Value)
+		entry.DueAt = leaseUntil
+		claimed = append(claimed, entry.Value)
+	}
+	return claimed
+}
+
+// Calls update on each entry match accepts
+func (q *Queue[T]) Update(match func(T) bool, update func(*Entry[T])) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.entries {
+		if match(entry.Value) {
+			update(entry)
+		}
+	}
+}
+
+// Removes the entries match accepts
+func (q *Queue[T]) Remove(match func(T) bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := q.entries[:0]
+	for _, entry := range q.entries {
+		if !match(entry.Value) {
+			kept = append(kept, entry)
+		}
+	}
+	q.entries = kept
+}
+
+// A copy of the i'th entry
+func (q *Queue[T]) Entry(i int) Entry[T] {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.entries[i]
+}
+
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
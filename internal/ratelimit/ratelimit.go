@@ -0,0 +1,110 @@
+// Package ratelimit implements token bucket rate limiting behind a Store
+// interface, so the in-memory store used by a single server can later be
+// swapped for one shared between replicas.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// A budget of Burst requests, refilled at Burst per Period. E.g. Burst 30 and
+// Period of a minute allows bursts of up to 30 requests, and a sustained rate
+// of one every two seconds.
+type Limit struct {
+	Burst  int
+	Period time.Duration
+}
+
+func (l Limit) ratePerSecond() float64 {
+	return float64(l.Burst) / l.Period.Seconds()
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Time until the bucket is completely refilled
+	ResetAfter time.Duration
+	// Time until the next request would be allowed, if this one wasn't
+	RetryAfter time.Duration
+}
+
+type Store interface {
+	// Takes one token from the bucket identified by key, if there is one
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// Of the limit it was last taken from, for sweeping
+	period time.Duration
+}
+
+// Store for a single server. Buckets that have refilled completely are
+// dropped periodically, since they are indistinguishable from new ones.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+const sweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > sweepInterval {
+		s.sweep(now)
+		s.lastSweep = now
+	}
+
+	capacity := float64(limit.Burst)
+	rate := limit.ratePerSecond()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+
+	// Refill for the time since we last looked
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*rate)
+		b.updated = now
+	}
+	b.period = limit.Period
+
+	result := Result{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.ResetAfter = secondsToDuration((capacity - b.tokens) / rate)
+	return result, nil
+}
+
+// Drops buckets that have been idle for their whole period, which refills
+// them completely at their own limit's rate.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.updated) > b.period {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreBurstThenRefill(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Burst: 3, Period: 3 * time.Second}
+	now := time.Date(2025, 4, 15, 12, 0, 0, 0, time.UTC)
+
+	// The full burst is available straight away
+	for i := 0; i < 3; i++ {
+		result, _ := store.Take(ctx, "ip:1.2.3.4", limit, now)
+		if !result.Allowed {
+			t.Fatalf("Take() #%d should have been allowed", i+1)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("Take() #%d Remaining = %d, want %d", i+1, result.Remaining, 2-i)
+		}
+	}
+
+	result, _ := store.Take(ctx, "ip:1.2.3.4", limit, now)
+	if result.Allowed {
+		t.Fatalf("Take() beyond burst should have been refused")
+	}
+	if result.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %s, want 1s", result.RetryAfter)
+	}
+	if result.ResetAfter != 3*time.Second {
+		t.Errorf("ResetAfter = %s, want 3s", result.ResetAfter)
+	}
+
+	// Other keys have their own bucket
+	if result, _ := store.Take(ctx, "ip:5.6.7.8", limit, now); !result.Allowed {
+		t.Errorf("Take() for another key should have been allowed")
+	}
+
+	// One token refills per second
+	result, _ = store.Take(ctx, "ip:1.2.3.4", limit, now.Add(time.Second))
+	if !result.Allowed {
+		t.Errorf("Take() after refill should have been allowed")
+	}
+	result, _ = store.Take(ctx, "ip:1.2.3.4", limit, now.Add(time.Second))
+	if result.Allowed {
+		t.Errorf("Take() should have been refused again after using the refilled token")
+	}
+
+	// Never refills beyond the burst
+	result, _ = store.Take(ctx, "ip:1.2.3.4", limit, now.Add(time.Hour))
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("Take() after a long idle = %+v, want allowed with 2 remaining", result)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Burst: 1, Period: time.Second}
+	now := time.Date(2025, 4, 15, 12, 0, 0, 0, time.UTC)
+
+	store.Take(ctx, "a", limit, now)
+	store.Take(ctx, "b", limit, now.Add(2*sweepInterval))
+	if _, ok := store.buckets["a"]; ok {
+		t.Errorf("idle bucket should have been swept")
+	}
+	if _, ok := store.buckets["b"]; !ok {
+		t.Errorf("active bucket should have been kept")
+	}
+}
+
+func TestMemoryStoreSweepUsesEachBucketsPeriod(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	hourly := Limit{Burst: 1, Period: time.Hour}
+	perSecond := Limit{Burst: 1, Period: time.Second}
+	now := time.Date(2025, 4, 15, 12, 0, 0, 0, time.UTC)
+
+	store.Take(ctx, "hourly", hourly, now)
+	// Sweeps while taking from a bucket with a much shorter period
+	store.Take(ctx, "other", perSecond, now.Add(2*sweepInterval))
+	if _, ok := store.buckets["hourly"]; !ok {
+		t.Fatalf("bucket still refilling at its own rate shouldn't have been swept")
+	}
+	if result, _ := store.Take(ctx, "hourly", hourly, now.Add(2*sweepInterval)); result.Allowed {
+		t.Errorf("Take() = %+v, want the hourly bucket still empty", result)
+	}
+}
@@ -0,0 +1,112 @@
+// Package server runs chirpy's HTTP server with timeouts suitable for
+// production, and shuts it down gracefully, letting in-flight requests finish.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Addr string
+	// Limits how long a client can take to send its headers, which is what
+	// slowloris style attacks exploit
+	ReadHeaderTimeout time.Duration
+	// Limits reading the whole request, including the body
+	ReadTimeout time.Duration
+	// Limits the time from the end of the request headers to the end of the
+	// response. Streaming handlers need to extend it via http.ResponseController.
+	WriteTimeout time.Duration
+	// How long an idle keep-alive connection stays open
+	IdleTimeout time.Duration
+	// How long to keep serving after shutdown starts, so load balancers see
+	// readiness fail and stop sending new requests before connections close
+	DrainDelay time.Duration
+	// How long shutdown waits for in-flight requests before giving up on them
+	ShutdownTimeout time.Duration
+}
+
+type Server struct {
+	config     Config
+	httpServer *http.Server
+
+	mu      sync.Mutex
+	onDrain []func()
+}
+
+func New(config Config, handler http.Handler) *Server {
+	return &Server{
+		config: config,
+		httpServer: &http.Server{
+			Addr:              config.Addr,
+			Handler:           handler,
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+			ReadTimeout:       config.ReadTimeout,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       config.IdleTimeout,
+		},
+	}
+}
+
+// Registers f to be called as soon as shutdown starts, before the drain delay,
+// e.g. to start failing readiness checks.
+func (s *Server) RegisterOnDrain(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onDrain = append(s.onDrain, f)
+}
+
+// Listens on the configured address and serves until ctx is done. See Serve.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serves on listener until ctx is done, then keeps serving for DrainDelay
+// before it stops accepting connections and waits up to ShutdownTimeout for
+// in-flight requests to finish. Returns nil after a clean shutdown, or an error
+// if the server failed or requests were still running at the deadline (in
+// which case their connections are closed).
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	onDrain := s.onDrain
+	s.mu.Unlock()
+	for _, f := range onDrain {
+		f()
+	}
+	select {
+	case err := <-serveErr:
+		return err
+	case <-time.After(s.config.DrainDelay):
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
+		s.httpServer.Close()
+		return fmt.Errorf("couldn't drain in-flight requests: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/venzy/chirpy/internal/config"
+)
+
+// The server settings chirpy runs with by default
+func defaultConfig() Config {
+	defaults := config.Default().Server
+	return Config{
+		Addr:              defaults.Addr,
+		ReadHeaderTimeout: defaults.ReadHeaderTimeout,
+		ReadTimeout:       defaults.ReadTimeout,
+		WriteTimeout:      defaults.WriteTimeout,
+		IdleTimeout:       defaults.IdleTimeout,
+		DrainDelay:        defaults.DrainDelay,
+		ShutdownTimeout:   defaults.ShutdownTimeout,
+	}
+}
+
+// Starts a server on a random local port, returning its URL and a channel
+// that receives Serve's result
+func startTestServer(t *testing.T, ctx context.Context, config Config, handler http.Handler) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- New(config, handler).Serve(ctx, listener)
+	}()
+	return "http://" + listener.Addr().String(), done
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+
+	config := defaultConfig()
+	config.DrainDelay = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	url, serveDone := startTestServer(t, ctx, config, handler)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		results <- result{body: string(body), err: err}
+	}()
+
+	// Shut down while the request is being handled
+	<-started
+	cancel()
+
+	got := <-results
+	if got.err != nil || got.body != "done" {
+		t.Errorf("in-flight request = %q, %v, want \"done\"", got.body, got.err)
+	}
+	if err := <-serveDone; err != nil {
+		t.Errorf("Serve() error = %v, want nil", err)
+	}
+
+	// No longer accepting connections
+	if response, err := http.Get(url); err == nil {
+		response.Body.Close()
+		t.Error("request after shutdown succeeded, want error")
+	}
+}
+
+func TestShutdownGivesUpAtDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	config := defaultConfig()
+	config.DrainDelay = 0
+	config.ShutdownTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	url, serveDone := startTestServer(t, ctx, config, handler)
+
+	go func() {
+		if response, err := http.Get(url); err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-serveDone:
+		if err == nil {
+			t.Error("Serve() error = nil, want deadline error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() didn't return after the shutdown deadline")
+	}
+}
+
+func TestDrainKeepsServingUntilDelay(t *testing.T) {
+	config := defaultConfig()
+	config.DrainDelay = 300 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	url := "http://" + listener.Addr().String()
+
+	srv := New(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	drained := make(chan struct{})
+	srv.RegisterOnDrain(func() { close(drained) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- srv.Serve(ctx, listener)
+	}()
+	cancel()
+
+	// Drain hooks run straight away, but new requests are still served
+	<-drained
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request during drain delay failed: %v", err)
+	}
+	response.Body.Close()
+
+	if err := <-serveDone; err != nil {
+		t.Errorf("Serve() error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,200 @@
+// Package stream fans messages out to clients with long-lived connections,
+// over Server-Sent Events or WebSockets. Each subscriber gets a bounded
+// buffer; one that falls too far behind is dropped rather than slowing the
+// others or growing without limit, and can reconnect to catch up from
+// wherever its messages came from.
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var (
+	// The subscriber's buffer filled up because it wasn't keeping up
+	ErrSlowConsumer = errors.New("subscriber fell behind")
+	// The hub was closed, e.g. because the server is shutting down
+	ErrClosed = errors.New("stream closed")
+)
+
+type Message struct {
+	// Sent as the event ID, for clients to resume from
+	ID    string
+	Event string
+	Data  []byte
+	// What subscribers can filter on, e.g. the author
+	Topic string
+}
+
+// Fans out published messages to subscribers
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]bool
+	closed      chan struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: map[*Subscription]bool{}, closed: make(chan struct{})}
+}
+
+type Subscription struct {
+	hub      *Hub
+	topic    string
+	messages chan Message
+	done     chan struct{}
+	// Why it ended, set before done is closed
+	err error
+}
+
+// Subscribes to messages on topic, or every message if topic is empty,
+// buffering up to buffer of them while the subscriber is busy
+func (h *Hub) Subscribe(topic string, buffer int) *Subscription {
+	sub := &Subscription{
+		hub:      h,
+		topic:    topic,
+		messages: make(chan Message, buffer),
+		done:     make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.isClosed() {
+		sub.end(ErrClosed)
+		return sub
+	}
+	h.subscribers[sub] = true
+	return sub
+}
+
+// Sends msg to every interested subscriber without waiting on any of them.
+// Subscribers whose buffer is full are dropped. Returns how many it was sent
+// to.
+func (h *Hub) Publish(msg Message) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sent := 0
+	for sub := range h.subscribers {
+		if sub.topic != "" && sub.topic != msg.Topic {
+			continue
+		}
+		select {
+		case sub.messages <- msg:
+			sent++
+		default:
+			delete(h.subscribers, sub)
+			sub.end(ErrSlowConsumer)
+		}
+	}
+	return sent
+}
+
+// Ends every subscription, and any made later. Safe to call more than once.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.isClosed() {
+		return
+	}
+	close(h.closed)
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		sub.end(ErrClosed)
+	}
+}
+
+// Closed once the hub is, for connections that should end then even without
+// any subscriptions
+func (h *Hub) Closed() <-chan struct{} {
+	return h.closed
+}
+
+// Must be called with the lock held
+func (h *Hub) isClosed() bool {
+	select {
+	case <-h.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// The number of current subscribers
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// Must be called with the hub's lock held
+func (s *Subscription) end(err error) {
+	s.err = err
+	close(s.done)
+}
+
+// Messages published since subscribing, in order
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Closed when the hub stops sending to this subscription. Messages already
+// buffered can still be read, but there may be a gap after them.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Why the subscription ended, once Done is closed
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Unsubscribes. Safe to call more than once, or after it has ended.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.hub.subscribers[s] {
+		delete(s.hub.subscribers, s)
+		s.end(nil)
+	}
+}
+
+// Writes msg in the text/event-stream format. Data containing newlines is
+// split over several data lines, which the client joins back up.
+func WriteMessage(w io.Writer, msg Message) error {
+	var b strings.Builder
+	if msg.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", singleLine(msg.ID))
+	}
+	if msg.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", singleLine(msg.Event))
+	}
+	for line := range strings.SplitSeq(string(msg.Data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", strings.TrimSuffix(line, "\r"))
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Writes a comment, which clients ignore, e.g. to keep an idle connection
+// from being closed by proxies
+func WriteComment(w io.Writer, comment string) error {
+	_, err := fmt.Fprintf(w, ": %s\n\n", singleLine(comment))
+	return err
+}
+
+// Tells the client how long to wait before reconnecting if the stream ends
+func WriteRetry(w io.Writer, millis int) error {
+	_, err := fmt.Fprintf(w, "retry: %d\n\n", millis)
+	return err
+}
+
+// A newline in an ID, event or comment would end the field early, letting it
+// inject others
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriteMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{
+			"full",
+			Message{ID: "1", Event: "chirp", Data: []byte(`{"body":"hi"}`)},
+			"id: 1\nevent: chirp\ndata: {\"body\":\"hi\"}\n\n",
+		},
+		{
+			"data only",
+			Message{Data: []byte("hi")},
+			"data: hi\n\n",
+		},
+		{
+			"multi-line data",
+			Message{Data: []byte("one\r\ntwo\nthree")},
+			"data: one\ndata: two\ndata: three\n\n",
+		},
+		{
+			"newline in ID",
+			Message{ID: "1\nevent: evil", Data: []byte("hi")},
+			"id: 1 event: evil\ndata: hi\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := WriteMessage(&b, tt.msg); err != nil {
+			t.Fatalf("%s: WriteMessage() error = %v", tt.name, err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s: WriteMessage() wrote %q, want %q", tt.name, b.String(), tt.want)
+		}
+	}
+}
+
+func TestHubTopics(t *testing.T) {
+	hub := NewHub()
+	all := hub.Subscribe("", 10)
+	alice := hub.Subscribe("alice", 10)
+	defer all.Close()
+	defer alice.Close()
+
+	hub.Publish(Message{ID: "1", Topic: "alice"})
+	hub.Publish(Message{ID: "2", Topic: "bob"})
+
+	if got := len(all.Messages()); got != 2 {
+		t.Errorf("unfiltered subscriber got %d messages, want 2", got)
+	}
+	if got := len(alice.Messages()); got != 1 {
+		t.Errorf("alice's subscriber got %d messages, want 1", got)
+	}
+	if msg := <-alice.Messages(); msg.ID != "1" {
+		t.Errorf("alice's subscriber got message %s, want 1", msg.ID)
+	}
+}
+
+func TestHubDropsSlowConsumers(t *testing.T) {
+	hub := NewHub()
+	slow := hub.Subscribe("", 2)
+	fast := hub.Subscribe("", 2)
+
+	for _, id := range []string{"1", "2", "3"} {
+		hub.Publish(Message{ID: id})
+		// Keeps up
+		<-fast.Messages()
+	}
+
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatalf("slow subscriber should have been dropped")
+	}
+	if !errors.Is(slow.Err(), ErrSlowConsumer) {
+		t.Errorf("Err() = %v, want %v", slow.Err(), ErrSlowConsumer)
+	}
+	// What it had buffered is still there, for sending before disconnecting
+	if got := len(slow.Messages()); got != 2 {
+		t.Errorf("slow subscriber has %d buffered messages, want 2", got)
+	}
+
+	select {
+	case <-fast.Done():
+		t.Errorf("fast subscriber shouldn't have been dropped")
+	default:
+	}
+	if hub.Len() != 1 {
+		t.Errorf("hub has %d subscribers, want 1", hub.Len())
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub()
+	before := hub.Subscribe("", 1)
+	hub.Close()
+	hub.Close()
+	after := hub.Subscribe("", 1)
+
+	select {
+	case <-hub.Closed():
+	default:
+		t.Errorf("Closed() should be closed")
+	}
+
+	for name, sub := range map[string]*Subscription{"before": before, "after": after} {
+		select {
+		case <-sub.Done():
+		default:
+			t.Fatalf("subscription made %s closing should have ended", name)
+		}
+		if !errors.Is(sub.Err(), ErrClosed) {
+			t.Errorf("%s: Err() = %v, want %v", name, sub.Err(), ErrClosed)
+		}
+	}
+
+	// Harmless once ended
+	before.Close()
+	if n := hub.Publish(Message{ID: "1"}); n != 0 {
+		t.Errorf("Publish() after Close() sent to %d subscribers, want 0", n)
+	}
+}
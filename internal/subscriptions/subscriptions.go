@@ -0,0 +1,83 @@
+// Package subscriptions decides how a Chirpy Red subscription changes as
+// payment events arrive. Providers retry and don't promise ordering, so an
+// event older than the one behind the current state is ignored rather than
+// undoing it.
+package subscriptions
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	Active   = "active"
+	PastDue  = "past_due"
+	Canceled = "canceled"
+	Refunded = "refunded"
+	Expired  = "expired"
+)
+
+// A subscription as stored
+type State struct {
+	Status      string
+	PeriodStart time.Time
+	// Not valid for subscriptions granted without a billing period
+	PeriodEnd sql.NullTime
+	// When Red lapses if nothing else happens, not valid for never
+	ExpiresAt sql.NullTime
+	// When the event behind the current state happened
+	LastEventAt time.Time
+}
+
+// Whether an event that happened at is older than the one current came from
+func stale(current *State, at time.Time) bool {
+	return current != nil && at.Before(current.LastEventAt)
+}
+
+// Starts or renews a paid period, happening at. Red lasts until the period's
+// end plus grace, in case the next payment is late. current is nil if the user
+// has no subscription yet. Returns false, leaving the subscription alone, for
+// out of date events or periods that started before the current one.
+func Renew(current *State, at, periodStart, periodEnd time.Time, grace time.Duration) (State, bool) {
+	if stale(current, at) || (current != nil && periodStart.Before(current.PeriodStart)) {
+		return State{}, false
+	}
+	return State{
+		Status:      Active,
+		PeriodStart: periodStart,
+		PeriodEnd:   sql.NullTime{Time: periodEnd, Valid: true},
+		ExpiresAt:   sql.NullTime{Time: periodEnd.Add(grace), Valid: true},
+		LastEventAt: at,
+	}, true
+}
+
+// A payment failed at. Only an active subscription becomes past due, and Red
+// lasts through grace after the current period ends, or after now if that's
+// later.
+func MarkPastDue(current *State, at, now time.Time, grace time.Duration) (State, bool) {
+	if current == nil || stale(current, at) || current.Status != Active {
+		return State{}, false
+	}
+	lapsesAt := now
+	if current.PeriodEnd.Valid && current.PeriodEnd.Time.After(lapsesAt) {
+		lapsesAt = current.PeriodEnd.Time
+	}
+	next := *current
+	next.Status = PastDue
+	next.ExpiresAt = sql.NullTime{Time: lapsesAt.Add(grace), Valid: true}
+	next.LastEventAt = at
+	return next, true
+}
+
+// Ends Red as of now, with status (Canceled or Refunded) saying why, for an
+// event that happened at.
+func End(current *State, status string, at, now time.Time) (State, bool) {
+	if current == nil || stale(current, at) {
+		return State{}, false
+	}
+	next := *current
+	next.Status = status
+	next.ExpiresAt = sql.NullTime{Time: now, Valid: true}
+	next.LastEventAt = at
+	return next, true
+}
@@ -0,0 +1,166 @@
+package subscriptions
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+const grace = 3 * 24 * time.Hour
+
+var (
+	jan1 = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb1 = time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar1 = time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func active(periodStart, periodEnd, lastEventAt time.Time) *State {
+	return &State{
+		Status:      Active,
+		PeriodStart: periodStart,
+		PeriodEnd:   sql.NullTime{Time: periodEnd, Valid: true},
+		ExpiresAt:   sql.NullTime{Time: periodEnd.Add(grace), Valid: true},
+		LastEventAt: lastEventAt,
+	}
+}
+
+func withStatus(state *State, status string, lastEventAt time.Time) *State {
+	next := *state
+	next.Status = status
+	next.LastEventAt = lastEventAt
+	return &next
+}
+
+func TestRenew(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     *State
+		at          time.Time
+		periodStart time.Time
+		periodEnd   time.Time
+		wantApplied bool
+	}{
+		{"first upgrade", nil, jan1, jan1, feb1, true},
+		{"renewal for the next period", active(jan1, feb1, jan1), feb1, feb1, mar1, true},
+		{"repeated delivery", active(jan1, feb1, jan1), jan1, jan1, feb1, true},
+		{"renewal after payment failed", withStatus(active(jan1, feb1, jan1), PastDue, feb1.Add(time.Hour)), feb1.Add(2 * time.Hour), feb1, mar1, true},
+		{"resubscribe after cancel", withStatus(active(jan1, feb1, jan1), Canceled, jan1.Add(time.Hour)), feb1, feb1, mar1, true},
+		{"late upgrade after cancel", withStatus(active(jan1, feb1, jan1), Canceled, jan1.Add(time.Hour)), jan1, jan1, feb1, false},
+		{"late renewal for an earlier period", active(feb1, mar1, feb1), feb1.Add(time.Hour), jan1, feb1, false},
+	}
+
+	for _, tt := range tests {
+		got, applied := Renew(tt.current, tt.at, tt.periodStart, tt.periodEnd, grace)
+		if applied != tt.wantApplied {
+			t.Errorf("%s: Renew() applied = %t, want %t", tt.name, applied, tt.wantApplied)
+			continue
+		}
+		if !applied {
+			continue
+		}
+		if got.Status != Active || !got.PeriodStart.Equal(tt.periodStart) || !got.PeriodEnd.Time.Equal(tt.periodEnd) {
+			t.Errorf("%s: Renew() = %+v, want active from %s to %s", tt.name, got, tt.periodStart, tt.periodEnd)
+		}
+		if !got.ExpiresAt.Valid || !got.ExpiresAt.Time.Equal(tt.periodEnd.Add(grace)) {
+			t.Errorf("%s: ExpiresAt = %+v, want period end plus grace", tt.name, got.ExpiresAt)
+		}
+		if !got.LastEventAt.Equal(tt.at) {
+			t.Errorf("%s: LastEventAt = %s, want %s", tt.name, got.LastEventAt, tt.at)
+		}
+	}
+}
+
+func TestMarkPastDue(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     *State
+		at          time.Time
+		now         time.Time
+		wantApplied bool
+		wantExpires time.Time
+	}{
+		{"active within period", active(jan1, feb1, jan1), jan1.Add(time.Hour), jan1.Add(time.Hour), true, feb1.Add(grace)},
+		{"active after period end", active(jan1, feb1, jan1), feb1.Add(time.Hour), feb1.Add(2 * time.Hour), true, feb1.Add(2 * time.Hour).Add(grace)},
+		{"no subscription", nil, jan1, jan1, false, time.Time{}},
+		{"already past due", withStatus(active(jan1, feb1, jan1), PastDue, jan1.Add(time.Hour)), jan1.Add(2 * time.Hour), jan1.Add(2 * time.Hour), false, time.Time{}},
+		{"canceled", withStatus(active(jan1, feb1, jan1), Canceled, jan1.Add(time.Hour)), jan1.Add(2 * time.Hour), jan1.Add(2 * time.Hour), false, time.Time{}},
+		{"expired", withStatus(active(jan1, feb1, jan1), Expired, jan1), mar1, mar1, false, time.Time{}},
+		{"late failure before a renewal", active(feb1, mar1, feb1), jan1.Add(time.Hour), feb1.Add(time.Hour), false, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		got, applied := MarkPastDue(tt.current, tt.at, tt.now, grace)
+		if applied != tt.wantApplied {
+			t.Errorf("%s: MarkPastDue() applied = %t, want %t", tt.name, applied, tt.wantApplied)
+			continue
+		}
+		if !applied {
+			continue
+		}
+		if got.Status != PastDue || !got.ExpiresAt.Time.Equal(tt.wantExpires) {
+			t.Errorf("%s: MarkPastDue() = %+v, want past due until %s", tt.name, got, tt.wantExpires)
+		}
+		if !got.PeriodStart.Equal(tt.current.PeriodStart) || got.PeriodEnd != tt.current.PeriodEnd {
+			t.Errorf("%s: MarkPastDue() changed the period to %+v", tt.name, got)
+		}
+	}
+}
+
+func TestEnd(t *testing.T) {
+	now := feb1.Add(24 * time.Hour)
+	tests := []struct {
+		name        string
+		current     *State
+		status      string
+		at          time.Time
+		wantApplied bool
+	}{
+		{"cancel active", active(jan1, feb1, jan1), Canceled, feb1, true},
+		{"cancel past due", withStatus(active(jan1, feb1, jan1), PastDue, feb1), Canceled, feb1.Add(time.Hour), true},
+		{"refund after cancel", withStatus(active(jan1, feb1, jan1), Canceled, feb1), Refunded, feb1.Add(time.Hour), true},
+		{"no subscription", nil, Canceled, feb1, false},
+		{"late cancel after a renewal", active(feb1, mar1, feb1), Canceled, jan1.Add(time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		got, applied := End(tt.current, tt.status, tt.at, now)
+		if applied != tt.wantApplied {
+			t.Errorf("%s: End() applied = %t, want %t", tt.name, applied, tt.wantApplied)
+			continue
+		}
+		if !applied {
+			continue
+		}
+		if got.Status != tt.status || !got.ExpiresAt.Valid || !got.ExpiresAt.Time.Equal(now) {
+			t.Errorf("%s: End() = %+v, want %s expiring now", tt.name, got, tt.status)
+		}
+	}
+}
+
+// A full lifecycle, with one event delivered late
+func TestLifecycle(t *testing.T) {
+	state, applied := Renew(nil, jan1, jan1, feb1, grace)
+	if !applied {
+		t.Fatalf("Renew() should have started the subscription")
+	}
+	upgradeAt := jan1
+
+	failedAt := feb1.Add(time.Hour)
+	if state, applied = MarkPastDue(&state, failedAt, failedAt, grace); !applied || state.Status != PastDue {
+		t.Fatalf("MarkPastDue() = %+v, %t, want past due", state, applied)
+	}
+
+	canceledAt := feb1.Add(2 * time.Hour)
+	if state, applied = End(&state, Canceled, canceledAt, canceledAt); !applied || state.Status != Canceled {
+		t.Fatalf("End() = %+v, %t, want canceled", state, applied)
+	}
+
+	// Polka retries the original upgrade
+	if _, applied := Renew(&state, upgradeAt, jan1, feb1, grace); applied {
+		t.Errorf("Renew() for the original upgrade shouldn't reactivate a canceled subscription")
+	}
+	// A failure reported late can't resurrect it as past due either
+	if _, applied := MarkPastDue(&state, failedAt, canceledAt, grace); applied {
+		t.Errorf("MarkPastDue() shouldn't apply to a canceled subscription")
+	}
+}
@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/venzy/chirpy/internal/server"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Wraps next so each request runs in a server span, continuing the trace from
+// the request's traceparent header if it has one. route names the span, and
+// should return the matched ServeMux pattern rather than the raw path, to keep
+// span names low cardinality.
+func Handler(tracer trace.Tracer, propagator propagation.TextMapPropagator, route func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		routeName := route(r)
+		ctx, span := tracer.Start(ctx, routeName,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(routeName),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		recorder := server.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.Status))
+		// Per the HTTP semantic conventions, 4xx is the client's problem, not an
+		// error for a server span
+		if recorder.Status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", recorder.Status))
+		}
+	})
+}
@@ -0,0 +1,31 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/venzy/chirpy/internal/database"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A database.QueryHook that runs each query in a client span named after the
+// sqlc query, as a child of whatever span is in the query's context.
+func QueryHook(tracer trace.Tracer) database.QueryHook {
+	return func(ctx context.Context, queryName string) (context.Context, func(err error)) {
+		ctx, span := tracer.Start(ctx, queryName,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemNamePostgreSQL,
+				semconv.DBOperationName(queryName),
+			),
+		)
+		return ctx, func(err error) {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package tracing sets up OpenTelemetry tracing for chirpy: a span per
+// incoming HTTP request, continuing any W3C traceparent the caller sent, with
+// child spans for each database query made while handling it.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation scope name for the spans chirpy creates
+const ScopeName = "github.com/venzy/chirpy"
+
+const defaultOTLPEndpoint = "http://localhost:4318"
+
+type Config struct {
+	ServiceName string
+	// "none" (or empty), "stdout" or "otlp" - as for OTEL_TRACES_EXPORTER
+	Exporter string
+	// Base URL of an OTLP/HTTP collector, e.g. "http://localhost:4318" - as
+	// for OTEL_EXPORTER_OTLP_ENDPOINT
+	OTLPEndpoint string
+	// Where the stdout exporter writes, os.Stdout if nil
+	Stdout io.Writer
+}
+
+// Builds the exporter named by config, or nil if tracing is disabled.
+func NewExporter(config Config) (sdktrace.SpanExporter, error) {
+	switch strings.ToLower(config.Exporter) {
+	case "", "none":
+		return nil, nil
+	case "stdout", "console":
+		options := []stdouttrace.Option{}
+		if config.Stdout != nil {
+			options = append(options, stdouttrace.WithWriter(config.Stdout))
+		}
+		return stdouttrace.New(options...)
+	case "otlp":
+		endpoint := config.OTLPEndpoint
+		if endpoint == "" {
+			endpoint = defaultOTLPEndpoint
+		}
+		return otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"),
+			otlptracehttp.WithTimeout(10*time.Second),
+		)
+	default:
+		return nil, fmt.Errorf("invalid traces exporter '%s', must be 'none', 'stdout' or 'otlp'", config.Exporter)
+	}
+}
+
+// Batches spans to exporter, which may be nil to record nothing.
+func NewTracerProvider(serviceName string, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	}
+	if exporter != nil {
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	return sdktrace.NewTracerProvider(options...)
+}
+
+// Installs a global tracer provider and W3C trace context propagator built
+// from config. The returned function flushes any buffered spans, and should be
+// called before exiting.
+func Setup(config Config) (func(context.Context) error, error) {
+	exporter, err := NewExporter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "chirpy"
+	}
+	provider := NewTracerProvider(serviceName, exporter)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// The tracer for chirpy's own spans, from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(ScopeName)
+}
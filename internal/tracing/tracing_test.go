@@ -0,0 +1,235 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/venzy/chirpy/internal/database"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestTracer() (trace.Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return provider.Tracer(ScopeName), exporter
+}
+
+// Only ExecContext is exercised by the queries these tests run
+type fakeDB struct {
+	execErr error
+}
+
+func (db fakeDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if db.execErr != nil {
+		return nil, db.execErr
+	}
+	return driverResult(1), nil
+}
+
+func (db fakeDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (db fakeDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (db fakeDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+type driverResult int64
+
+func (r driverResult) LastInsertId() (int64, error) { return 0, nil }
+func (r driverResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func attributeValue(attributes []attribute.KeyValue, key string) (attribute.Value, bool) {
+	for _, kv := range attributes {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestHandlerContinuesTraceWithQuerySpans(t *testing.T) {
+	tracer, exporter := newTestTracer()
+	queries := database.New(database.WithQueryHook(fakeDB{}, QueryHook(tracer)))
+
+	handler := Handler(tracer, propagation.TraceContext{},
+		func(*http.Request) string { return "POST /admin/reset" },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := queries.DeleteUsers(r.Context()); err != nil {
+				t.Errorf("DeleteUsers() error = %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	request := httptest.NewRequest(http.MethodPost, "/admin/reset", nil)
+	request.Header.Set("traceparent", traceParent)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	// Children end first
+	querySpan, serverSpan := spans[0], spans[1]
+
+	if serverSpan.Name != "POST /admin/reset" || serverSpan.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span = %s (%s), want POST /admin/reset (server)", serverSpan.Name, serverSpan.SpanKind)
+	}
+	if got := serverSpan.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server span trace ID = %s, want the one from traceparent", got)
+	}
+	if got := serverSpan.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %s, want the span from traceparent", got)
+	}
+	if status, _ := attributeValue(serverSpan.Attributes, "http.response.status_code"); status.AsInt64() != http.StatusCreated {
+		t.Errorf("http.response.status_code = %d, want %d", status.AsInt64(), http.StatusCreated)
+	}
+
+	if querySpan.Name != "DeleteUsers" || querySpan.SpanKind != trace.SpanKindClient {
+		t.Errorf("query span = %s (%s), want DeleteUsers (client)", querySpan.Name, querySpan.SpanKind)
+	}
+	if querySpan.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("query span isn't a child of the server span")
+	}
+	if querySpan.Status.Code != codes.Unset {
+		t.Errorf("query span status = %s, want unset", querySpan.Status.Code)
+	}
+}
+
+func TestHandlerMarksServerErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantError bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, false},
+		{http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		tracer, exporter := newTestTracer()
+		handler := Handler(tracer, propagation.TraceContext{},
+			func(*http.Request) string { return "GET /api/healthz" },
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+
+		spans := exporter.GetSpans()
+		if len(spans) != 1 {
+			t.Fatalf("status %d: got %d spans, want 1", tt.status, len(spans))
+		}
+		if got := spans[0].Status.Code == codes.Error; got != tt.wantError {
+			t.Errorf("status %d: span error = %v, want %v", tt.status, got, tt.wantError)
+		}
+		if spans[0].Parent.IsValid() {
+			t.Errorf("status %d: span without traceparent has a parent", tt.status)
+		}
+	}
+}
+
+func TestQueryHookRecordsErrors(t *testing.T) {
+	tracer, exporter := newTestTracer()
+	queries := database.New(database.WithQueryHook(fakeDB{execErr: errors.New("connection refused")}, QueryHook(tracer)))
+
+	if _, err := queries.RevokeAPIToken(context.Background(), database.RevokeAPITokenParams{}); err == nil {
+		t.Fatal("RevokeAPIToken() error = nil, want error")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if spans[0].Name != "RevokeAPIToken" || spans[0].Status.Code != codes.Error {
+		t.Errorf("span = %s (%s), want RevokeAPIToken (error)", spans[0].Name, spans[0].Status.Code)
+	}
+	if operation, _ := attributeValue(spans[0].Attributes, "db.operation.name"); operation.AsString() != "RevokeAPIToken" {
+		t.Errorf("db.operation.name = %s, want RevokeAPIToken", operation.AsString())
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var received coltracepb.ExportTraceServiceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("got %s with content type %s, want /v1/traces with protobuf", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &received); err != nil {
+			t.Errorf("couldn't decode export request: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	exporter, err := NewExporter(Config{Exporter: "otlp", OTLPEndpoint: collector.URL + "/"})
+	if err != nil {
+		t.Fatalf("NewExporter() error = %v", err)
+	}
+	provider := NewTracerProvider("chirpy-test", exporter)
+	ctx, parent := provider.Tracer(ScopeName).Start(context.Background(), "parent")
+	_, child := provider.Tracer(ScopeName).Start(ctx, "child", trace.WithAttributes(attribute.Int("count", 3)))
+	child.SetStatus(codes.Error, "boom")
+	child.End()
+	parent.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	if len(received.ResourceSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %d resource spans, want 1 with 1 scope", len(received.ResourceSpans))
+	}
+	resourceSpans := received.ResourceSpans[0]
+	foundService := false
+	for _, kv := range resourceSpans.Resource.Attributes {
+		if kv.Key == "service.name" && kv.Value.GetStringValue() == "chirpy-test" {
+			foundService = true
+		}
+	}
+	if !foundService {
+		t.Errorf("resource is missing service.name")
+	}
+
+	spans := resourceSpans.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	child0, parent0 := spans[0], spans[1]
+	if child0.Name != "child" || !bytes.Equal(child0.ParentSpanId, parent0.SpanId) || !bytes.Equal(child0.TraceId, parent0.TraceId) {
+		t.Errorf("child span %v isn't linked to parent %v", child0, parent0)
+	}
+	if child0.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || child0.Status.GetMessage() != "boom" {
+		t.Errorf("child status = %v, want error 'boom'", child0.Status)
+	}
+	if len(child0.Attributes) != 1 || child0.Attributes[0].Value.GetIntValue() != 3 {
+		t.Errorf("child attributes = %v, want count=3", child0.Attributes)
+	}
+}
+
+func TestNewExporterRejectsUnknown(t *testing.T) {
+	if _, err := NewExporter(Config{Exporter: "zipkin"}); err == nil {
+		t.Error("NewExporter(zipkin) error = nil, want error")
+	}
+	if exporter, err := NewExporter(Config{}); exporter != nil || err != nil {
+		t.Errorf("NewExporter() = %v, %v, want nil, nil", exporter, err)
+	}
+}
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/venzy/chirpy/internal/config"
 	"github.com/venzy/chirpy/internal/database"
+	"github.com/venzy/chirpy/internal/entitlements"
+	"github.com/venzy/chirpy/internal/events"
+	"github.com/venzy/chirpy/internal/migrate"
+	"github.com/venzy/chirpy/internal/oidc"
+	"github.com/venzy/chirpy/internal/outbound"
+	"github.com/venzy/chirpy/internal/ratelimit"
+	"github.com/venzy/chirpy/internal/server"
+	"github.com/venzy/chirpy/internal/stream"
+	"github.com/venzy/chirpy/internal/tracing"
 )
 
 type Platform int
@@ -20,80 +37,281 @@ const (
 )
 
 type apiConfig struct {
-	fileserverHits atomic.Int32
-	maxChirpLength int
+	metrics *appMetrics
+	// What each user's plan allows
+	entitlements entitlements.Checker
+	accessTokenExpiry time.Duration
+	refreshTokenExpiry time.Duration
+	mfaChallengeExpiry time.Duration
 	db *database.Queries
+	// The pool behind db, for pinging it and starting transactions
+	sqlDB *sql.DB
+	// The migration version this build expects
+	schemaVersion int64
 	platform Platform
 	jwtSecret string
 	polkaKey string
-}
-
-func (cfg *apiConfig) withMetricsInc(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits.Add(1)
-		next.ServeHTTP(w, r)
-	})
+	// Set to require signed webhooks instead of polkaKey
+	polkaSigningSecrets []string
+	polkaSignatureTolerance time.Duration
+	// How long Chirpy Red lasts after a period ends unpaid
+	subscriptionGracePeriod time.Duration
+	adminKey string
+	oidcProviders map[string]*oidc.Provider
+	rateLimiter ratelimit.Store
+	// Publishes domain events from the outbox. Nil outside the server.
+	eventDispatcher *events.Dispatcher
+	// Fans new chirps out to streaming clients
+	streamHub *stream.Hub
+	// Open connections, each capped separately. WebSocket clients can hold
+	// several hub subscriptions on one connection.
+	openStreams atomic.Int64
+	openWebSockets atomic.Int64
+	// Set once shutdown starts, so readiness fails while we drain
+	draining atomic.Bool
 }
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	printConfig := flag.Bool("print-config", false, "print the configuration, with secrets redacted, and exit")
+	flag.Parse()
+
 	godotenv.Load()
+	conf, err := config.Load(*configPath, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		if err := conf.WriteYAML(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Problem printing config: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Set up logging first, so everything after uses it
+	logger, err := newLogger(os.Stderr, conf.Log.Format, conf.Log.Level)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Problem configuring logging: %s\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	// Open DB
+	db, err := sql.Open("postgres", conf.Database.URL)
+	if err != nil {
+		slog.Error("Problem opening database", "error", err)
+		os.Exit(1)
+	}
+	db.SetMaxOpenConns(conf.Database.MaxOpenConns)
+	db.SetMaxIdleConns(conf.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(conf.Database.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(conf.Database.ConnMaxIdleTime)
+
+	// Serving is the default, the other commands are for operators
+	err = runCommand(conf, db, flag.Args())
+	if closeErr := db.Close(); closeErr != nil {
+		slog.Error("Problem closing database", "error", closeErr)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Runs the API server until SIGINT or SIGTERM, then shuts down gracefully
+func runServe(conf config.Config, db *sql.DB) error {
+	// Tracing is off unless the exporter is 'stdout' or 'otlp'
+	shutdownTracing, err := tracing.Setup(tracing.Config{
+		ServiceName: conf.Tracing.ServiceName,
+		Exporter: conf.Tracing.Exporter,
+		OTLPEndpoint: conf.Tracing.OTLPEndpoint,
+	})
+	if err != nil {
+		return fmt.Errorf("problem configuring tracing: %w", err)
+	}
 
 	// Get Platform
-	platformEnv := os.Getenv("PLATFORM")
 	var platform Platform
-	switch platformEnv {
+	switch conf.Platform {
 	case "dev":
 		platform = Dev
 	default:
 		platform = Prod
 	}
 
-	// Open DB
-	dbURL := os.Getenv("DB_URL")
-	db, err := sql.Open("postgres", dbURL)
+	appMetrics := newAppMetrics()
+	hookedDB := database.WithQueryHook(db, appMetrics.queryHook)
+	hookedDB = database.WithQueryHook(hookedDB, tracing.QueryHook(tracing.Tracer()))
+	dbQueries := database.New(hookedDB)
+
+	// Refuse to start against a schema our queries don't match
+	migrator, err := migrate.New(db, slog.Default())
 	if err != nil {
-		log.Fatalf("Problem opening database: %v\n", err)
+		return err
+	}
+	if err := ensureSchema(context.Background(), migrator, conf.Database.AutoMigrate); err != nil {
+		return fmt.Errorf("database schema isn't ready: %w", err)
 	}
-	dbQueries := database.New(db)
 
-	// Get secrets
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatalf("JWT_SECRET environment needs to be defined")
+	planEntitlements, err := entitlements.New(map[entitlements.Plan]entitlements.Entitlements{
+		entitlements.Free: entitlementsFromConfig(conf.Plans.Free, conf.Chirps.MaxLength),
+		entitlements.Red: entitlementsFromConfig(conf.Plans.Red, conf.Chirps.MaxLength),
+	}, userPlanLookup(dbQueries))
+	if err != nil {
+		return err
 	}
 
-	polkaKey := os.Getenv("POLKA_KEY")
-	if polkaKey == "" {
-		log.Fatalf("POLKA_KEY environment needs to be defined")
+	// Optional "sign in with X" provider
+	oidcProviders := map[string]*oidc.Provider{}
+	if conf.OIDC.Issuer != "" {
+		oidcProviders[conf.OIDC.ProviderName] = oidc.NewProvider(oidc.Config{
+			Name: conf.OIDC.ProviderName,
+			Issuer: conf.OIDC.Issuer,
+			ClientID: conf.OIDC.ClientID,
+			ClientSecret: conf.OIDC.ClientSecret,
+			RedirectURL: conf.OIDC.RedirectURL,
+		}, nil)
 	}
 
 	cfg := &apiConfig{
-		maxChirpLength: 140,
+		metrics: appMetrics,
+		entitlements: planEntitlements,
+		accessTokenExpiry: conf.Auth.AccessTokenExpiry,
+		refreshTokenExpiry: conf.Auth.RefreshTokenExpiry,
+		mfaChallengeExpiry: conf.Auth.MFAChallengeExpiry,
 		db: dbQueries,
+		sqlDB: db,
+		schemaVersion: migrate.LatestVersion(),
 		platform: platform,
-		jwtSecret: jwtSecret,
-		polkaKey: polkaKey,
+		jwtSecret: conf.Auth.JWTSecret,
+		polkaKey: conf.Polka.Key,
+		polkaSigningSecrets: conf.Polka.SigningSecrets,
+		polkaSignatureTolerance: conf.Polka.SignatureTolerance,
+		subscriptionGracePeriod: conf.Subscriptions.GracePeriod,
+		// Optional - admin API is disabled without it
+		adminKey: conf.Auth.AdminAPIKey,
+		oidcProviders: oidcProviders,
+		rateLimiter: ratelimit.NewMemoryStore(),
+		streamHub: stream.NewHub(),
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/app/", cfg.withMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
-	mux.HandleFunc("GET /api/healthz", handleReady)
-	mux.HandleFunc("GET /admin/metrics", cfg.handleMetrics)
+	mux.HandleFunc("GET /api/healthz", handleLivez)
+	mux.HandleFunc("GET /api/livez", handleLivez)
+	mux.HandleFunc("GET /api/readyz", cfg.handleReadyz)
+	mux.HandleFunc("GET /metrics", cfg.handleMetrics)
 	mux.HandleFunc("POST /admin/reset", cfg.handleReset)
+	mux.Handle("POST /admin/unlock", cfg.withAdmin(cfg.handleUnlockAccount))
+	mux.Handle("GET /admin/webhooks", cfg.withAdmin(cfg.handleListWebhookEvents))
+	mux.Handle("POST /admin/webhooks/{eventID}/replay", cfg.withAdmin(cfg.handleReplayWebhookEvent))
+
+	mux.Handle("POST /api/users", cfg.withRateLimit(authBudget, http.HandlerFunc(cfg.handleCreateUser)))
+	mux.Handle("PUT /api/users", cfg.withAuthenticatedUser(scopeUsersWrite, cfg.withUserRateLimit(writeBudget, cfg.handleUpdateUser)))
+	mux.Handle("POST /api/login", cfg.withRateLimit(authBudget, http.HandlerFunc(cfg.handleLogin)))
+	mux.Handle("POST /api/login/mfa", cfg.withRateLimit(authBudget, http.HandlerFunc(cfg.handleLoginMFA)))
+	mux.Handle("GET /api/auth/{provider}/start", cfg.withRateLimit(authBudget, http.HandlerFunc(cfg.handleOIDCStart)))
+	mux.Handle("GET /api/auth/{provider}/callback", cfg.withRateLimit(authBudget, http.HandlerFunc(cfg.handleOIDCCallback)))
+	mux.Handle("POST /api/refresh", cfg.withRateLimit(authBudget, http.HandlerFunc(cfg.handleRefresh)))
+	mux.Handle("POST /api/revoke", cfg.withRateLimit(authBudget, http.HandlerFunc(cfg.handleRevoke)))
+
+	mux.Handle("POST /api/mfa/totp/enroll", cfg.withAuthenticatedUser("", cfg.handleEnrollTOTP))
+	mux.Handle("POST /api/mfa/totp/confirm", cfg.withAuthenticatedUser("", cfg.handleConfirmTOTP))
+	mux.Handle("DELETE /api/mfa/totp", cfg.withAuthenticatedUser("", cfg.withUserRateLimit(authBudget, cfg.handleDisableTOTP)))
 
-	mux.HandleFunc("POST /api/users", cfg.handleCreateUser)
-	mux.Handle("PUT /api/users", cfg.withAuthenticatedUser(cfg.handleUpdateUser))
-	mux.HandleFunc("POST /api/login", cfg.handleLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handleRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handleRevoke)
+	mux.Handle("POST /api/chirps", cfg.withAuthenticatedUser(scopeChirpsWrite, cfg.withUserRateLimit(writeBudget, cfg.handleCreateChirp)))
+	mux.Handle("GET /api/chirps", cfg.withRateLimit(anonymousReadBudget, cfg.withOptionalUser(cfg.handleGetChirps)))
+	mux.Handle("GET /api/chirps/{chirpID}", cfg.withRateLimit(anonymousReadBudget, cfg.withOptionalUser(cfg.handleGetChirpByID)))
+	mux.Handle("GET /api/stream", cfg.withRateLimit(anonymousReadBudget, http.HandlerFunc(cfg.handleStreamChirps)))
+	mux.Handle("GET /api/ws", cfg.withRateLimit(anonymousReadBudget, http.HandlerFunc(cfg.handleWebSocket)))
+	mux.Handle("DELETE /api/chirps/{chirpID}", cfg.withAuthenticatedUser(scopeChirpsWrite, cfg.withUserRateLimit(writeBudget, cfg.handleDeleteChirpByID)))
 
-	mux.Handle("POST /api/chirps", cfg.withAuthenticatedUser(cfg.handleCreateChirp))
-	mux.HandleFunc("GET /api/chirps", cfg.handleGetChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", cfg.handleGetChirpByID)
-	mux.Handle("DELETE /api/chirps/{chirpID}", cfg.withAuthenticatedUser(cfg.handleDeleteChirpByID))
+	mux.Handle("POST /api/tokens", cfg.withAuthenticatedUser("", cfg.handleCreateAPIToken))
+	mux.Handle("GET /api/tokens", cfg.withAuthenticatedUser("", cfg.handleGetAPITokens))
+	mux.Handle("DELETE /api/tokens/{tokenID}", cfg.withAuthenticatedUser("", cfg.handleRevokeAPIToken))
+
+	mux.Handle("GET /api/notifications", cfg.withAuthenticatedUser("", cfg.handleGetNotifications))
+	mux.Handle("POST /api/notifications/read-all", cfg.withAuthenticatedUser("", cfg.handleMarkAllNotificationsRead))
+	mux.Handle("POST /api/notifications/{notificationID}/read", cfg.withAuthenticatedUser("", cfg.handleMarkNotificationRead))
+	mux.Handle("GET /api/notifications/preferences", cfg.withAuthenticatedUser("", cfg.handleGetNotificationPreferences))
+	mux.Handle("PUT /api/notifications/preferences", cfg.withAuthenticatedUser("", cfg.handleUpdateNotificationPreferences))
+	mux.Handle("POST /api/conversations", cfg.withAuthenticatedUser("", cfg.withUserRateLimit(writeBudget, cfg.handleCreateConversation)))
+	mux.Handle("GET /api/conversations", cfg.withAuthenticatedUser("", cfg.handleGetConversations))
+	mux.Handle("GET /api/conversations/{conversationID}", cfg.withAuthenticatedUser("", cfg.handleGetConversation))
+	mux.Handle("GET /api/conversations/{conversationID}/messages", cfg.withAuthenticatedUser("", cfg.handleGetMessages))
+	mux.Handle("POST /api/conversations/{conversationID}/messages", cfg.withAuthenticatedUser("", cfg.withUserRateLimit(writeBudget, cfg.handleSendMessage)))
+	mux.Handle("POST /api/conversations/{conversationID}/read", cfg.withAuthenticatedUser("", cfg.handleMarkConversationRead))
+	mux.Handle("POST /api/blocks", cfg.withAuthenticatedUser("", cfg.withUserRateLimit(writeBudget, cfg.handleBlockUser)))
+	mux.Handle("GET /api/blocks", cfg.withAuthenticatedUser("", cfg.handleGetBlocks))
+	mux.Handle("DELETE /api/blocks/{userID}", cfg.withAuthenticatedUser("", cfg.handleUnblockUser))
+	mux.Handle("POST /api/mutes", cfg.withAuthenticatedUser("", cfg.withUserRateLimit(writeBudget, cfg.handleMuteUser)))
+	mux.Handle("GET /api/mutes", cfg.withAuthenticatedUser("", cfg.handleGetMutes))
+	mux.Handle("DELETE /api/mutes/{userID}", cfg.withAuthenticatedUser("", cfg.handleUnmuteUser))
+
+	mux.Handle("POST /api/webhooks", cfg.withAuthenticatedUser("", cfg.handleCreateWebhookEndpoint))
+	mux.Handle("GET /api/webhooks", cfg.withAuthenticatedUser("", cfg.handleGetWebhookEndpoints))
+	mux.Handle("DELETE /api/webhooks/{endpointID}", cfg.withAuthenticatedUser("", cfg.handleDeleteWebhookEndpoint))
+	mux.Handle("POST /api/webhooks/{endpointID}/enable", cfg.withAuthenticatedUser("", cfg.handleEnableWebhookEndpoint))
+	mux.Handle("GET /api/webhooks/{endpointID}/deliveries", cfg.withAuthenticatedUser("", cfg.handleGetWebhookDeliveries))
 
 	mux.HandleFunc("POST /api/polka/webhooks", cfg.handlePolkaWebhook)
 
-	server := &http.Server{Handler: mux, Addr: ":8080"}
-	server.ListenAndServe()
+	// Serve until SIGINT or SIGTERM, then drain in-flight requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serverConfig := server.Config{
+		Addr: conf.Server.Addr,
+		ReadHeaderTimeout: conf.Server.ReadHeaderTimeout,
+		ReadTimeout: conf.Server.ReadTimeout,
+		WriteTimeout: conf.Server.WriteTimeout,
+		IdleTimeout: conf.Server.IdleTimeout,
+		DrainDelay: conf.Server.DrainDelay,
+		ShutdownTimeout: conf.Server.ShutdownTimeout,
+	}
+	if platform == Dev {
+		// No load balancer to wait for
+		serverConfig.DrainDelay = 0
+	}
+	// Background jobs run until ctx is done
+	var jobs sync.WaitGroup
+	runJob := func(job func()) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			job()
+		}()
+	}
+	runJob(func() { cfg.runSubscriptionExpiry(ctx, conf.Subscriptions.ExpiryInterval) })
+	bus := events.NewBus()
+	cfg.subscribeToEvents(bus)
+	cfg.eventDispatcher = events.NewDispatcher(outboxStore{db: dbQueries}, bus, slog.Default())
+	runJob(func() { cfg.eventDispatcher.Run(ctx, outboxPollInterval) })
+	runJob(func() { cfg.runChirpListener(ctx, conf.Database.URL) })
+	// Local receivers are fine in dev, but never reachable in production
+	webhookClient := outbound.NewClient(outbound.DefaultTimeout, platform == Dev)
+	dispatcher := outbound.NewDispatcher(webhookDeliveryStore{db: dbQueries}, webhookClient, slog.Default())
+	runJob(func() { dispatcher.Run(ctx, webhookDeliveryInterval) })
+
+	srv := server.New(serverConfig, withRequestLogging(mux, withTracing(cfg.withHTTPMetrics(mux))))
+	srv.RegisterOnDrain(func() { cfg.draining.Store(true) })
+	// Streams never finish by themselves, so end them for clients to
+	// reconnect elsewhere
+	srv.RegisterOnDrain(cfg.streamHub.Close)
+	slog.Info("Serving", "addr", serverConfig.Addr)
+	serveErr := srv.Run(ctx)
+	slog.Info("Server stopped, shutting down")
+
+	// Then stop background work - anything using the DB must stop before
+	// we return and the pool is closed
+	stop()
+	jobs.Wait()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Problem flushing traces", "error", err)
+	}
+
+	return serveErr
 }
@@ -0,0 +1,39 @@
+-- name: CreateAPIToken :one
+INSERT INTO api_tokens (id, created_at, updated_at, user_id, name, token_hash, scopes, expires_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5
+)
+RETURNING *;
+
+-- name: GetAPITokensByUserID :many
+SELECT * FROM api_tokens WHERE user_id = $1 ORDER BY created_at ASC;
+
+-- name: GetAPITokenByHash :one
+SELECT * FROM api_tokens WHERE token_hash = $1;
+
+-- name: TouchAPIToken :exec
+UPDATE api_tokens
+SET last_used_at = NOW()
+WHERE id = $1;
+
+-- name: RevokeAPIToken :execrows
+UPDATE api_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;
+
+-- name: RevokeAPITokensByUserID :exec
+UPDATE api_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
+
+-- name: DeleteStaleAPITokens :execrows
+-- Deletes tokens that expired or were revoked before the cutoff.
+DELETE FROM api_tokens
+WHERE expires_at < sqlc.arg(cutoff)::timestamp OR revoked_at < sqlc.arg(cutoff)::timestamp;
\ No newline at end of file
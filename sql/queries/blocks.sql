@@ -0,0 +1,25 @@
+-- name: BlockUser :exec
+INSERT INTO blocks (blocker_id, blocked_id, created_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT (blocker_id, blocked_id) DO NOTHING;
+
+-- name: CountBlocksWith :one
+-- Blocks either way between the user and any of the others
+SELECT COUNT(*) FROM blocks
+WHERE (blocker_id = sqlc.arg(user_id) AND blocked_id = ANY(sqlc.arg(user_ids)::uuid[]))
+    OR (blocked_id = sqlc.arg(user_id) AND blocker_id = ANY(sqlc.arg(user_ids)::uuid[]));
+
+-- name: GetBlockedOrBlockingUserIDs :many
+-- Everyone hidden from the user by a block, whichever of them made it
+SELECT blocked_id FROM blocks WHERE blocker_id = $1
+UNION
+SELECT blocker_id FROM blocks WHERE blocked_id = $1;
+
+-- name: GetBlocks :many
+SELECT * FROM blocks
+WHERE blocker_id = $1
+ORDER BY created_at DESC, blocked_id;
+
+-- name: UnblockUser :execrows
+DELETE FROM blocks
+WHERE blocker_id = $1 AND blocked_id = $2;
@@ -19,4 +19,18 @@ SELECT * FROM chirps WHERE id = $1;
 SELECT * FROM chirps WHERE user_id = $1 ORDER BY created_at ASC;
 
 -- name: DeleteChirpByID :exec
-DELETE FROM chirps WHERE id = $1;
\ No newline at end of file
+DELETE FROM chirps WHERE id = $1;
+
+-- name: GetChirpsAfter :many
+-- Chirps created after the given one, oldest first, optionally by one author.
+-- For resuming a stream from the last chirp a client saw.
+SELECT * FROM chirps
+WHERE (created_at, id) > (sqlc.arg(created_at)::timestamp, sqlc.arg(id)::uuid)
+    AND (sqlc.narg(author_id)::uuid IS NULL OR user_id = sqlc.narg(author_id))
+ORDER BY created_at, id
+LIMIT sqlc.arg(max_results);
+
+-- name: NotifyChirpCreated :exec
+-- Tells every server listening on chirp_created about a new chirp. Run in a
+-- transaction, it's sent when that commits.
+SELECT pg_notify('chirp_created', sqlc.arg(chirp_id)::text);
@@ -0,0 +1,27 @@
+-- name: GetLoginFailure :one
+SELECT * FROM login_failures WHERE key_type = $1 AND key = $2;
+
+-- name: RecordLoginFailure :one
+-- Failures before window_start are forgotten, so the count starts again at 1.
+INSERT INTO login_failures (key_type, key, failures, last_failure_at)
+VALUES (
+    $1,
+    $2,
+    1,
+    NOW()
+)
+ON CONFLICT (key_type, key) DO UPDATE
+SET failures = CASE
+        WHEN login_failures.last_failure_at < sqlc.arg(window_start) THEN 1
+        ELSE login_failures.failures + 1
+    END,
+    last_failure_at = NOW()
+RETURNING *;
+
+-- name: SetLoginLockedUntil :exec
+UPDATE login_failures
+SET locked_until = $3
+WHERE key_type = $1 AND key = $2;
+
+-- name: ClearLoginFailures :execrows
+DELETE FROM login_failures WHERE key_type = $1 AND key = $2;
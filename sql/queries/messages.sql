@@ -0,0 +1,83 @@
+-- name: AddConversationMember :exec
+INSERT INTO conversation_members (conversation_id, user_id, joined_at)
+VALUES ($1, $2, NOW());
+
+-- name: CountUnreadMessages :one
+-- Messages from others sent since the member last read the conversation
+SELECT COUNT(*) FROM messages
+JOIN conversation_members ON conversation_members.conversation_id = messages.conversation_id
+WHERE messages.conversation_id = $1
+    AND conversation_members.user_id = $2
+    AND messages.sender_id <> conversation_members.user_id
+    AND (conversation_members.last_read_at IS NULL OR messages.created_at > conversation_members.last_read_at);
+
+-- name: CreateConversation :one
+-- Returns no rows if there's already a one-to-one conversation with the same
+-- direct_key, which GetConversationByDirectKey finds.
+INSERT INTO conversations (id, created_at, updated_at, direct_key)
+VALUES (gen_random_uuid(), NOW(), NOW(), $1)
+ON CONFLICT (direct_key) DO NOTHING
+RETURNING *;
+
+-- name: CreateMessage :one
+INSERT INTO messages (id, created_at, conversation_id, sender_id, body)
+VALUES (gen_random_uuid(), NOW(), $1, $2, $3)
+RETURNING *;
+
+-- name: GetConversation :one
+-- Only finds conversations the user is a member of.
+SELECT conversations.* FROM conversations
+JOIN conversation_members ON conversation_members.conversation_id = conversations.id
+WHERE conversations.id = $1 AND conversation_members.user_id = $2;
+
+-- name: GetConversationByDirectKey :one
+SELECT * FROM conversations
+WHERE direct_key = $1;
+
+-- name: GetConversationMembers :many
+-- The members of each of the conversations
+SELECT * FROM conversation_members
+WHERE conversation_id = ANY(sqlc.arg(conversation_ids)::uuid[])
+ORDER BY conversation_id, joined_at, user_id;
+
+-- name: GetConversations :many
+-- A page of the user's conversations, most recently active first, starting
+-- after the cursor if there is one.
+SELECT conversations.*,
+    (
+        SELECT COUNT(*) FROM messages
+        WHERE messages.conversation_id = conversations.id
+            AND messages.sender_id <> conversation_members.user_id
+            AND (conversation_members.last_read_at IS NULL OR messages.created_at > conversation_members.last_read_at)
+    ) AS unread_count
+FROM conversations
+JOIN conversation_members ON conversation_members.conversation_id = conversations.id
+WHERE conversation_members.user_id = sqlc.arg(user_id)
+    AND (
+        sqlc.narg(before_updated_at)::timestamp IS NULL
+        OR (conversations.updated_at, conversations.id) < (sqlc.narg(before_updated_at)::timestamp, sqlc.narg(before_id)::uuid)
+    )
+ORDER BY conversations.updated_at DESC, conversations.id DESC
+LIMIT sqlc.arg(max_results);
+
+-- name: GetMessages :many
+-- A page of the conversation's messages, newest first, starting after the
+-- cursor if there is one.
+SELECT * FROM messages
+WHERE conversation_id = sqlc.arg(conversation_id)
+    AND (
+        sqlc.narg(before_created_at)::timestamp IS NULL
+        OR (created_at, id) < (sqlc.narg(before_created_at)::timestamp, sqlc.narg(before_id)::uuid)
+    )
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(max_results);
+
+-- name: MarkConversationRead :execrows
+UPDATE conversation_members
+SET last_read_at = NOW()
+WHERE conversation_id = $1 AND user_id = $2;
+
+-- name: TouchConversation :exec
+UPDATE conversations
+SET updated_at = NOW()
+WHERE id = $1;
@@ -0,0 +1,17 @@
+-- name: GetMutedUserIDs :many
+SELECT muted_id FROM mutes
+WHERE muter_id = $1;
+
+-- name: GetMutes :many
+SELECT * FROM mutes
+WHERE muter_id = $1
+ORDER BY created_at DESC, muted_id;
+
+-- name: MuteUser :exec
+INSERT INTO mutes (muter_id, muted_id, created_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT (muter_id, muted_id) DO NOTHING;
+
+-- name: UnmuteUser :execrows
+DELETE FROM mutes
+WHERE muter_id = $1 AND muted_id = $2;
@@ -0,0 +1,80 @@
+-- name: AddNotification :execrows
+-- Adds the actor to the user's unread notification in the group, or starts a
+-- new one. Nothing happens if the actor is already in the unread one, so
+-- repeats before it's read are harmless, if the user has turned the type off,
+-- or if either of them has blocked the other. Once it's read, the actor can
+-- start a new one, e.g. with a later message in the same conversation.
+INSERT INTO notifications (id, created_at, updated_at, user_id, type, group_key, chirp_id, actor_ids)
+SELECT gen_random_uuid(), NOW(), NOW(), sqlc.arg(user_id)::uuid, sqlc.arg(type)::text, sqlc.arg(group_key)::text, sqlc.narg(chirp_id)::uuid, ARRAY[sqlc.arg(actor_id)::uuid]
+WHERE NOT EXISTS (
+    SELECT 1 FROM notifications
+    WHERE user_id = sqlc.arg(user_id)
+        AND group_key = sqlc.arg(group_key)
+        AND sqlc.arg(actor_id)::uuid = ANY(actor_ids)
+        AND read_at IS NULL
+)
+AND NOT EXISTS (
+    SELECT 1 FROM notification_preferences
+    WHERE user_id = sqlc.arg(user_id)
+        AND type = sqlc.arg(type)
+        AND NOT enabled
+)
+AND NOT EXISTS (
+    SELECT 1 FROM blocks
+    WHERE (blocker_id = sqlc.arg(user_id) AND blocked_id = sqlc.arg(actor_id))
+        OR (blocker_id = sqlc.arg(actor_id) AND blocked_id = sqlc.arg(user_id))
+)
+ON CONFLICT (user_id, group_key) WHERE read_at IS NULL DO UPDATE
+SET updated_at = NOW(),
+    actor_ids = array_prepend(sqlc.arg(actor_id)::uuid, notifications.actor_ids);
+
+-- name: CountUnreadNotifications :one
+SELECT COUNT(*) FROM notifications
+WHERE user_id = $1 AND read_at IS NULL;
+
+-- name: DeleteEmptyNotifications :exec
+-- Removes the user's notifications that RemoveNotificationActor left with no
+-- actors.
+DELETE FROM notifications
+WHERE user_id = $1 AND cardinality(actor_ids) = 0;
+
+-- name: GetNotificationPreferences :many
+SELECT * FROM notification_preferences
+WHERE user_id = $1;
+
+-- name: GetNotifications :many
+-- A page of the user's notifications, newest first, starting after the
+-- cursor if there is one. Ordered by when they were started, which unlike
+-- updated_at doesn't change as actors join, so pages don't shift.
+SELECT * FROM notifications
+WHERE user_id = sqlc.arg(user_id)
+    AND (
+        sqlc.narg(before_created_at)::timestamp IS NULL
+        OR (created_at, id) < (sqlc.narg(before_created_at)::timestamp, sqlc.narg(before_id)::uuid)
+    )
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(max_results);
+
+-- name: MarkAllNotificationsRead :execrows
+UPDATE notifications
+SET read_at = NOW()
+WHERE user_id = $1 AND read_at IS NULL;
+
+-- name: MarkNotificationRead :execrows
+-- Matches read notifications too, so marking one twice isn't an error.
+UPDATE notifications
+SET read_at = COALESCE(read_at, NOW())
+WHERE id = $1 AND user_id = $2;
+
+-- name: RemoveNotificationActor :exec
+-- Takes the actor out of all the user's notifications, read or not.
+UPDATE notifications
+SET actor_ids = array_remove(actor_ids, sqlc.arg(actor_id)::uuid)
+WHERE user_id = sqlc.arg(user_id) AND sqlc.arg(actor_id)::uuid = ANY(actor_ids);
+
+-- name: SetNotificationPreference :exec
+INSERT INTO notification_preferences (user_id, type, enabled, updated_at)
+VALUES ($1, $2, $3, NOW())
+ON CONFLICT (user_id, type) DO UPDATE
+SET enabled = EXCLUDED.enabled,
+    updated_at = NOW();
@@ -0,0 +1,34 @@
+-- name: CreateOIDCAuthRequest :exec
+INSERT INTO oidc_auth_requests (state, created_at, provider, nonce, code_verifier, expires_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5
+);
+
+-- name: TakeOIDCAuthRequest :one
+-- Deletes as it reads, so each state can only be redeemed once.
+DELETE FROM oidc_auth_requests WHERE state = $1
+RETURNING *;
+
+-- name: DeleteExpiredOIDCAuthRequests :exec
+DELETE FROM oidc_auth_requests WHERE expires_at < NOW();
+
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities (id, created_at, updated_at, user_id, provider, subject, email)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4
+)
+RETURNING *;
+
+-- name: GetUserIdentity :one
+SELECT * FROM user_identities WHERE provider = $1 AND subject = $2;
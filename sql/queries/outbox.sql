@@ -0,0 +1,40 @@
+-- name: ClaimOutboxEvents :many
+-- Takes due events for publishing, oldest first, counting an attempt and
+-- pushing them back until lease_until so other replicas leave them alone
+-- meanwhile.
+WITH due AS (
+    SELECT id
+    FROM outbox
+    WHERE next_attempt_at <= NOW()
+    ORDER BY next_attempt_at, created_at
+    LIMIT sqlc.arg(max_results)
+    FOR UPDATE SKIP LOCKED
+)
+UPDATE outbox
+SET attempts = outbox.attempts + 1,
+    next_attempt_at = sqlc.arg(lease_until)::timestamp
+FROM due
+WHERE outbox.id = due.id
+RETURNING outbox.*;
+
+-- name: CreateOutboxEvent :exec
+INSERT INTO outbox (id, created_at, event_type, user_id, payload, attempts, next_attempt_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    0,
+    NOW()
+);
+
+-- name: DeleteOutboxEvent :exec
+DELETE FROM outbox
+WHERE id = $1;
+
+-- name: RetryOutboxEvent :exec
+UPDATE outbox
+SET next_attempt_at = $2,
+    last_error = $3
+WHERE id = $1;
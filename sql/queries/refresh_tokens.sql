@@ -24,4 +24,14 @@ SET revoked_at = NOW(), updated_at = NOW()
 WHERE token = $1 AND revoked_at IS NULL;
 
 -- name: DeleteRefreshTokenByToken :exec
-DELETE FROM refresh_tokens WHERE token = $1;
\ No newline at end of file
+DELETE FROM refresh_tokens WHERE token = $1;
+
+-- name: RevokeRefreshTokensByUserID :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
+
+-- name: DeleteStaleRefreshTokens :execrows
+-- Deletes tokens that expired or were revoked before the cutoff.
+DELETE FROM refresh_tokens
+WHERE expires_at < sqlc.arg(cutoff)::timestamp OR revoked_at < sqlc.arg(cutoff)::timestamp;
\ No newline at end of file
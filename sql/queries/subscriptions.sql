@@ -0,0 +1,62 @@
+-- name: UpsertSubscription :one
+-- Starts a user's subscription, or replaces it if they have one.
+INSERT INTO subscriptions (id, created_at, updated_at, user_id, status, current_period_start, current_period_end, expires_at, last_event_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6
+)
+ON CONFLICT (user_id) DO UPDATE
+SET updated_at = NOW(),
+    status = EXCLUDED.status,
+    current_period_start = EXCLUDED.current_period_start,
+    current_period_end = EXCLUDED.current_period_end,
+    expires_at = EXCLUDED.expires_at,
+    last_event_at = EXCLUDED.last_event_at
+RETURNING *;
+
+-- name: GetSubscriptionByUserID :one
+SELECT * FROM subscriptions WHERE user_id = $1;
+
+-- name: GetSubscriptionByUserIDForUpdate :one
+-- Locks the subscription until the transaction ends, so events for the same
+-- user are applied one at a time.
+SELECT * FROM subscriptions WHERE user_id = $1 FOR UPDATE;
+
+-- name: ExpireSubscriptions :execrows
+-- Ends subscriptions whose period and grace period have both passed.
+UPDATE subscriptions
+SET updated_at = NOW(),
+    status = 'expired'
+WHERE status IN ('active', 'past_due') AND expires_at <= NOW();
+
+-- name: SyncUserChirpyRed :one
+-- Sets is_chirpy_red from whether the user has a subscription in effect.
+UPDATE users
+SET updated_at = NOW(),
+    is_chirpy_red = EXISTS (
+        SELECT 1 FROM subscriptions
+        WHERE subscriptions.user_id = users.id
+            AND subscriptions.status IN ('active', 'past_due')
+            AND (subscriptions.expires_at IS NULL OR subscriptions.expires_at > NOW())
+    )
+WHERE id = $1
+RETURNING *;
+
+-- name: SyncAllUsersChirpyRed :execrows
+-- Flips is_chirpy_red for every user whose subscription no longer agrees.
+UPDATE users
+SET updated_at = NOW(),
+    is_chirpy_red = NOT is_chirpy_red
+WHERE is_chirpy_red <> EXISTS (
+    SELECT 1 FROM subscriptions
+    WHERE subscriptions.user_id = users.id
+        AND subscriptions.status IN ('active', 'past_due')
+        AND (subscriptions.expires_at IS NULL OR subscriptions.expires_at > NOW())
+);
@@ -0,0 +1,55 @@
+-- name: UpsertTOTPCredential :one
+-- Starting enrollment again replaces any unconfirmed secret.
+INSERT INTO totp_credentials (user_id, created_at, updated_at, secret)
+VALUES (
+    $1,
+    NOW(),
+    NOW(),
+    $2
+)
+ON CONFLICT (user_id) DO UPDATE
+SET updated_at = NOW(),
+    secret = EXCLUDED.secret,
+    confirmed_at = NULL,
+    last_used_step = 0
+RETURNING *;
+
+-- name: GetTOTPCredentialByUserID :one
+SELECT * FROM totp_credentials WHERE user_id = $1;
+
+-- name: ConfirmTOTPCredential :exec
+UPDATE totp_credentials
+SET updated_at = NOW(),
+    confirmed_at = NOW(),
+    last_used_step = $2
+WHERE user_id = $1;
+
+-- name: UseTOTPStep :execrows
+-- Only succeeds for a step later than the last one used, so a code can't be replayed.
+UPDATE totp_credentials
+SET updated_at = NOW(),
+    last_used_step = $2
+WHERE user_id = $1 AND last_used_step < $2;
+
+-- name: DeleteTOTPCredential :exec
+DELETE FROM totp_credentials WHERE user_id = $1;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO recovery_codes (id, created_at, user_id, code_hash)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2
+);
+
+-- name: GetUnusedRecoveryCodesByUserID :many
+SELECT * FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL;
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE id = $1 AND used_at IS NULL;
+
+-- name: DeleteRecoveryCodesByUserID :exec
+DELETE FROM recovery_codes WHERE user_id = $1;
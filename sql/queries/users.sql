@@ -17,14 +17,6 @@ SET updated_at = NOW(),
 WHERE id = $1
 RETURNING *;
 
--- name: UpgradeUser :one
--- This query is used to upgrade a user to a "chirpy red" status.
-UPDATE users
-SET updated_at = NOW(),
-    is_chirpy_red = TRUE
-WHERE id = $1
-RETURNING *;
-
 -- name: GetUserByID :one
 SELECT * FROM users WHERE id = $1;
 
@@ -32,4 +24,19 @@ SELECT * FROM users WHERE id = $1;
 SELECT * FROM users WHERE email = $1;
 
 -- name: DeleteUsers :exec
-DELETE FROM users;
\ No newline at end of file
+DELETE FROM users;
+
+-- name: ListUsers :many
+SELECT * FROM users ORDER BY created_at ASC;
+
+-- name: DisableUser :one
+UPDATE users
+SET updated_at = NOW(),
+    disabled_at = COALESCE(disabled_at, NOW())
+WHERE id = $1
+RETURNING *;
+
+-- name: CountActiveUsers :one
+-- How many of the users exist and aren't disabled
+SELECT COUNT(*) FROM users
+WHERE id = ANY(sqlc.arg(ids)::uuid[]) AND disabled_at IS NULL;
@@ -0,0 +1,50 @@
+-- name: EnqueueWebhookDeliveries :execrows
+-- Queues the event for each of the user's enabled endpoints subscribed to it,
+-- skipping endpoints it's already been queued for.
+INSERT INTO webhook_deliveries (id, created_at, updated_at, endpoint_id, event_id, event_type, payload, status, attempts, next_attempt_at)
+SELECT gen_random_uuid(), NOW(), NOW(), webhook_endpoints.id, sqlc.arg(event_id)::uuid, sqlc.arg(event_type)::text, sqlc.arg(payload)::jsonb, 'pending', 0, NOW()
+FROM webhook_endpoints
+WHERE webhook_endpoints.user_id = sqlc.arg(user_id)
+    AND webhook_endpoints.disabled_at IS NULL
+    AND sqlc.arg(event_type)::text = ANY(webhook_endpoints.event_types)
+ON CONFLICT (endpoint_id, event_id) DO NOTHING;
+
+-- name: ClaimWebhookDeliveries :many
+-- Takes due deliveries for sending, counting an attempt and pushing them back
+-- until lease_until so other replicas leave them alone meanwhile.
+WITH due AS (
+    SELECT webhook_deliveries.id
+    FROM webhook_deliveries
+    JOIN webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id
+    WHERE webhook_deliveries.status = 'pending'
+        AND webhook_deliveries.next_attempt_at <= NOW()
+        AND webhook_endpoints.disabled_at IS NULL
+    ORDER BY webhook_deliveries.next_attempt_at
+    LIMIT sqlc.arg(max_results)
+    FOR UPDATE OF webhook_deliveries SKIP LOCKED
+)
+UPDATE webhook_deliveries
+SET updated_at = NOW(),
+    attempts = webhook_deliveries.attempts + 1,
+    last_attempt_at = NOW(),
+    next_attempt_at = sqlc.arg(lease_until)::timestamp
+FROM due, webhook_endpoints
+WHERE webhook_deliveries.id = due.id
+    AND webhook_endpoints.id = webhook_deliveries.endpoint_id
+RETURNING webhook_deliveries.id, webhook_deliveries.endpoint_id, webhook_deliveries.event_type, webhook_deliveries.payload, webhook_deliveries.attempts, webhook_endpoints.url, webhook_endpoints.secret;
+
+-- name: FinishWebhookDelivery :exec
+-- Records an attempt's outcome. A pending status retries at next_attempt_at.
+UPDATE webhook_deliveries
+SET updated_at = NOW(),
+    status = $2,
+    next_attempt_at = $3,
+    response_status = $4,
+    last_error = $5
+WHERE id = $1;
+
+-- name: GetWebhookDeliveriesByEndpointID :many
+SELECT * FROM webhook_deliveries
+WHERE endpoint_id = $1
+ORDER BY created_at DESC
+LIMIT $2;
@@ -0,0 +1,47 @@
+-- name: CreateWebhookEndpoint :one
+INSERT INTO webhook_endpoints (id, created_at, updated_at, user_id, url, secret, event_types)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4
+)
+RETURNING *;
+
+-- name: GetWebhookEndpointsByUserID :many
+SELECT * FROM webhook_endpoints WHERE user_id = $1 ORDER BY created_at ASC;
+
+-- name: GetWebhookEndpoint :one
+-- Only matches endpoints owned by the user.
+SELECT * FROM webhook_endpoints WHERE id = $1 AND user_id = $2;
+
+-- name: DeleteWebhookEndpoint :execrows
+DELETE FROM webhook_endpoints WHERE id = $1 AND user_id = $2;
+
+-- name: EnableWebhookEndpoint :one
+UPDATE webhook_endpoints
+SET updated_at = NOW(),
+    consecutive_failures = 0,
+    disabled_at = NULL
+WHERE id = $1 AND user_id = $2
+RETURNING *;
+
+-- name: RecordWebhookEndpointSuccess :exec
+UPDATE webhook_endpoints
+SET consecutive_failures = 0
+WHERE id = $1 AND consecutive_failures > 0;
+
+-- name: RecordWebhookEndpointFailure :one
+-- Disables the endpoint once it reaches the given number of failures in a row.
+UPDATE webhook_endpoints
+SET updated_at = NOW(),
+    consecutive_failures = consecutive_failures + 1,
+    disabled_at = CASE
+        WHEN disabled_at IS NULL AND consecutive_failures + 1 >= sqlc.arg(disable_after)::int THEN NOW()
+        ELSE disabled_at
+    END
+WHERE id = sqlc.arg(id)
+RETURNING *;
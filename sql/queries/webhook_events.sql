@@ -0,0 +1,51 @@
+-- name: CreateWebhookEvent :one
+-- Returns no rows if the provider's event ID has been seen before.
+INSERT INTO webhook_events (id, created_at, updated_at, provider, event_id, event_type, payload, status, attempts)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    'processing',
+    1
+)
+ON CONFLICT (provider, event_id) DO NOTHING
+RETURNING *;
+
+-- name: RetryWebhookEvent :one
+-- Claims a failed event for another attempt, or one left processing since
+-- before stale_before (e.g. by a crash mid delivery). Returns no rows if it
+-- was processed, or another delivery is still processing it.
+UPDATE webhook_events
+SET status = 'processing',
+    attempts = attempts + 1,
+    error = NULL,
+    updated_at = NOW()
+WHERE id = sqlc.arg(id)
+  AND (status = 'failed'
+       OR (status = 'processing' AND updated_at < sqlc.arg(stale_before)))
+RETURNING *;
+
+-- name: FinishWebhookEvent :exec
+UPDATE webhook_events
+SET status = $2,
+    error = $3,
+    processed_at = NOW(),
+    updated_at = NOW()
+WHERE id = $1;
+
+-- name: GetWebhookEvent :one
+SELECT * FROM webhook_events WHERE provider = $1 AND event_id = $2;
+
+-- name: GetWebhookEventByID :one
+SELECT * FROM webhook_events WHERE id = $1;
+
+-- name: ListWebhookEvents :many
+-- All events, or only those with the given status, newest first.
+SELECT * FROM webhook_events
+WHERE sqlc.narg(status)::text IS NULL OR status = sqlc.narg(status)::text
+ORDER BY created_at DESC
+LIMIT sqlc.arg(max_results);
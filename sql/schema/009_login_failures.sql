@@ -0,0 +1,14 @@
+-- +goose Up
+-- Failed login attempts, counted per account (by email as supplied, whether or
+-- not it is registered) and per client IP.
+CREATE TABLE login_failures (
+    key_type TEXT NOT NULL,
+    key TEXT NOT NULL,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (key_type, key)
+);
+
+-- +goose Down
+DROP TABLE login_failures;
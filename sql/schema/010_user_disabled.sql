@@ -0,0 +1,6 @@
+-- +goose Up
+-- Disabled users can't log in, and have their tokens revoked when disabled.
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN disabled_at;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- Every webhook delivery received, so retries of the same event can be
+-- acknowledged without applying it twice, and failures can be replayed.
+CREATE TABLE webhook_events (
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    provider TEXT NOT NULL,
+    -- The provider's ID for the event, the same across redeliveries
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    -- 'processing', 'processed', 'ignored' or 'failed'
+    status TEXT NOT NULL,
+    error TEXT,
+    attempts INTEGER NOT NULL,
+    processed_at TIMESTAMP,
+    UNIQUE (provider, event_id)
+);
+
+CREATE INDEX webhook_events_status_idx ON webhook_events (status, created_at);
+
+-- +goose Down
+DROP TABLE webhook_events;
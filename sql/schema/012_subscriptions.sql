@@ -0,0 +1,33 @@
+-- +goose Up
+-- A user's Chirpy Red subscription. users.is_chirpy_red is kept in step with
+-- it, so the many queries reading users don't all need to join this.
+CREATE TABLE subscriptions (
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    -- 'active', 'past_due', 'canceled', 'refunded' or 'expired'
+    status TEXT NOT NULL,
+    current_period_start TIMESTAMP NOT NULL,
+    -- NULL for subscriptions granted without a billing period
+    current_period_end TIMESTAMP,
+    -- When Red lapses if nothing else happens: the period end plus a grace
+    -- period, or NULL for never
+    expires_at TIMESTAMP,
+    -- When the payment event behind the current state happened, so a late or
+    -- replayed older event can be recognised and ignored rather than undoing
+    -- a newer one
+    last_event_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX subscriptions_expires_at_idx ON subscriptions (expires_at)
+WHERE status IN ('active', 'past_due');
+
+-- Upgrades from before subscriptions were tracked never end
+INSERT INTO subscriptions (id, created_at, updated_at, user_id, status, current_period_start, last_event_at)
+SELECT gen_random_uuid(), NOW(), NOW(), id, 'active', updated_at, updated_at
+FROM users
+WHERE is_chirpy_red;
+
+-- +goose Down
+DROP TABLE subscriptions;
@@ -0,0 +1,48 @@
+-- +goose Up
+-- Endpoints users register to be told about events on their account
+CREATE TABLE webhook_endpoints (
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    -- Kept in the clear, since we need it to sign payloads
+    secret TEXT NOT NULL,
+    event_types TEXT[] NOT NULL,
+    -- Failed attempts since the last success, across all deliveries
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    disabled_at TIMESTAMP
+);
+
+-- The queue of deliveries, one per endpoint per event. Rows stay once sent,
+-- as the delivery log.
+CREATE TABLE webhook_deliveries (
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    endpoint_id UUID NOT NULL,
+        FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+    -- The domain event it's for, so an event published again (e.g. after
+    -- another subscriber failed) doesn't queue a second delivery
+    event_id UUID NOT NULL,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    -- 'pending', 'succeeded' or 'failed'
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    -- When a pending delivery is next due
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_attempt_at TIMESTAMP,
+    response_status INTEGER,
+    last_error TEXT
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at)
+WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_endpoint_idx ON webhook_deliveries (endpoint_id, created_at);
+CREATE UNIQUE INDEX webhook_deliveries_event_idx ON webhook_deliveries (endpoint_id, event_id);
+
+-- +goose Down
+DROP TABLE webhook_deliveries;
+DROP TABLE webhook_endpoints;
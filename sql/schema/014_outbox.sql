@@ -0,0 +1,22 @@
+-- +goose Up
+-- Domain events, written in the same transaction as the change they describe
+-- and deleted once every subscriber has handled them
+CREATE TABLE outbox (
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    event_type TEXT NOT NULL,
+    -- The user whose account it concerns. Not a foreign key, so events
+    -- outlive the user.
+    user_id UUID NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL,
+    -- When it's next due to be published, pushed back while it's being
+    -- published and after failures
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT
+);
+
+CREATE INDEX outbox_due_idx ON outbox (next_attempt_at, created_at);
+
+-- +goose Down
+DROP TABLE outbox;
@@ -0,0 +1,37 @@
+-- +goose Up
+-- In-app notifications. While unread, notifications with the same group_key
+-- are one row listing everyone who caused them, e.g. all the likes of a
+-- chirp, and a new group is started once it's read.
+CREATE TABLE notifications (
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    -- When the latest actor was added. They're ordered by created_at, which
+    -- stays put as actors join, so pages don't shift.
+    updated_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- 'reply', 'mention', 'like', 'follow', 'rechirp' or 'message'
+    type TEXT NOT NULL,
+    group_key TEXT NOT NULL,
+    -- The user's chirp it's about, if any
+    chirp_id UUID REFERENCES chirps(id) ON DELETE CASCADE,
+    -- The users who caused it, most recent first
+    actor_ids UUID[] NOT NULL,
+    read_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX notifications_unread_group_idx ON notifications (user_id, group_key)
+WHERE read_at IS NULL;
+CREATE INDEX notifications_user_idx ON notifications (user_id, created_at DESC, id DESC);
+
+-- Types a user has turned off. Anything missing is on.
+CREATE TABLE notification_preferences (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, type)
+);
+
+-- +goose Down
+DROP TABLE notification_preferences;
+DROP TABLE notifications;
@@ -0,0 +1,8 @@
+// Package schema embeds chirpy's goose migrations, so the binary can apply
+// them itself. sqlc reads the same files to learn the schema.
+package schema
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS